@@ -2,9 +2,13 @@
 package main
 
 import (
+	"log"
+
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/app"
 )
 
 func main() {
-	app.Run()
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
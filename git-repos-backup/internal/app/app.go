@@ -2,16 +2,28 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/git"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/metrics"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/notify"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/state"
 	"github.com/adeotek/adeotek-tools/git-repos-backup/pkg/filter"
 )
 
@@ -20,179 +32,698 @@ const (
 	Version = "0.1.2"
 )
 
-// Run executes the main application logic
-func Run() {
+// Run executes the main application logic.
+// It returns an error when the configuration is invalid or the backup did not complete for every provider.
+func Run() error {
+	// Mask secrets in all the log messages
+	log.SetOutput(output.Stderr)
+
+	// Commands
+	args := os.Args[1:]
+	daemon := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return Validate(args[1:])
+		case "daemon":
+			daemon = true
+			args = args[1:]
+		}
+	}
+
 	// Define command-line flags
 	configPath := flag.String("config", "", "Path to configuration file (default: config.yaml)")
-	providerType := flag.String("provider", "", "Provider type (gitea or github)")
-	serverURL := flag.String("server-url", "", "URL of the Git server (required for Gitea, optional for GitHub)")
-	accessToken := flag.String("token", "", "API token for authentication")
-	username := flag.String("username", "", "Username for basic authentication")
-	password := flag.String("password", "", "Password for basic authentication")
-	useBasicAuth := flag.Bool("use-basic-auth", false, "Whether to use basic authentication")
-	skipSSLValidation := flag.Bool("skip-ssl", false, "Whether to skip SSL validation")
-	includeRepos := flag.String("include", "", "Comma-separated list of repository full names to include")
-	excludeRepos := flag.String("exclude", "", "Comma-separated list of repository full names to exclude")
-	targetDir := flag.String("target-dir", "", "Directory to clone repositories into")
+	flag.String("provider", "", "Provider type (gitea, github or gitlab)")
+	flag.String("server-url", "", "URL of the Git server (required for Gitea, optional for GitHub and GitLab)")
+	flag.String("token", "", "API token for authentication")
+	flag.String("username", "", "Username for basic authentication")
+	flag.String("password", "", "Password for basic authentication")
+	flag.Bool("use-basic-auth", false, "Whether to use basic authentication")
+	flag.Bool("skip-ssl", false, "Whether to skip SSL validation")
+	flag.String("include", "", "Comma-separated list of repository full names or patterns to include")
+	flag.String("exclude", "", "Comma-separated list of repository full names or patterns to exclude")
+	flag.Bool("skip-forks", false, "Whether to skip forked repositories")
+	flag.Bool("skip-archived", false, "Whether to skip archived repositories")
+	flag.String("visibility", "", "Repositories to back up by visibility (private, public or all)")
+	flag.String("transport", "", "Transport used for git operations (https or ssh)")
+	flag.String("ssh-key-file", "", "Private key file for the SSH transport")
+	flag.String("known-hosts-file", "", "Known hosts file for the SSH transport")
+	flag.Bool("strict-host-key-checking", false, "Whether to reject SSH hosts missing from the known hosts")
+	flag.String("refs", "", "Refs to back up (heads-tags or all)")
+	flag.Bool("include-pull-requests", false, "Whether to back up pull (merge) request refs")
+	flag.Bool("include-metadata", false, "Whether to export issues, pull requests, comments, labels and milestones (Gitea and GitHub)")
+	flag.Bool("include-wikis", false, "Whether to back up the repository wikis (Gitea and GitHub)")
+	flag.Bool("include-releases", false, "Whether to export the releases and download their assets (Gitea and GitHub)")
+	flag.String("max-asset-size", "0", "Size above which release assets are not downloaded, 0 for no limit (e.g. 500MB)")
+	flag.Bool("lfs", false, "Whether to fetch the Git LFS objects of the repositories")
+	flag.String("target-dir", "", "Directory to clone repositories into")
+	flag.Int("concurrency", 0, "Number of repositories to fetch in parallel (overrides the config file global value)")
+	reportJSON := flag.String("report-json", "", "Path of a JSON file the run report is written to")
+	full := flag.Bool("full", false, "Whether to fetch all the repositories, including the ones unchanged since the last backup")
+	flag.String("schedule", "", "Cron expression or @every interval of the backups in daemon mode (overrides the config file global value)")
+	flag.Duration("jitter", 0, "Maximum random delay added to the scheduled backups in daemon mode (e.g. 5m)")
+	flag.String("http-listen", "", "Address of the /metrics and /healthz listener in daemon mode (e.g. :9090)")
+	flag.Duration("health-max-age", 0, "Age of the last successful backup above which /healthz reports unhealthy (e.g. 26h)")
+	runOnStart := flag.Bool("run-on-start", false, "Whether to back up all providers when the daemon starts, before following the schedules")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
 	verbose := flag.Bool("verbose", false, "Show all messages")
 	showHelp := flag.Bool("help", false, "Show help message and exit")
 
+	// The options that are not configuration values default to their environment variables
+	for name, envName := range flagEnvVars {
+		if value := os.Getenv(envName); value != "" {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s environment variable: %w", envName, err)
+			}
+		}
+	}
+
 	// Parse command-line flags
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	// Show version
-	fmt.Printf("git-repos-backup version %s (%s/%s)\n", Version, runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(output.Stdout, "git-repos-backup version %s (%s/%s)\n", Version, runtime.GOOS, runtime.GOARCH)
 
 	if *showVersion {
-		return
+		return nil
 	}
 
 	// Show help if requested
 	if *showHelp {
 		PrintUsage()
-		return
+		return nil
 	}
 
-	var cfg *config.Config
-	var err error
-
-	// Check if using config file or command-line arguments
-	if *configPath != "" {
-		// Load configuration from file
-		if *verbose {
-			fmt.Printf("----> Loading configuration from file: %s\n", *configPath)
+	// Configuration values set by flags, which take precedence over the environment and the config file
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			overrides[key] = f.Value.String()
 		}
-		cfg, err = config.Load(*configPath)
-		if err != nil {
-			log.Fatalf("Failed to load config: %v", err)
-		}
-	} else if *providerType != "" {
-		// Check if required parameters are provided
-		if *targetDir == "" {
-			log.Fatalf("Target directory is required when not using a config file")
-		}
-
-		// Parse include/exclude repositories
-		var include, exclude []string
-		if *includeRepos != "" {
-			include = splitCommaSeparatedList(*includeRepos)
-		}
-		if *excludeRepos != "" && *includeRepos == "" {
-			exclude = splitCommaSeparatedList(*excludeRepos)
-		}
-
-		// Create configuration from arguments
-		if *verbose {
-			fmt.Printf("----> Creating configuration from command-line arguments\n")
-		}
-		cfg = config.CreateFromArgs(
-			*providerType,
-			*serverURL,
-			*accessToken,
-			*username,
-			*password,
-			*useBasicAuth,
-			*skipSSLValidation,
-			include,
-			exclude,
-			*targetDir,
-		)
-	} else {
-		// Default to config.yaml in current directory if exists
-		defaultConfig := "config.yaml"
-		if _, err := os.Stat(defaultConfig); err == nil {
-			if *verbose {
-				fmt.Printf("----> Loading configuration from default file: %s\n", defaultConfig)
-			}
-			cfg, err = config.Load(defaultConfig)
-			if err != nil {
-				log.Fatalf("Failed to load default config: %v", err)
-			}
+	})
+
+	configFile, err := resolveConfigFile(*configPath, overrides["providers[0].type"] != "")
+	if err != nil {
+		return err
+	}
+	warnUnknownEnvVars()
+
+	if *verbose {
+		if configFile != "" {
+			fmt.Fprintf(output.Stdout, "----> Loading configuration from file: %s\n", configFile)
 		} else {
-			log.Fatalf("No configuration provided. Either specify a config file with -config or provide required command-line arguments")
+			fmt.Fprintf(output.Stdout, "----> Creating configuration from environment variables and command-line arguments\n")
+		}
+	}
+	cfg, err := config.Build(configFile, os.Environ(), overrides, filter.CheckPatterns)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Register the credentials of all providers and notifications to be masked in the output
+	for _, provider := range cfg.Providers {
+		output.RegisterSecret(provider.AccessToken)
+		output.RegisterSecret(provider.Password)
+	}
+	for _, notification := range cfg.Notifications {
+		output.RegisterSecret(notification.Token)
+		output.RegisterSecret(notification.Password)
+	}
+
+	// Stop on SIGINT and SIGTERM, once the in-flight fetches are finished
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	opts := runOptions{reportJSON: *reportJSON, full: *full, verbose: *verbose}
+	if len(cfg.Notifications) > 0 {
+		if opts.notifier, err = notify.New(cfg.Notifications); err != nil {
+			return fmt.Errorf("failed to configure notifications: %w", err)
 		}
+		// Send the digests of the runs not notified yet before exiting
+		defer opts.notifier.Flush()
+	}
+	if daemon {
+		return runDaemon(ctx, cfg, *runOnStart, opts)
+	}
+	return runBackup(ctx, cfg, cfg.Providers, opts)
+}
+
+// defaultConfigFile is the config file used when none is specified
+const defaultConfigFile = "config.yaml"
+
+// errNoConfig is returned when neither a config file nor a provider is given
+var errNoConfig = errors.New("no configuration provided: either specify a config file with -config or provide required command-line arguments")
+
+// resolveConfigFile returns the config file to load: configFile when set, otherwise config.yaml of the current
+// directory, unless a provider is set by flags (providerFlag) or environment variables, in which case
+// the configuration is built from them only and no file is returned
+func resolveConfigFile(configFile string, providerFlag bool) (string, error) {
+	providerGiven := providerFlag ||
+		os.Getenv(config.EnvPrefix+"PROVIDER") != "" || os.Getenv(config.EnvPrefix+"PROVIDERS_0_TYPE") != ""
+	if configFile != "" || providerGiven {
+		return configFile, nil
+	}
+	if _, err := os.Stat(defaultConfigFile); err != nil {
+		return "", errNoConfig
+	}
+	return defaultConfigFile, nil
+}
+
+// warnUnknownEnvVars logs the `GB_*` environment variables that are ignored, e.g. misspelled or renamed ones
+func warnUnknownEnvVars() {
+	known := make([]string, 0, len(flagEnvVars))
+	for _, name := range flagEnvVars {
+		known = append(known, name)
+	}
+	for _, name := range config.UnknownEnvVars(os.Environ(), known...) {
+		log.Printf("Warning: ignoring unknown environment variable %s", name)
 	}
+}
+
+// flagEnvVars maps the flags that are not configuration values to the environment variables
+// they default to
+var flagEnvVars = map[string]string{
+	"config":       config.EnvPrefix + "CONFIG",
+	"full":         config.EnvPrefix + "FULL",
+	"report-json":  config.EnvPrefix + "REPORT_JSON",
+	"run-on-start": config.EnvPrefix + "RUN_ON_START",
+	"verbose":      config.EnvPrefix + "VERBOSE",
+}
 
+// flagKeys maps the flags setting configuration values to their configuration keys (see config.Config.Set).
+// The provider flags set the first provider.
+var flagKeys = map[string]string{
+	"provider":                 "providers[0].type",
+	"server-url":               "providers[0].server_url",
+	"token":                    "providers[0].access_token",
+	"username":                 "providers[0].username",
+	"password":                 "providers[0].password",
+	"use-basic-auth":           "providers[0].use_basic_auth",
+	"skip-ssl":                 "providers[0].skip_ssl_validation",
+	"include":                  "providers[0].include",
+	"exclude":                  "providers[0].exclude",
+	"skip-forks":               "providers[0].skip_forks",
+	"skip-archived":            "providers[0].skip_archived",
+	"visibility":               "providers[0].visibility",
+	"transport":                "providers[0].transport",
+	"ssh-key-file":             "providers[0].ssh_key_file",
+	"known-hosts-file":         "providers[0].known_hosts_file",
+	"strict-host-key-checking": "providers[0].strict_host_key_checking",
+	"refs":                     "providers[0].refs",
+	"include-pull-requests":    "providers[0].include_pull_requests",
+	"include-metadata":         "providers[0].include_metadata",
+	"include-wikis":            "providers[0].include_wikis",
+	"include-releases":         "providers[0].include_releases",
+	"max-asset-size":           "providers[0].max_asset_size",
+	"lfs":                      "providers[0].lfs",
+	"target-dir":               "providers[0].target_dir",
+	"concurrency":              "concurrency",
+	"schedule":                 "schedule",
+	"jitter":                   "jitter",
+	"http-listen":              "http_listen",
+	"health-max-age":           "health_max_age",
+}
+
+// runOptions holds the command-line options of the backup runs
+type runOptions struct {
+	reportJSON string
+	// full disables the incremental backups: all the repositories are fetched
+	full    bool
+	verbose bool
+	// metrics records the outcome of the runs, when enabled
+	metrics *metrics.Metrics
+	// notifier sends the summaries of the runs, when notifications are configured
+	notifier *notify.Notifier
+}
+
+// runBackup backs up the providers and writes the run report.
+// When ctx is cancelled, the in-flight fetches are finished and the remaining ones are reported as failed.
+// It returns an error when the backup did not complete for every provider.
+func runBackup(ctx context.Context, cfg *config.Config, providers []config.ProviderConfig, opts runOptions) error {
 	// Process each provider
-	for i, provider := range cfg.Providers {
-		providerName := string(provider.Type)
-		if *verbose {
-			fmt.Printf("----> Processing provider %d: %s\n", i+1, providerName)
+	runReport := report.New(Version)
+	for i, provider := range providers {
+		providerName := provider.Label()
+		if opts.verbose {
+			fmt.Fprintf(output.Stdout, "----> Processing provider %d: %s\n", i+1, providerName)
 		}
 
-		// Create target directory if it doesn't exist
-		if err := os.MkdirAll(provider.TargetDir, 0755); err != nil {
-			log.Fatalf("Failed to create target directory: %v", err)
+		providerReport := runReport.AddProvider(providerName, string(provider.Type), provider.ServerURL, provider.TargetDir)
+		if ctx.Err() != nil {
+			providerReport.Fail(errInterrupted)
+		} else {
+			processProvider(ctx, cfg, &provider, providerReport, opts.full, opts.verbose)
 		}
+		providerReport.Finish()
+	}
+	runReport.Finish()
+	if opts.metrics != nil {
+		opts.metrics.Record(runReport)
+	}
+	if opts.notifier != nil {
+		opts.notifier.Notify(runReport)
+	}
 
-		// Get list of repositories
-		repos, err := repository.GetRepositories(&provider, *verbose)
-		if err != nil {
-			log.Printf("Failed to get repositories from %s: %v", providerName, err)
-			continue
-		} else if *verbose {
-			fmt.Printf("----> %d repos found from %s\n", len(repos), providerName)
+	// Print the run report
+	fmt.Fprintln(output.Stdout)
+	runReport.WriteTable(output.Stdout)
+
+	if opts.reportJSON != "" {
+		if err := runReport.WriteJSON(opts.reportJSON); err != nil {
+			return fmt.Errorf("failed to write JSON report: %w", err)
 		}
+		if opts.verbose {
+			fmt.Fprintf(output.Stdout, "----> JSON report written to: %s\n", opts.reportJSON)
+		}
+	}
 
-		// Filter repositories based on include/exclude lists
-		repos = filter.FilterRepositories(repos, &provider, *verbose)
+	if !runReport.Success {
+		return fmt.Errorf("backup failed: %d failure(s), see the summary above", runReport.FailureCount())
+	}
 
-		if *verbose {
-			fmt.Printf("----> %d repos filtered from %s\n", len(repos), providerName)
+	return nil
+}
+
+// Validate checks the configuration and prints all its problems (the `validate` command).
+// The configuration is built from the config file and the environment variables, as by Run.
+// It returns an error when the configuration is not valid.
+func Validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := flags.String("config", "", "Path to the configuration file to check (default: config.yaml)")
+	if value := os.Getenv(flagEnvVars["config"]); value != "" {
+		if err := flags.Set("config", value); err != nil {
+			return err
 		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
 
-		// Clone each repository
-		for _, repo := range repos {
-			if *verbose {
-				fmt.Printf("----> Processing repo: %s\n", repo.FullName)
-			}
+	configFile, err := resolveConfigFile(*configPath, false)
+	if err != nil {
+		return err
+	}
+	warnUnknownEnvVars()
+	label := configFile
+	if label == "" {
+		label = "environment"
+	}
 
-			if err := git.FetchRepository(&provider, repo, *verbose); err != nil {
-				log.Printf("Failed to fetch repository %s: %v", repo.Name, err)
+	cfg, err := config.Build(configFile, os.Environ(), nil, filter.CheckPatterns)
+	var validationErr *config.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, problem := range validationErr.Problems {
+			// Only the problems found in the file have a line
+			if problem.Line > 0 {
+				fmt.Fprintf(output.Stdout, "%s: %s\n", configFile, problem)
+			} else {
+				fmt.Fprintln(output.Stdout, problem)
 			}
 		}
+		return fmt.Errorf("%s: %d problem(s) found", label, len(validationErr.Problems))
+	}
+	if err != nil {
+		return err
 	}
+
+	fmt.Fprintf(output.Stdout, "%s: valid configuration with %d provider(s)\n", label, len(cfg.Providers))
+	return nil
 }
 
-// splitCommaSeparatedList splits a comma-separated string into a slice of strings
-func splitCommaSeparatedList(list string) []string {
-	if list == "" {
-		return nil
+// processProvider backs up all the repositories of a provider, recording the outcome in providerReport.
+// Unless full is set, the repositories unchanged since the last backup are not fetched.
+func processProvider(ctx context.Context, cfg *config.Config, provider *config.ProviderConfig, providerReport *report.ProviderReport, full bool, verbose bool) {
+	providerName := providerReport.Name
+
+	// Create target directory if it doesn't exist
+	if err := os.MkdirAll(provider.TargetDir, 0755); err != nil {
+		log.Printf("Failed to create target directory for %s, skipping provider: %v", providerName, err)
+		providerReport.Fail(err)
+		return
+	}
+
+	// Get list of repositories
+	repos, err := repository.GetRepositories(provider, verbose)
+	if err != nil {
+		log.Printf("Failed to get repositories from %s, skipping provider: %v", providerName, err)
+		providerReport.Fail(err)
+		return
+	} else if verbose {
+		fmt.Fprintf(output.Stdout, "----> %d repos found from %s\n", len(repos), providerName)
 	}
-	parts := strings.Split(list, ",")
-	result := make([]string, 0, len(parts))
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed != "" {
-			result = append(result, trimmed)
+
+	// Filter repositories based on include/exclude lists
+	filtered := filter.FilterRepositories(repos, provider, verbose)
+
+	if verbose {
+		fmt.Fprintf(output.Stdout, "----> %d repos filtered from %s\n", len(filtered), providerName)
+	}
+
+	// Report the repositories skipped by filters
+	included := make(map[string]bool, len(filtered))
+	for _, repo := range filtered {
+		included[repo.FullName] = true
+	}
+	for _, repo := range repos {
+		if !included[repo.FullName] {
+			providerReport.AddRepo(report.RepoReport{Name: repo.FullName, Status: report.StatusSkipped})
+		}
+	}
+
+	// Load the state of the previous backups, a full backup starts from an empty state
+	statePath := state.Path(provider.TargetDir)
+	backupState := state.New(stateOptions(provider))
+	if !full {
+		if backupState, err = state.Load(statePath, backupState.Options); err != nil {
+			log.Printf("Failed to load the backup state of %s, fetching all repositories: %v", providerName, err)
+		}
+	}
+
+	// Fetch repositories using a pool of workers
+	workers := cfg.ProviderConcurrency(provider)
+	if verbose {
+		fmt.Fprintf(output.Stdout, "----> Fetching %d repos from %s using %d worker(s)\n", len(filtered), providerName, workers)
+	}
+	names := make([]string, 0, len(filtered))
+	for _, result := range fetchRepositories(ctx, provider, backupState, filtered, workers, verbose) {
+		names = append(names, result.repo.FullName)
+		addRepoResult(providerReport, result)
+		if result.wiki != nil {
+			addRepoResult(providerReport, *result.wiki)
 		}
 	}
-	return result
+
+	// Only keep the state of the repositories still backed up
+	backupState.Prune(names)
+	if err := backupState.Save(statePath); err != nil {
+		log.Printf("Failed to save the backup state of %s, the next run will fetch all repositories: %v", providerName, err)
+	}
+}
+
+// stateOptions returns the fetch options recorded in the backup state.
+// When they change (e.g. other refs are backed up), all the repositories are fetched again.
+func stateOptions(provider *config.ProviderConfig) string {
+	refspecs, _ := git.FetchRefspecs(provider)
+	options := strings.Join(refspecs, " ")
+	if provider.LFS {
+		options += " lfs"
+	}
+	return options
+}
+
+// addRepoResult records the outcome of a repository fetch in providerReport, logging failures
+func addRepoResult(providerReport *report.ProviderReport, result fetchResult) {
+	if result.err != nil && !errors.Is(result.err, errInterrupted) && !errors.Is(result.err, git.ErrNoWiki) {
+		log.Printf("Failed to fetch repository %s: %v", result.repo.FullName, result.err)
+	}
+	providerReport.AddRepo(repoReport(result))
+}
+
+// repoReport converts the outcome of a repository fetch to its report entry
+func repoReport(result fetchResult) report.RepoReport {
+	entry := report.RepoReport{
+		Name:     result.repo.FullName,
+		Duration: report.Duration(result.duration),
+	}
+	if result.result != nil {
+		entry.BytesTransferred = result.result.BytesTransferred
+		entry.RefsChanged = result.result.RefsChanged
+		if lfs := result.result.LFS; lfs != nil {
+			entry.LFS = &report.LFSReport{Objects: lfs.Objects, Bytes: lfs.Size, Missing: lfs.Missing}
+		}
+	}
+
+	switch {
+	case errors.Is(result.err, git.ErrNoWiki):
+		entry.Status = report.StatusSkipped
+	case result.err != nil:
+		entry.Status = report.StatusFailed
+		entry.Error = result.err.Error()
+	case result.result != nil && result.result.Created:
+		entry.Status = report.StatusNew
+	case result.result != nil && result.result.RefsChanged > 0:
+		entry.Status = report.StatusUpdated
+	default:
+		entry.Status = report.StatusUnchanged
+	}
+
+	return entry
+}
+
+// fetchRepository is a variable that holds the function fetching a single repository.
+// It can be replaced in tests to mock git operations.
+var fetchRepository = git.FetchRepository
+
+// fetchWiki is a variable that holds the function fetching the wiki of a repository.
+// It can be replaced in tests to mock git operations.
+var fetchWiki = git.FetchWiki
+
+// listRefs is a variable that holds the function listing the refs of a backup repository.
+// It can be replaced in tests to mock git operations.
+var listRefs = git.ListRefs
+
+// remoteRefs is a variable that holds the function listing the refs of a remote repository.
+// It can be replaced in tests to mock git operations.
+var remoteRefs = git.RemoteRefs
+
+// exportMetadata is a variable that holds the function exporting the metadata of a repository.
+// It can be replaced in tests to mock the API requests.
+var exportMetadata = repository.ExportMetadata
+
+// exportReleases is a variable that holds the function exporting the releases of a repository.
+// It can be replaced in tests to mock the API requests.
+var exportReleases = repository.ExportReleases
+
+// backupRepository fetches a repository and backs up the provider data configured for it.
+// The fetch is skipped when backupState reports the repository unchanged since the last backup;
+// the metadata and releases, not covered by the push time, are still exported.
+func backupRepository(provider *config.ProviderConfig, backupState *state.State, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+	repoDir := git.RepoPath(provider.TargetDir, repo.Login, repo.Name)
+	// The push time alone can miss pushes (GitLab updates last_activity_at at most once an hour):
+	// the recorded refs must also match the refs of the backup and of the remote.
+	// A default branch change is not a push, so the fetch keeping HEAD on it is not skipped either.
+	current := func(recorded state.Repo) bool {
+		if local, err := listRefs(repoDir); err != nil || !maps.Equal(local, recorded.Refs) {
+			return false
+		}
+		remote, defaultBranch, err := remoteRefs(provider, repo)
+		if err != nil || !maps.Equal(remote, recorded.Refs) {
+			return false
+		}
+		if repo.DefaultBranch != "" {
+			defaultBranch = repo.DefaultBranch
+		}
+		return defaultBranch == recorded.DefaultBranch
+	}
+	var result *git.FetchResult
+	if backupState.Unchanged(repo.FullName, repo.PushedAt, current) {
+		if verbose {
+			fmt.Fprintf(output.Stdout, "----> Skipping fetch of %s, unchanged since the last backup\n", repo.FullName)
+		}
+		result = &git.FetchResult{RepoDir: repoDir}
+	} else {
+		var err error
+		result, err = fetchRepository(provider, repo, verbose)
+		if err != nil || result == nil {
+			// Fetch the repository again on the next run
+			backupState.Forget(repo.FullName)
+			return result, err
+		}
+		backupState.Record(repo.FullName, repo.PushedAt, result.Refs, result.DefaultBranch)
+	}
+
+	if provider.IncludeMetadata {
+		metadata, err := exportMetadata(provider, repo, repository.MetadataDir(result.RepoDir), verbose)
+		if err != nil {
+			return result, fmt.Errorf("failed to export metadata of %s: %w", repo.FullName, err)
+		}
+		if verbose {
+			fmt.Fprintf(output.Stdout, "----> Exported metadata of %s: %s\n", repo.FullName, metadata)
+		}
+	}
+
+	if provider.IncludeReleases {
+		releases, err := exportReleases(provider, repo, repository.MetadataDir(result.RepoDir), verbose)
+		if err != nil {
+			return result, fmt.Errorf("failed to export releases of %s: %w", repo.FullName, err)
+		}
+		if verbose {
+			fmt.Fprintf(output.Stdout, "----> Exported releases of %s: %s\n", repo.FullName, releases)
+		}
+	}
+
+	return result, nil
+}
+
+// backupWiki fetches the wiki of a repository, reported as a separate repository
+func backupWiki(provider *config.ProviderConfig, repo repository.Repository, verbose bool) *fetchResult {
+	start := time.Now()
+	result, err := fetchWiki(provider, repo, verbose)
+	if verbose && errors.Is(err, git.ErrNoWiki) {
+		fmt.Fprintf(output.Stdout, "----> No wiki to back up for %s\n", repo.FullName)
+	}
+	return &fetchResult{
+		repo:     git.WikiRepository(repo),
+		result:   result,
+		err:      err,
+		duration: time.Since(start),
+	}
+}
+
+// errInterrupted is reported for the providers and repositories not backed up because of a shutdown
+var errInterrupted = errors.New("backup interrupted by shutdown")
+
+// fetchResult holds the outcome of fetching a single repository
+type fetchResult struct {
+	repo     repository.Repository
+	result   *git.FetchResult
+	err      error
+	duration time.Duration
+	// wiki is the outcome of fetching the wiki of the repository, if wikis are backed up
+	wiki *fetchResult
+}
+
+// fetchRepositories fetches repositories using a pool of concurrency workers, recording them in backupState.
+// Results are returned in the same order as repos.
+func fetchRepositories(ctx context.Context, provider *config.ProviderConfig, backupState *state.State, repos []repository.Repository, concurrency int, verbose bool) []fetchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(repos) {
+		concurrency = len(repos)
+	}
+
+	results := make([]fetchResult, len(repos))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				repo := repos[i]
+				if verbose {
+					fmt.Fprintf(output.Stdout, "----> Processing repo: %s\n", repo.FullName)
+				}
+				// Each worker writes its own slots only, so no locking is needed
+				start := time.Now()
+				result, err := backupRepository(provider, backupState, repo, verbose)
+				results[i] = fetchResult{
+					repo:     repo,
+					result:   result,
+					err:      err,
+					duration: time.Since(start),
+				}
+				if provider.IncludeWikis {
+					results[i].wiki = backupWiki(provider, repo, verbose)
+				}
+			}
+		}()
+	}
+
+	// Stop dispatching repositories on shutdown: the in-flight fetches are finished,
+	// the remaining repositories are reported as interrupted
+	dispatched := 0
+dispatch:
+	for ; dispatched < len(repos); dispatched++ {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- dispatched:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := dispatched; i < len(repos); i++ {
+		results[i] = fetchResult{repo: repos[i], err: errInterrupted}
+	}
+
+	return results
 }
 
 // PrintUsage displays the command-line usage information
 func PrintUsage() {
-	fmt.Println("Git Repos Backup - Backup multiple Git repositories from Gitea and GitHub")
+	fmt.Println("Git Repos Backup - Backup multiple Git repositories from Gitea, GitHub and GitLab")
 	fmt.Println("\nUsage:")
 	fmt.Println("  git-repos-backup [flags]")
+	fmt.Println("  git-repos-backup daemon [flags]")
+	fmt.Println("  git-repos-backup validate [-config /path/to/config.yaml]")
 	fmt.Println("\nFlags:")
 	flag.PrintDefaults()
+	fmt.Println("\nEnvironment variables:")
+	fmt.Println("  GB_<KEY>, GB_PROVIDERS_<n>_<KEY> and GB_NOTIFICATIONS_<n>_<KEY> set the configuration file keys")
+	fmt.Println("  (e.g. GB_CONCURRENCY, GB_PROVIDERS_0_ACCESS_TOKEN, GB_NOTIFICATIONS_0_URL),")
+	fmt.Println("  GB_CONFIG, GB_VERBOSE, GB_REPORT_JSON and GB_RUN_ON_START the flags of the same name.")
+	fmt.Println("  Flags take precedence over environment variables, which take precedence over the configuration file.")
 	fmt.Println("\nConfiguration Examples:")
 	fmt.Println("\n1. Using config file:")
-	fmt.Println("   git-repos-backup -config /path/to/config.yaml [-verbose]")
+	fmt.Println("   git-repos-backup -config /path/to/config.yaml [-full] [-verbose]")
 	fmt.Println("\n2. Using command-line arguments:")
 	fmt.Println("   git-repos-backup -provider github -token your_github_token -target-dir /path/to/backups [-verbose]")
+	fmt.Println("\n3. Checking a config file, reporting all its problems with their line numbers:")
+	fmt.Println("   git-repos-backup validate -config /path/to/config.yaml")
+	fmt.Println("\n4. Running as a daemon, backing up on schedules:")
+	fmt.Println("   git-repos-backup daemon -config /path/to/config.yaml [-schedule \"0 3 * * *\"] [-jitter 10m] [-run-on-start] [-http-listen :9090]")
 	fmt.Println("\nConfiguration file (YAML):")
 	fmt.Println("  providers:")
-	fmt.Println("    - type: gitea|github")
-	fmt.Println("      server_url: URL of the Git server (for GitHub Enterprise)")
+	fmt.Println("    - name: Label of the provider used in reports (optional)")
+	fmt.Println("      type: gitea|github|gitlab")
+	fmt.Println("      server_url: URL of the Git server (for GitHub Enterprise or self-managed GitLab)")
 	fmt.Println("      access_token: API token for authentication (if use_basic_auth is false)")
+	fmt.Println("      access_token_file: File the API token is read from (optional, instead of access_token)")
 	fmt.Println("      username: Username for basic authentication (if use_basic_auth is true)")
 	fmt.Println("      password: Password for basic authentication (if use_basic_auth is true)")
+	fmt.Println("      password_file: File the password is read from (optional, instead of password)")
 	fmt.Println("      use_basic_auth: Whether to use basic authentication (default: false)")
 	fmt.Println("      skip_ssl_validation: Whether to skip SSL validation (default: false)")
-	fmt.Println("      include: List of repository full names to include (optional)")
-	fmt.Println("      exclude: List of repository full names to exclude (optional, ignored if include is specified)")
+	fmt.Println("      ca_cert_file: Path to a PEM file with additional CA certificates to trust (optional)")
+	fmt.Println("      include: List of repository full names or patterns to include (optional)")
+	fmt.Println("      exclude: List of repository full names or patterns to exclude (optional, applied after include)")
+	fmt.Println("               Patterns: owner/repo (exact), owner/ (all repos of owner), owner/*-svc (glob), re:^owner/.*$ (regex)")
+	fmt.Println("      skip_forks: Set to true to skip forked repositories (optional)")
+	fmt.Println("      skip_archived: Set to true to skip archived repositories (optional)")
+	fmt.Println("      skip_mirrors: Set to true to skip mirror repositories (optional)")
+	fmt.Println("      skip_templates: Set to true to skip template repositories (optional, Gitea and GitHub only)")
+	fmt.Println("      include_wikis: Set to true to back up the repository wikis next to the repositories (optional, Gitea and GitHub only)")
+	fmt.Println("      include_releases: Set to true to export the releases and download their assets (optional, Gitea and GitHub only)")
+	fmt.Println("      max_asset_size: Size above which release assets are not downloaded, e.g. 500MB or 2GiB (optional, default: no limit)")
+	fmt.Println("      lfs: Set to true to fetch the Git LFS objects of the repositories (optional)")
+	fmt.Println("      visibility: Repositories to back up by visibility: private, public or all (optional, default: all)")
+	fmt.Println("      transport: Transport used for git operations: https or ssh (optional, default: https)")
+	fmt.Println("      ssh_key_file: Private key file for the SSH transport (optional)")
+	fmt.Println("      known_hosts_file: Known hosts file for the SSH transport (optional)")
+	fmt.Println("      strict_host_key_checking: Set to true to reject SSH hosts missing from the known hosts (optional)")
+	fmt.Println("      refs: Refs to back up: heads-tags, all or custom (optional, default: heads-tags)")
+	fmt.Println("      refspecs: List of refspecs to fetch when refs is custom (optional)")
+	fmt.Println("      include_pull_requests: Set to true to back up pull (merge) request refs (optional)")
+	fmt.Println("      include_metadata: Set to true to export issues, pull requests, comments, labels and milestones (optional, Gitea and GitHub only)")
+	fmt.Println("      groups: List of GitLab groups whose projects (including subgroups) are backed up (optional, GitLab only)")
 	fmt.Println("      target_dir: Directory to clone repositories into")
+	fmt.Println("      concurrency: Number of repositories to fetch in parallel (optional, overrides the global value)")
+	fmt.Println("      schedule: Schedule of the provider backups in daemon mode (optional, overrides the global value)")
+	fmt.Println("  concurrency: Number of repositories to fetch in parallel for all providers (default: 1)")
+	fmt.Println("  schedule: Cron expression, @daily, @hourly, ... or @every <interval> of the backups in daemon mode (default: @every 24h)")
+	fmt.Println("  jitter: Maximum random delay added to every scheduled backup in daemon mode (optional, e.g. 10m)")
+	fmt.Println("  http_listen: Address of the /metrics and /healthz listener in daemon mode (optional, e.g. :9090)")
+	fmt.Println("  health_max_age: Age of the last successful backup above which /healthz reports unhealthy (optional, e.g. 26h)")
+	fmt.Println("  notifications: Summaries of the runs sent after every run or as digests (optional)")
+	fmt.Println("    - name: Label of the notification used in logs (optional)")
+	fmt.Println("      type: webhook|slack|ntfy|gotify|email")
+	fmt.Println("      url: Webhook URL (webhook, slack), topic URL (ntfy) or server URL (gotify)")
+	fmt.Println("      token: Access token (ntfy, optional) or application token (gotify)")
+	fmt.Println("      token_file: File the token is read from (optional, instead of token)")
+	fmt.Println("      smtp_host: SMTP server (email)")
+	fmt.Println("      smtp_port: SMTP server port (email, default: 587)")
+	fmt.Println("      username: SMTP username (email, optional)")
+	fmt.Println("      password: SMTP password (email, optional)")
+	fmt.Println("      password_file: File the SMTP password is read from (optional, instead of password)")
+	fmt.Println("      from: Sender address (email)")
+	fmt.Println("      to: List of recipient addresses (email)")
+	fmt.Println("      on_failure_only: Set to true to skip the summaries of successful runs (optional)")
+	fmt.Println("      digest: Schedule of a single summary of the runs since the previous one (optional, daemon mode)")
 }
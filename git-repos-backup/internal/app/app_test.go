@@ -1,11 +1,27 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/git"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/notify"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/state"
 )
 
 func TestPrintUsage(t *testing.T) {
@@ -133,83 +149,677 @@ providers:
 	// when loading a valid config
 }
 
-func TestSplitCommaSeparatedList(t *testing.T) {
+func TestArgsConfig(t *testing.T) {
+	// Save original arguments
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	// Create a temp dir for target directory
+	tmpDir, err := os.MkdirTemp("", "git-repos-backup-args-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Mock arguments to use command-line args
+	os.Args = []string{
+		"git-repos-backup",
+		"-provider", "github",
+		"-token", "fake_token",
+		"-target-dir", tmpDir,
+		"-include", "owner/repo1,owner/repo2",
+	}
+
+	// Reset the flag package state to handle the new args
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	// Run the app with command-line args
+	// This will fail as we don't mock the API calls
+	// but we just want to test that it attempts to use command-line args
+	Run()
+
+	// No assertions needed - we're just making sure it doesn't panic
+	// when using command-line args
+}
+
+func TestFetchRepositories(t *testing.T) {
+	// Save the original fetch function and restore it after the test
+	oldFetchRepository := fetchRepository
+	defer func() { fetchRepository = oldFetchRepository }()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	fetchRepository = func(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if repo.Id%3 == 0 {
+			return &git.FetchResult{}, errors.New("fetch failed")
+		}
+		return &git.FetchResult{RefsChanged: 1}, nil
+	}
+
+	repos := make([]repository.Repository, 12)
+	for i := range repos {
+		repos[i] = repository.Repository{
+			Id:       i + 1,
+			FullName: fmt.Sprintf("owner/repo%d", i+1),
+		}
+	}
+
+	results := fetchRepositories(context.Background(), &config.ProviderConfig{}, nil, repos, 4, false)
+
+	// Results must keep the order of the repositories
+	if len(results) != len(repos) {
+		t.Fatalf("Expected %d results, got %d", len(repos), len(results))
+	}
+	for i, result := range results {
+		if result.repo.Id != repos[i].Id {
+			t.Errorf("Expected result %d for repo %d, got repo %d", i, repos[i].Id, result.repo.Id)
+		}
+		if (result.err != nil) != (repos[i].Id%3 == 0) {
+			t.Errorf("Unexpected error for repo %d: %v", repos[i].Id, result.err)
+		}
+	}
+
+	// The pool must never exceed the configured concurrency
+	if maxRunning > 4 {
+		t.Errorf("Expected at most 4 concurrent fetches, got %d", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Errorf("Expected repositories to be fetched concurrently, got %d concurrent fetch(es)", maxRunning)
+	}
+
+	// Wikis are fetched after their repository and returned with it
+	oldFetchWiki := fetchWiki
+	defer func() { fetchWiki = oldFetchWiki }()
+	fetchWiki = func(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+		if !repo.HasWiki {
+			return &git.FetchResult{}, git.ErrNoWiki
+		}
+		return &git.FetchResult{Created: true}, nil
+	}
+	repos[0].HasWiki = true
+	results = fetchRepositories(context.Background(), &config.ProviderConfig{IncludeWikis: true}, nil, repos[:2], 2, false)
+	if results[0].wiki == nil || results[0].wiki.repo.FullName != "owner/repo1.wiki" || results[0].wiki.err != nil {
+		t.Errorf("Expected the wiki of owner/repo1 to be fetched, got %+v", results[0].wiki)
+	}
+	if results[1].wiki == nil || !errors.Is(results[1].wiki.err, git.ErrNoWiki) {
+		t.Errorf("Expected owner/repo2 to have no wiki, got %+v", results[1].wiki)
+	}
+	if results = fetchRepositories(context.Background(), &config.ProviderConfig{}, nil, repos[:1], 1, false); results[0].wiki != nil {
+		t.Errorf("Expected no wiki fetch without include_wikis, got %+v", results[0].wiki)
+	}
+
+	// No repositories and invalid concurrency must not block
+	if results := fetchRepositories(context.Background(), &config.ProviderConfig{}, nil, nil, 0, false); len(results) != 0 {
+		t.Errorf("Expected no results, got %d", len(results))
+	}
+}
+
+func TestBackupRepository(t *testing.T) {
+	// Save the original functions and restore them after the test
+	oldFetchRepository, oldExportMetadata, oldExportReleases := fetchRepository, exportMetadata, exportReleases
+	defer func() {
+		fetchRepository, exportMetadata, exportReleases = oldFetchRepository, oldExportMetadata, oldExportReleases
+	}()
+
+	fetchRepository = func(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+		if repo.Name == "broken" {
+			return &git.FetchResult{}, errors.New("fetch failed")
+		}
+		return &git.FetchResult{RepoDir: filepath.Join("/backup", repo.FullName)}, nil
+	}
+	var exported []string
+	exportMetadata = func(provider *config.ProviderConfig, repo repository.Repository, dir string, verbose bool) (*repository.MetadataResult, error) {
+		exported = append(exported, dir)
+		if repo.Name == "noapi" {
+			return nil, errors.New("API request failed")
+		}
+		return &repository.MetadataResult{}, nil
+	}
+	exportReleases = func(provider *config.ProviderConfig, repo repository.Repository, dir string, verbose bool) (*repository.ReleasesResult, error) {
+		exported = append(exported, filepath.Join(dir, repository.ReleasesDir))
+		return &repository.ReleasesResult{}, nil
+	}
+
 	tests := []struct {
-		name     string
-		input    string
-		expected []string
+		name            string
+		includeMetadata bool
+		includeReleases bool
+		repo            string
+		wantErr         bool
+		wantExported    []string
 	}{
+		{name: "Without metadata", repo: "repo"},
+		{name: "With metadata", includeMetadata: true, repo: "repo", wantExported: []string{filepath.Join("/backup", "owner", "repo.metadata")}},
+		{name: "With releases", includeReleases: true, repo: "repo", wantExported: []string{filepath.Join("/backup", "owner", "repo.metadata", "releases")}},
+		{name: "Failed fetch", includeMetadata: true, repo: "broken", wantErr: true},
+		{name: "Failed export", includeMetadata: true, repo: "noapi", wantErr: true, wantExported: []string{filepath.Join("/backup", "owner", "noapi.metadata")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exported = nil
+			provider := &config.ProviderConfig{IncludeMetadata: tt.includeMetadata, IncludeReleases: tt.includeReleases}
+			repo := repository.Repository{Login: "owner", Name: tt.repo, FullName: "owner/" + tt.repo}
+
+			_, err := backupRepository(provider, nil, repo, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("backupRepository() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(exported) != len(tt.wantExported) || (len(exported) > 0 && exported[0] != tt.wantExported[0]) {
+				t.Errorf("Exported metadata to %v, want %v", exported, tt.wantExported)
+			}
+		})
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	// Save the original functions and restore them after the test
+	oldFetchRepository, oldListRefs, oldRemoteRefs := fetchRepository, listRefs, remoteRefs
+	defer func() { fetchRepository, listRefs, remoteRefs = oldFetchRepository, oldListRefs, oldRemoteRefs }()
+
+	fetched := 0
+	remoteBranch := ""
+	fetchRepository = func(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+		fetched++
+		if repo.Name == "broken" {
+			return &git.FetchResult{}, errors.New("fetch failed")
+		}
+		defaultBranch := repo.DefaultBranch
+		if defaultBranch == "" {
+			defaultBranch = remoteBranch
+		}
+		return &git.FetchResult{RefsChanged: 1, Refs: map[string]string{"refs/heads/main": "abc"}, DefaultBranch: defaultBranch}, nil
+	}
+	localRefs := map[string]string{"refs/heads/main": "abc"}
+	listRefs = func(repoDir string) (map[string]string, error) {
+		if repoDir != filepath.Join("/backup", "owner", "repo") && repoDir != filepath.Join("/backup", "owner", "broken") {
+			t.Errorf("listRefs() called for %s", repoDir)
+		}
+		return localRefs, nil
+	}
+	currentRefs := localRefs
+	remoteRefs = func(provider *config.ProviderConfig, repo repository.Repository) (map[string]string, string, error) {
+		return currentRefs, remoteBranch, nil
+	}
+
+	provider := &config.ProviderConfig{TargetDir: "/backup"}
+	backupState := state.New("")
+	pushedAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := repository.Repository{Login: "owner", Name: "repo", FullName: "owner/repo", PushedAt: pushedAt}
+
+	changedRefs := map[string]string{"refs/heads/main": "def"}
+	tests := []struct {
+		name          string
+		pushedAt      time.Time
+		localRefs     map[string]string
+		remoteRefs    map[string]string
+		defaultBranch string
+		remoteBranch  string
+		wantFetched   bool
+	}{
+		{name: "First backup", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs, wantFetched: true},
+		{name: "Unchanged repository", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs},
+		// The fetch keeps HEAD on the new default branch
+		{name: "Default branch changed", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs, defaultBranch: "develop", wantFetched: true},
+		{name: "Unchanged default branch", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs, defaultBranch: "develop"},
+		{name: "Remote default branch unchanged", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs, remoteBranch: "develop"},
+		{name: "Remote default branch changed", pushedAt: pushedAt, localRefs: localRefs, remoteRefs: localRefs, remoteBranch: "main", wantFetched: true},
+		{name: "New push", pushedAt: pushedAt.Add(time.Hour), localRefs: localRefs, remoteRefs: localRefs, wantFetched: true},
+		{name: "Backup refs changed", pushedAt: pushedAt.Add(time.Hour), localRefs: changedRefs, remoteRefs: localRefs, wantFetched: true},
+		// e.g. a GitLab push within the hour of the previous activity
+		{name: "Remote refs changed with the same push time", pushedAt: pushedAt.Add(time.Hour), localRefs: localRefs, remoteRefs: changedRefs, wantFetched: true},
+		{name: "Unknown push time", localRefs: localRefs, remoteRefs: localRefs, wantFetched: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched = 0
+			localRefs, currentRefs, remoteBranch = tt.localRefs, tt.remoteRefs, tt.remoteBranch
+			repo.PushedAt, repo.DefaultBranch = tt.pushedAt, tt.defaultBranch
+
+			result, err := backupRepository(provider, backupState, repo, false)
+			if err != nil {
+				t.Fatalf("backupRepository() error = %v", err)
+			}
+			if (fetched > 0) != tt.wantFetched {
+				t.Errorf("backupRepository() fetched = %v, want %v", fetched > 0, tt.wantFetched)
+			}
+			if want := filepath.Join("/backup", "owner", "repo"); !tt.wantFetched && result.RepoDir != want {
+				t.Errorf("backupRepository() RepoDir = %s, want %s", result.RepoDir, want)
+			}
+		})
+	}
+
+	// A failed fetch is retried by the next run
+	broken := repository.Repository{Login: "owner", Name: "broken", FullName: "owner/broken", PushedAt: pushedAt}
+	backupState.Record(broken.FullName, pushedAt.Add(-time.Hour), localRefs, "")
+	if _, err := backupRepository(provider, backupState, broken, false); err == nil {
+		t.Error("Expected error for failed fetch, got nil")
+	}
+	if _, ok := backupState.Repos[broken.FullName]; ok {
+		t.Error("Expected the failed repository to be removed from the state")
+	}
+}
+
+func TestRepoReport(t *testing.T) {
+	repo := repository.Repository{FullName: "owner/repo"}
+
+	tests := []struct {
+		name   string
+		result fetchResult
+		want   report.Status
+	}{
+		{
+			name:   "Failed fetch",
+			result: fetchResult{repo: repo, result: &git.FetchResult{}, err: errors.New("failed to fetch repository")},
+			want:   report.StatusFailed,
+		},
 		{
-			name:     "Empty string",
-			input:    "",
-			expected: nil,
+			name:   "New repository",
+			result: fetchResult{repo: repo, result: &git.FetchResult{Created: true, RefsChanged: 3}},
+			want:   report.StatusNew,
 		},
 		{
-			name:     "Single item",
-			input:    "repo1",
-			expected: []string{"repo1"},
+			name:   "Updated repository",
+			result: fetchResult{repo: repo, result: &git.FetchResult{RefsChanged: 1, BytesTransferred: 2048}},
+			want:   report.StatusUpdated,
 		},
 		{
-			name:     "Multiple items",
-			input:    "repo1,repo2,repo3",
-			expected: []string{"repo1", "repo2", "repo3"},
+			name:   "Unchanged repository",
+			result: fetchResult{repo: repo, result: &git.FetchResult{}},
+			want:   report.StatusUnchanged,
 		},
 		{
-			name:     "With spaces",
-			input:    " repo1 , repo2 , repo3 ",
-			expected: []string{"repo1", "repo2", "repo3"},
+			name:   "Missing wiki",
+			result: fetchResult{repo: repo, result: &git.FetchResult{}, err: git.ErrNoWiki},
+			want:   report.StatusSkipped,
 		},
 		{
-			name:     "With empty items",
-			input:    "repo1,,repo3",
-			expected: []string{"repo1", "repo3"},
+			name:   "Missing LFS objects",
+			result: fetchResult{repo: repo, result: &git.FetchResult{RefsChanged: 1, LFS: &git.LFSResult{Objects: 3, Size: 4096, Missing: 1}}},
+			want:   report.StatusUpdated,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := splitCommaSeparatedList(tt.input)
-			if len(result) != len(tt.expected) {
-				t.Fatalf("Expected %d items, got %d", len(tt.expected), len(result))
+			entry := repoReport(tt.result)
+			if entry.Status != tt.want {
+				t.Errorf("repoReport() status = %s, want %s", entry.Status, tt.want)
 			}
-			for i := range result {
-				if result[i] != tt.expected[i] {
-					t.Errorf("Expected %s at index %d, got %s", tt.expected[i], i, result[i])
-				}
+			if entry.Name != "owner/repo" {
+				t.Errorf("repoReport() name = %s, want owner/repo", entry.Name)
+			}
+			if entry.RefsChanged != tt.result.result.RefsChanged || entry.BytesTransferred != tt.result.result.BytesTransferred {
+				t.Errorf("repoReport() = %+v, does not match fetch result %+v", entry, tt.result.result)
+			}
+			if lfs := tt.result.result.LFS; lfs != nil &&
+				(entry.LFS == nil || *entry.LFS != (report.LFSReport{Objects: lfs.Objects, Bytes: lfs.Size, Missing: lfs.Missing})) {
+				t.Errorf("repoReport() LFS = %+v, want %+v", entry.LFS, lfs)
+			}
+			if (entry.Error != "") != (tt.want == report.StatusFailed) {
+				t.Errorf("repoReport() error = %q, want error %v", entry.Error, tt.result.err)
 			}
 		})
 	}
 }
 
-func TestArgsConfig(t *testing.T) {
+func TestReportJSON(t *testing.T) {
 	// Save original arguments
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
 
-	// Create a temp dir for target directory
-	tmpDir, err := os.MkdirTemp("", "git-repos-backup-args-test")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
+	tmpDir := t.TempDir()
+	reportPath := filepath.Join(tmpDir, "report.json")
 
-	// Mock arguments to use command-line args
+	// Nothing listens on the server port, so the run fails without any network access
 	os.Args = []string{
 		"git-repos-backup",
-		"-provider", "github",
-		"-token", "fake_token",
+		"-provider", "gitea",
+		"-server-url", "http://127.0.0.1:1",
 		"-target-dir", tmpDir,
-		"-include", "owner/repo1,owner/repo2",
+		"-report-json", reportPath,
 	}
 
 	// Reset the flag package state to handle the new args
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
-	// Run the app with command-line args
-	// This will fail as we don't mock the API calls
-	// but we just want to test that it attempts to use command-line args
+	if err := Run(); err == nil {
+		t.Error("Expected Run() to fail for an unreachable provider, got nil")
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Failed to read JSON report: %v", err)
+	}
+
+	var runReport report.Report
+	if err := json.Unmarshal(data, &runReport); err != nil {
+		t.Fatalf("Failed to parse JSON report: %v", err)
+	}
+	if runReport.Success || len(runReport.Providers) != 1 || runReport.Providers[0].Error == "" {
+		t.Errorf("Expected a failed provider in the JSON report, got %s", data)
+	}
+}
+
+func TestRunNotifications(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	var mu sync.Mutex
+	var summaries []notify.Summary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary notify.Summary
+		json.NewDecoder(r.Body).Decode(&summary)
+		mu.Lock()
+		summaries = append(summaries, summary)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// The digest of a single run is sent when it exits
+	t.Setenv("GB_NOTIFICATIONS_0_TYPE", "webhook")
+	t.Setenv("GB_NOTIFICATIONS_0_URL", server.URL)
+	t.Setenv("GB_NOTIFICATIONS_0_DIGEST", "@daily")
+	os.Args = []string{
+		"git-repos-backup",
+		"-provider", "gitea",
+		"-server-url", "http://127.0.0.1:1",
+		"-target-dir", t.TempDir(),
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	if err := Run(); err == nil {
+		t.Error("Expected Run() to fail for an unreachable provider, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(summaries) != 1 || summaries[0].Success || len(summaries[0].Failures) != 1 {
+		t.Errorf("Expected the summary of the failed run, got %+v", summaries)
+	}
+}
+
+func TestRunConfigErrors(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "No configuration", wantErr: errNoConfig.Error()},
+		{name: "Missing config file", args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, wantErr: "failed to load config"},
+		{name: "Invalid provider", args: []string{"-provider", "svn", "-target-dir", t.TempDir()}, wantErr: "failed to load config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Args = append([]string{"git-repos-backup"}, tt.args...)
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+			if err := Run(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	validConfig := `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+`
+
+	tests := []struct {
+		name       string
+		content    string
+		env        map[string]string
+		args       []string
+		wantErr    string
+		wantOutput string
+	}{
+		{
+			name:       "Valid config",
+			content:    validConfig,
+			args:       []string{"-config", configPath},
+			wantOutput: configPath + ": valid configuration with 1 provider(s)",
+		},
+		{
+			name: "Invalid config",
+			content: `providers:
+  - type: github
+    target_dir: /backup
+    include:
+      - re:(
+    skip_fork: true
+`,
+			args:       []string{"-config", configPath},
+			wantErr:    configPath + ": 3 problem(s) found",
+			wantOutput: configPath + ": line 6: providers[0].skip_fork: unknown key",
+		},
+		{
+			name:       "Config file from GB_CONFIG",
+			content:    validConfig,
+			env:        map[string]string{"GB_CONFIG": configPath},
+			wantOutput: configPath + ": valid configuration with 1 provider(s)",
+		},
+		{
+			name:       "Environment configuration",
+			env:        map[string]string{"GB_PROVIDER": "github", "GB_TOKEN": "token", "GB_TARGET_DIR": "/backup"},
+			wantOutput: "environment: valid configuration with 1 provider(s)",
+		},
+		{
+			name:       "Invalid environment variable",
+			content:    validConfig,
+			env:        map[string]string{"GB_JITTER": "soon"},
+			args:       []string{"-config", configPath},
+			wantErr:    configPath + ": 1 problem(s) found",
+			wantOutput: "\nGB_JITTER: invalid duration \"soon\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test config file: %v", err)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			// Capture the printed problems
+			oldStdout := os.Stdout
+			r, w, _ := os.Pipe()
+			os.Stdout = w
+			err := Validate(tt.args)
+			w.Close()
+			os.Stdout = oldStdout
+			out, _ := io.ReadAll(r)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+			if !strings.Contains("\n"+string(out), tt.wantOutput) {
+				t.Errorf("Validate() output = %q, want %q", out, tt.wantOutput)
+			}
+		})
+	}
+
+	// Without config file nor provider
+	if err := Validate(nil); !errors.Is(err, errNoConfig) {
+		t.Errorf("Validate() error = %v, want %v", err, errNoConfig)
+	}
+}
+
+func TestFetchRepositoriesShutdown(t *testing.T) {
+	oldFetchRepository := fetchRepository
+	defer func() { fetchRepository = oldFetchRepository }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The shutdown is requested while the first repository is fetched
+	fetchRepository = func(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*git.FetchResult, error) {
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		return &git.FetchResult{RefsChanged: 1}, nil
+	}
+
+	repos := []repository.Repository{{Id: 1, FullName: "owner/repo1"}, {Id: 2, FullName: "owner/repo2"}, {Id: 3, FullName: "owner/repo3"}}
+	results := fetchRepositories(ctx, &config.ProviderConfig{}, nil, repos, 1, false)
+
+	if len(results) != len(repos) {
+		t.Fatalf("Expected %d results, got %d", len(repos), len(results))
+	}
+	if results[0].err != nil || results[0].result == nil {
+		t.Errorf("Expected the in-flight fetch to finish, got %v", results[0].err)
+	}
+	for _, result := range results[1:] {
+		if !errors.Is(result.err, errInterrupted) || result.repo.FullName == "" {
+			t.Errorf("Expected %s to be interrupted, got %v", result.repo.FullName, result.err)
+		}
+	}
+}
+
+func TestScheduleJobs(t *testing.T) {
+	cfg := &config.Config{
+		Schedule: "0 3 * * *",
+		Providers: []config.ProviderConfig{
+			{Name: "first", Type: config.ProviderGitHub},
+			{Name: "second", Type: config.ProviderGitLab, Schedule: "@hourly"},
+			{Name: "third", Type: config.ProviderGitea},
+		},
+	}
+
+	jobs, err := scheduleJobs(cfg)
+	if err != nil {
+		t.Fatalf("scheduleJobs() error = %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(jobs))
+	}
+	if jobs[0].expr != "0 3 * * *" || jobs[0].name() != "first, third" {
+		t.Errorf("Expected first job `0 3 * * *` for first, third, got `%s` for %s", jobs[0].expr, jobs[0].name())
+	}
+	if jobs[1].expr != "@hourly" || jobs[1].name() != "second" {
+		t.Errorf("Expected second job `@hourly` for second, got `%s` for %s", jobs[1].expr, jobs[1].name())
+	}
+
+	// Without any schedule, providers are backed up daily
+	jobs, err = scheduleJobs(&config.Config{Providers: []config.ProviderConfig{{Type: config.ProviderGitHub}}})
+	if err != nil || len(jobs) != 1 || jobs[0].expr != config.DefaultSchedule {
+		t.Errorf("scheduleJobs() = %v, %v, want a single %s job", jobs, err, config.DefaultSchedule)
+	}
+}
+
+func TestRunDaemon(t *testing.T) {
+	oldScheduledBackup := scheduledBackup
+	defer func() { scheduledBackup = oldScheduledBackup }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var runs [][]string
+	running := false
+	scheduledBackup = func(ctx context.Context, cfg *config.Config, providers []config.ProviderConfig, opts runOptions) error {
+		mu.Lock()
+		if running {
+			t.Error("Expected backups not to overlap")
+		}
+		running = true
+		var names []string
+		for _, provider := range providers {
+			names = append(names, provider.Name)
+		}
+		runs = append(runs, names)
+		if len(runs) == 2 {
+			cancel()
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running = false
+		mu.Unlock()
+		return nil
+	}
+
+	cfg := &config.Config{
+		Providers: []config.ProviderConfig{
+			{Name: "frequent", Type: config.ProviderGitHub, Schedule: "@every 1s"},
+			{Name: "daily", Type: config.ProviderGitLab, Schedule: "@daily"},
+		},
+	}
+
+	done := make(chan error)
+	go func() { done <- runDaemon(ctx, cfg, true, runOptions{}) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runDaemon() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the daemon to stop on shutdown")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]string{{"frequent", "daily"}, {"frequent"}}
+	if fmt.Sprint(runs) != fmt.Sprint(want) {
+		t.Errorf("Expected runs %v, got %v", want, runs)
+	}
+}
+
+func TestFlagKeys(t *testing.T) {
+	// Every configuration flag must be defined and set a configuration key
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	oldCommandLine := flag.CommandLine
+	defer func() { flag.CommandLine = oldCommandLine }()
+	flag.CommandLine = flags
+
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"git-repos-backup", "-version"}
 	Run()
 
-	// No assertions needed - we're just making sure it doesn't panic
-	// when using command-line args
+	for name, key := range flagKeys {
+		f := flags.Lookup(name)
+		if f == nil {
+			t.Errorf("Flag -%s is not defined", name)
+			continue
+		}
+		if err := (&config.Config{}).Set(key, f.DefValue); err != nil {
+			t.Errorf("Flag -%s sets an invalid key %s: %v", name, key, err)
+		}
+	}
+	for name := range flagEnvVars {
+		if flags.Lookup(name) == nil {
+			t.Errorf("Flag -%s is not defined", name)
+		}
+	}
 }
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/metrics"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/schedule"
+)
+
+// scheduledBackup is a variable that holds the function running the backups of a job.
+// It can be replaced in tests to mock the backups.
+var scheduledBackup = runBackup
+
+// job is a set of providers backed up on the same schedule
+type job struct {
+	expr      string
+	schedule  schedule.Schedule
+	providers []config.ProviderConfig
+	next      time.Time
+}
+
+// name returns a human readable identifier of the job
+func (j *job) name() string {
+	names := make([]string, len(j.providers))
+	for i := range j.providers {
+		names[i] = j.providers[i].Label()
+	}
+	return strings.Join(names, ", ")
+}
+
+// scheduleJobs groups the providers by schedule, in the order of the configuration
+func scheduleJobs(cfg *config.Config) ([]*job, error) {
+	var jobs []*job
+	byExpr := make(map[string]*job)
+	for _, provider := range cfg.Providers {
+		expr := cfg.ProviderSchedule(&provider)
+		j, ok := byExpr[expr]
+		if !ok {
+			s, err := schedule.Parse(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", provider.Label(), err)
+			}
+			j = &job{expr: expr, schedule: s}
+			byExpr[expr] = j
+			jobs = append(jobs, j)
+		}
+		j.providers = append(j.providers, provider)
+	}
+	return jobs, nil
+}
+
+// nextRun returns the next run time of a job after t, delayed by a random jitter
+func nextRun(j *job, t time.Time, jitter time.Duration) time.Time {
+	next := j.schedule.Next(t)
+	if jitter > 0 && !next.IsZero() {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+// serveMetrics serves the metrics and the health check on addr.
+// It returns the function shutting the listener down.
+func serveMetrics(addr string, m *metrics.Metrics) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+
+	server := &http.Server{Handler: m.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics listener failed: %v", err)
+		}
+	}()
+	log.Printf("Serving /metrics and /healthz on %s", listener.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// runDaemon backs up the providers on their schedules until ctx is cancelled.
+// Jobs never overlap: a job due while another one runs is started once the running one is finished.
+// On shutdown, the in-flight fetches are finished before returning.
+func runDaemon(ctx context.Context, cfg *config.Config, runOnStart bool, opts runOptions) error {
+	jobs, err := scheduleJobs(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.HTTPListen != "" {
+		opts.metrics = metrics.New(cfg.HealthMaxAge)
+		for i := range cfg.Providers {
+			opts.metrics.AddProvider(cfg.Providers[i].Label())
+		}
+		shutdown, err := serveMetrics(cfg.HTTPListen, opts.metrics)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+	}
+
+	if opts.notifier != nil {
+		// The digests left when stopping are sent by the caller, once the last run is finished
+		digestsDone := make(chan struct{})
+		go func() {
+			opts.notifier.Run(ctx)
+			close(digestsDone)
+		}()
+		defer func() { <-digestsDone }()
+	}
+
+	log.Printf("Daemon started with %d schedule(s)", len(jobs))
+	if runOnStart {
+		log.Printf("Starting backup of all providers")
+		if err := scheduledBackup(ctx, cfg, cfg.Providers, opts); err != nil {
+			log.Printf("Backup of all providers failed: %v", err)
+		}
+	}
+
+	for _, j := range jobs {
+		j.next = nextRun(j, time.Now(), cfg.Jitter)
+		log.Printf("Next backup of %s (%s): %s", j.name(), j.expr, j.next.Format(time.RFC3339))
+	}
+
+	for {
+		if ctx.Err() != nil {
+			log.Printf("Daemon stopped")
+			return nil
+		}
+
+		// Wait for the first due job
+		due := jobs[0]
+		for _, j := range jobs[1:] {
+			if j.next.Before(due.next) {
+				due = j
+			}
+		}
+		timer := time.NewTimer(time.Until(due.next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("Daemon stopped")
+			return nil
+		case <-timer.C:
+		}
+
+		log.Printf("Starting scheduled backup of %s", due.name())
+		if err := scheduledBackup(ctx, cfg, due.providers, opts); err != nil {
+			log.Printf("Scheduled backup of %s failed: %v", due.name(), err)
+		}
+
+		due.next = nextRun(due, time.Now(), cfg.Jitter)
+		if ctx.Err() == nil {
+			log.Printf("Next backup of %s (%s): %s", due.name(), due.expr, due.next.Format(time.RFC3339))
+		}
+	}
+}
@@ -2,8 +2,14 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,69 +22,286 @@ const (
 	ProviderGitea ProviderType = "gitea"
 	// ProviderGitHub is for GitHub
 	ProviderGitHub ProviderType = "github"
+	// ProviderGitLab is for GitLab (gitlab.com or self-managed)
+	ProviderGitLab ProviderType = "gitlab"
 )
 
+// Transport selects the protocol git operations use
+type Transport string
+
+const (
+	// TransportHTTPS fetches repositories over HTTP(S) using the API clone URLs (default)
+	TransportHTTPS Transport = "https"
+	// TransportSSH fetches repositories over SSH using the API SSH URLs
+	TransportSSH Transport = "ssh"
+)
+
+// Visibility selects repositories by visibility
+type Visibility string
+
+const (
+	// VisibilityAll selects all repositories (default)
+	VisibilityAll Visibility = "all"
+	// VisibilityPrivate selects only repositories that are not publicly visible
+	VisibilityPrivate Visibility = "private"
+	// VisibilityPublic selects only publicly visible repositories
+	VisibilityPublic Visibility = "public"
+)
+
+// RefSet selects the refs fetched into the backup repositories
+type RefSet string
+
+const (
+	// RefSetHeadsTags fetches branches and tags (default)
+	RefSetHeadsTags RefSet = "heads-tags"
+	// RefSetAll fetches all the refs advertised by the server (notes, review refs, etc.)
+	RefSetAll RefSet = "all"
+	// RefSetCustom fetches the refspecs listed in the `refspecs` option
+	RefSetCustom RefSet = "custom"
+)
+
+// ByteSize is a size in bytes, configured as a number of bytes or with a unit (e.g. 500MB, 2GiB)
+type ByteSize int64
+
+// byteUnits maps the size units, in lower case, to their number of bytes
+var byteUnits = map[string]int64{
+	"": 1, "b": 1,
+	"kb": 1000, "mb": 1000 * 1000, "gb": 1000 * 1000 * 1000, "tb": 1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// ParseByteSize parses a size: a non-negative number optionally followed by a unit
+// (B, KB, MB, GB, TB or KiB, MiB, GiB, TiB)
+func ParseByteSize(value string) (ByteSize, error) {
+	s := strings.TrimSpace(value)
+	number, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	multiplier, ok := byteUnits[strings.ToLower(unit)]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(n * float64(multiplier)), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := ParseByteSize(node.Value)
+	if node.Kind != yaml.ScalarNode || err != nil {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: invalid size %q", node.Line, node.Value)}}
+	}
+	*b = size
+	return nil
+}
+
+// NotificationType selects the service run summaries are sent to
+type NotificationType string
+
+const (
+	// NotificationWebhook posts the summary as JSON to a URL
+	NotificationWebhook NotificationType = "webhook"
+	// NotificationSlack posts the summary to a Slack or Mattermost incoming webhook
+	NotificationSlack NotificationType = "slack"
+	// NotificationNtfy publishes the summary to an ntfy topic URL
+	NotificationNtfy NotificationType = "ntfy"
+	// NotificationGotify pushes the summary to a Gotify server
+	NotificationGotify NotificationType = "gotify"
+	// NotificationEmail sends the summary by email through an SMTP server
+	NotificationEmail NotificationType = "email"
+)
+
+// DefaultSMTPPort is the SMTP port used when not configured (message submission, with STARTTLS)
+const DefaultSMTPPort = 587
+
+// ImplicitTLSSMTPPort is the SMTP port of the message submission over implicit TLS
+const ImplicitTLSSMTPPort = 465
+
+const (
+	// SMTPTLSStartTLS upgrades the SMTP connection with STARTTLS, when the server supports it
+	// (default `smtp_tls`, except on port 465)
+	SMTPTLSStartTLS = "starttls"
+	// SMTPTLSImplicit connects to the SMTP server over TLS (default `smtp_tls` on port 465)
+	SMTPTLSImplicit = "implicit"
+)
+
+// NotificationConfig contains configuration for a notification of the backup runs
+type NotificationConfig struct {
+	Name string           `yaml:"name,omitempty"`
+	Type NotificationType `yaml:"type"`
+	// URL is the webhook URL, the ntfy topic URL or the Gotify server URL
+	URL string `yaml:"url,omitempty"`
+	// Token is the ntfy access token or the Gotify application token
+	Token        string   `yaml:"token,omitempty"`
+	TokenFile    string   `yaml:"token_file,omitempty"`
+	SMTPHost     string   `yaml:"smtp_host,omitempty"`
+	SMTPPort     int      `yaml:"smtp_port,omitempty"`
+	SMTPTLS      string   `yaml:"smtp_tls,omitempty"`
+	Username     string   `yaml:"username,omitempty"`
+	Password     string   `yaml:"password,omitempty"`
+	PasswordFile string   `yaml:"password_file,omitempty"`
+	From         string   `yaml:"from,omitempty"`
+	To           []string `yaml:"to,omitempty"`
+	// OnFailureOnly skips the summaries of successful runs
+	OnFailureOnly bool `yaml:"on_failure_only,omitempty"`
+	// Digest is the schedule of a single summary of all the runs since the previous one,
+	// instead of a summary per run (daemon mode)
+	Digest string `yaml:"digest,omitempty"`
+}
+
 // ProviderConfig contains configuration for a git provider
 type ProviderConfig struct {
+	Name              string       `yaml:"name,omitempty"`
 	Type              ProviderType `yaml:"type"`
 	ServerURL         string       `yaml:"server_url"`
 	AccessToken       string       `yaml:"access_token"`
+	AccessTokenFile   string       `yaml:"access_token_file,omitempty"`
 	Username          string       `yaml:"username"`
 	Password          string       `yaml:"password"`
+	PasswordFile      string       `yaml:"password_file,omitempty"`
 	UseBasicAuth      bool         `yaml:"use_basic_auth"`
 	SkipSslValidation bool         `yaml:"skip_ssl_validation"`
+	CACertFile        string       `yaml:"ca_cert_file,omitempty"`
+	Transport         Transport    `yaml:"transport,omitempty"`
+	SSHKeyFile        string       `yaml:"ssh_key_file,omitempty"`
+	KnownHostsFile    string       `yaml:"known_hosts_file,omitempty"`
+	StrictHostKey     bool         `yaml:"strict_host_key_checking,omitempty"`
 	Include           []string     `yaml:"include,omitempty"`
 	Exclude           []string     `yaml:"exclude,omitempty"`
+	SkipForks         bool         `yaml:"skip_forks,omitempty"`
+	SkipArchived      bool         `yaml:"skip_archived,omitempty"`
+	SkipMirrors       bool         `yaml:"skip_mirrors,omitempty"`
+	SkipTemplates     bool         `yaml:"skip_templates,omitempty"`
+	Visibility        Visibility   `yaml:"visibility,omitempty"`
+	Refs              RefSet       `yaml:"refs,omitempty"`
+	Refspecs          []string     `yaml:"refspecs,omitempty"`
+	IncludePulls      bool         `yaml:"include_pull_requests,omitempty"`
+	IncludeMetadata   bool         `yaml:"include_metadata,omitempty"`
+	IncludeWikis      bool         `yaml:"include_wikis,omitempty"`
+	IncludeReleases   bool         `yaml:"include_releases,omitempty"`
+	MaxAssetSize      ByteSize     `yaml:"max_asset_size,omitempty"`
+	LFS               bool         `yaml:"lfs,omitempty"`
+	Groups            []string     `yaml:"groups,omitempty"`
 	TargetDir         string       `yaml:"target_dir"`
+	Concurrency       int          `yaml:"concurrency,omitempty"`
+	Schedule          string       `yaml:"schedule,omitempty"`
 }
 
 // Config contains application configuration loaded from YAML
 type Config struct {
-	Providers []ProviderConfig `yaml:"providers"`
+	Concurrency int           `yaml:"concurrency,omitempty"`
+	Schedule    string        `yaml:"schedule,omitempty"`
+	Jitter      time.Duration `yaml:"jitter,omitempty"`
+	// HTTPListen is the address of the metrics and health check listener of the daemon (disabled when empty)
+	HTTPListen    string               `yaml:"http_listen,omitempty"`
+	HealthMaxAge  time.Duration        `yaml:"health_max_age,omitempty"`
+	Notifications []NotificationConfig `yaml:"notifications,omitempty"`
+	Providers     []ProviderConfig     `yaml:"providers"`
 }
 
-// Load loads configuration from the specified YAML file
-func Load(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+// DefaultConcurrency is the number of repositories fetched in parallel when not configured
+const DefaultConcurrency = 1
+
+// Label returns a human readable identifier of the provider: its name, or its type and server URL.
+// Labels are unique within a valid configuration.
+func (p *ProviderConfig) Label() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if p.ServerURL == "" {
+		return string(p.Type)
 	}
+	return fmt.Sprintf("%s (%s)", p.Type, p.ServerURL)
+}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+// ProviderConcurrency returns the number of repositories to fetch in parallel for a provider.
+// The provider setting takes precedence over the global one.
+func (c *Config) ProviderConcurrency(provider *ProviderConfig) int {
+	if provider.Concurrency > 0 {
+		return provider.Concurrency
 	}
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return DefaultConcurrency
+}
 
-	return &config, nil
+// DefaultSchedule is the daemon schedule of the providers without a configured schedule
+const DefaultSchedule = "@every 24h"
+
+// ProviderSchedule returns the daemon schedule of a provider.
+// The provider setting takes precedence over the global one.
+func (c *Config) ProviderSchedule(provider *ProviderConfig) string {
+	if provider.Schedule != "" {
+		return provider.Schedule
+	}
+	if c.Schedule != "" {
+		return c.Schedule
+	}
+	return DefaultSchedule
+}
+
+// Load loads configuration from the specified YAML file.
+// `${ENV_VAR}` references in values are replaced with the environment variables values
+// and the secrets configured through `access_token_file` and `password_file` are read.
+// The configuration is strictly validated (unknown keys, required fields, combinations of options
+// and the additional checks): all the problems found are returned as a *ValidationError.
+func Load(filename string, checks ...ProviderCheck) (*Config, error) {
+	return Build(filename, nil, nil, checks...)
 }
 
-// CreateFromArgs creates a config from command line arguments
-func CreateFromArgs(
-	providerType string, 
-	serverURL string, 
-	accessToken string, 
-	username string,
-	password string,
-	useBasicAuth bool,
-	skipSSLValidation bool,
-	include []string,
-	exclude []string,
-	targetDir string,
-) *Config {
-	provider := ProviderConfig{
-		Type:              ProviderType(providerType),
-		ServerURL:         serverURL,
-		AccessToken:       accessToken,
-		Username:          username,
-		Password:          password,
-		UseBasicAuth:      useBasicAuth,
-		SkipSslValidation: skipSSLValidation,
-		Include:           include,
-		Exclude:           exclude,
-		TargetDir:         targetDir,
+// Build builds the configuration from its sources, in increasing order of precedence:
+// the YAML file (optional, see Load), the `GB_*` variables of environ (see applyEnv)
+// and the overrides (e.g. command-line flags), keyed as accepted by Config.Set.
+// The resulting configuration is validated as in Load.
+func Build(filename string, environ []string, overrides map[string]string, checks ...ProviderCheck) (*Config, error) {
+	var config Config
+	v := &validator{lines: make(map[string]int)}
+
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+
+		interpolateNode(&root, v)
+		checkKeys(&root, reflect.TypeOf(Config{}), "", v)
+
+		if err := root.Decode(&config); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("failed to parse config file: %w", err)
+			}
+			for _, message := range typeErr.Errors {
+				v.problems = append(v.problems, decodeProblem(message))
+			}
+		}
 	}
 
-	return &Config{
-		Providers: []ProviderConfig{provider},
+	config.applyEnv(environ, v)
+
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := config.Set(key, overrides[key]); err != nil {
+			v.problems = append(v.problems, Problem{Path: key, Message: err.Error()})
+		}
+	}
+
+	config.resolveSecretFiles(v)
+	config.validateWith(v, checks)
+
+	if len(v.problems) > 0 {
+		return nil, &ValidationError{Problems: v.problems}
+	}
+	return &config, nil
 }
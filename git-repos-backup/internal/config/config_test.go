@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -92,128 +96,951 @@ providers:
 	}
 }
 
-func TestCreateFromArgs(t *testing.T) {
-	// Test creating config from arguments
+// loadTestConfig loads a config file with the given content
+func loadTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+	cfg, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
+
+func TestLoadGitLabGroups(t *testing.T) {
+	cfg := loadTestConfig(t, `
+providers:
+  - type: gitlab
+    access_token: gitlab_token
+    target_dir: /gitlab/backup
+    groups:
+      - group/subgroup
+`)
+
+	if cfg.Providers[0].Type != ProviderGitLab {
+		t.Errorf("Expected type %s, got %s", ProviderGitLab, cfg.Providers[0].Type)
+	}
+	if !reflect.DeepEqual(cfg.Providers[0].Groups, []string{"group/subgroup"}) {
+		t.Errorf("Expected groups [group/subgroup], got %v", cfg.Providers[0].Groups)
+	}
+}
+
+func TestLoadConcurrency(t *testing.T) {
+	cfg := loadTestConfig(t, `
+concurrency: 4
+providers:
+  - type: gitea
+    server_url: https://gitea.example.com
+    access_token: fake_token
+    target_dir: /path/to/backup
+    concurrency: 8
+  - type: github
+    access_token: github_token
+    target_dir: /github/backup
+`)
+
+	if got := cfg.ProviderConcurrency(&cfg.Providers[0]); got != 8 {
+		t.Errorf("Expected provider concurrency 8, got %d", got)
+	}
+	if got := cfg.ProviderConcurrency(&cfg.Providers[1]); got != 4 {
+		t.Errorf("Expected global concurrency 4, got %d", got)
+	}
+}
+
+func TestLoadRepositoryFilters(t *testing.T) {
+	cfg := loadTestConfig(t, `
+providers:
+  - type: github
+    access_token: github_token
+    target_dir: /github/backup
+    skip_forks: true
+    skip_archived: true
+    visibility: private
+`)
+
+	provider := cfg.Providers[0]
+	if !provider.SkipForks || !provider.SkipArchived {
+		t.Errorf("Expected skip_forks and skip_archived to be set, got %v and %v", provider.SkipForks, provider.SkipArchived)
+	}
+	if provider.Visibility != VisibilityPrivate {
+		t.Errorf("Expected visibility %s, got %s", VisibilityPrivate, provider.Visibility)
+	}
+}
+
+func TestLoadRefs(t *testing.T) {
+	cfg := loadTestConfig(t, `
+providers:
+  - type: gitlab
+    access_token: gitlab_token
+    target_dir: /gitlab/backup
+    refs: all
+    include_pull_requests: true
+`)
+
+	if cfg.Providers[0].Refs != RefSetAll || !cfg.Providers[0].IncludePulls {
+		t.Errorf("Expected refs %s with pull requests, got %s and %v", RefSetAll, cfg.Providers[0].Refs, cfg.Providers[0].IncludePulls)
+	}
+}
+
+func TestBuildOverrides(t *testing.T) {
+	// Test creating config from command-line overrides
 	testCases := []struct {
-		name              string
-		providerType      string
-		serverURL         string
-		accessToken       string
-		username          string
-		password          string
-		useBasicAuth      bool
-		skipSSLValidation bool
-		include           []string
-		exclude           []string
-		targetDir         string
+		name      string
+		overrides map[string]string
+		want      ProviderConfig
 	}{
 		{
-			name:         "GitHub with token",
-			providerType: "github",
-			accessToken:  "github_token",
-			targetDir:    "/path/to/backup",
+			name: "GitHub with token",
+			overrides: map[string]string{
+				"providers[0].type":         "github",
+				"providers[0].access_token": "github_token",
+				"providers[0].target_dir":   "/path/to/backup",
+			},
+			want: ProviderConfig{Type: ProviderGitHub, AccessToken: "github_token", TargetDir: "/path/to/backup"},
 		},
 		{
-			name:         "Gitea with token and server URL",
-			providerType: "gitea",
-			serverURL:    "https://gitea.example.com",
-			accessToken:  "gitea_token",
-			targetDir:    "/path/to/backup",
+			name: "Gitea with token and server URL",
+			overrides: map[string]string{
+				"providers[0].type":         "gitea",
+				"providers[0].server_url":   "https://gitea.example.com",
+				"providers[0].access_token": "gitea_token",
+				"providers[0].target_dir":   "/path/to/backup",
+			},
+			want: ProviderConfig{Type: ProviderGitea, ServerURL: "https://gitea.example.com", AccessToken: "gitea_token", TargetDir: "/path/to/backup"},
 		},
 		{
-			name:              "GitHub with basic auth and include",
-			providerType:      "github",
-			username:          "user",
-			password:          "pass",
-			useBasicAuth:      true,
-			skipSSLValidation: true,
-			include:           []string{"owner/repo1", "owner/repo2"},
-			targetDir:         "/path/to/backup",
+			name: "GitHub with basic auth and include",
+			overrides: map[string]string{
+				"providers[0].type":                "github",
+				"providers[0].username":            "user",
+				"providers[0].password":            "pass",
+				"providers[0].use_basic_auth":      "true",
+				"providers[0].skip_ssl_validation": "true",
+				"providers[0].include":             "owner/repo1,owner/repo2",
+				"providers[0].target_dir":          "/path/to/backup",
+			},
+			want: ProviderConfig{
+				Type:              ProviderGitHub,
+				Username:          "user",
+				Password:          "pass",
+				UseBasicAuth:      true,
+				SkipSslValidation: true,
+				Include:           []string{"owner/repo1", "owner/repo2"},
+				TargetDir:         "/path/to/backup",
+			},
 		},
 		{
-			name:         "GitHub with exclude",
-			providerType: "github",
-			accessToken:  "token",
-			exclude:      []string{"owner/repo3"},
-			targetDir:    "/path/to/backup",
+			name: "GitHub with exclude",
+			overrides: map[string]string{
+				"providers[0].type":         "github",
+				"providers[0].access_token": "token",
+				"providers[0].exclude":      "owner/repo3",
+				"providers[0].target_dir":   "/path/to/backup",
+			},
+			want: ProviderConfig{Type: ProviderGitHub, AccessToken: "token", Exclude: []string{"owner/repo3"}, TargetDir: "/path/to/backup"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			cfg := CreateFromArgs(
-				tc.providerType,
-				tc.serverURL,
-				tc.accessToken,
-				tc.username,
-				tc.password,
-				tc.useBasicAuth,
-				tc.skipSSLValidation,
-				tc.include,
-				tc.exclude,
-				tc.targetDir,
-			)
+			cfg, err := Build("", nil, tc.overrides)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
 
 			// Verify config
 			if len(cfg.Providers) != 1 {
-				t.Errorf("Expected 1 provider, got %d", len(cfg.Providers))
-				return
+				t.Fatalf("Expected 1 provider, got %d", len(cfg.Providers))
 			}
+			if !reflect.DeepEqual(cfg.Providers[0], tc.want) {
+				t.Errorf("Expected provider %+v, got %+v", tc.want, cfg.Providers[0])
+			}
+		})
+	}
+}
+
+func TestProviderConcurrency(t *testing.T) {
+	cfg := &Config{}
+	provider := &ProviderConfig{}
+	if got := cfg.ProviderConcurrency(provider); got != DefaultConcurrency {
+		t.Errorf("Expected default concurrency %d, got %d", DefaultConcurrency, got)
+	}
+
+	cfg.Concurrency = 3
+	if got := cfg.ProviderConcurrency(provider); got != 3 {
+		t.Errorf("Expected global concurrency 3, got %d", got)
+	}
+
+	provider.Concurrency = 5
+	if got := cfg.ProviderConcurrency(provider); got != 5 {
+		t.Errorf("Expected provider concurrency 5, got %d", got)
+	}
+}
+
+func TestProviderSchedule(t *testing.T) {
+	cfg := &Config{}
+	provider := &ProviderConfig{}
+	if got := cfg.ProviderSchedule(provider); got != DefaultSchedule {
+		t.Errorf("Expected default schedule %s, got %s", DefaultSchedule, got)
+	}
+
+	cfg.Schedule = "@daily"
+	if got := cfg.ProviderSchedule(provider); got != "@daily" {
+		t.Errorf("Expected global schedule @daily, got %s", got)
+	}
+
+	provider.Schedule = "0 */6 * * *"
+	if got := cfg.ProviderSchedule(provider); got != "0 */6 * * *" {
+		t.Errorf("Expected provider schedule 0 */6 * * *, got %s", got)
+	}
+}
+
+func TestLoadInterpolation(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	t.Setenv("GB_TEST_TOKEN", "env_token")
+	t.Setenv("GB_TEST_HOST", "gitea.example.com")
+	t.Setenv("GB_TEST_CONCURRENCY", "6")
+
+	content := `
+concurrency: ${GB_TEST_CONCURRENCY}
+providers:
+  - type: gitea
+    server_url: https://${GB_TEST_HOST}
+    access_token: ${GB_TEST_TOKEN}
+    target_dir: /backup/$${GB_TEST_HOST}
+    exclude:
+      - "${GB_TEST_HOST}/repo"
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
 
-			provider := cfg.Providers[0]
+	cfg, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Concurrency != 6 {
+		t.Errorf("Expected concurrency 6, got %d", cfg.Concurrency)
+	}
+	provider := cfg.Providers[0]
+	if provider.ServerURL != "https://gitea.example.com" {
+		t.Errorf("Expected server_url https://gitea.example.com, got %s", provider.ServerURL)
+	}
+	if provider.AccessToken != "env_token" {
+		t.Errorf("Expected access_token env_token, got %s", provider.AccessToken)
+	}
+	if provider.TargetDir != "/backup/${GB_TEST_HOST}" {
+		t.Errorf("Expected escaped target_dir /backup/${GB_TEST_HOST}, got %s", provider.TargetDir)
+	}
+	if provider.Exclude[0] != "gitea.example.com/repo" {
+		t.Errorf("Expected exclude[0] gitea.example.com/repo, got %s", provider.Exclude[0])
+	}
 
-			// Check provider type
-			if string(provider.Type) != tc.providerType {
-				t.Errorf("Expected type %s, got %s", tc.providerType, provider.Type)
+	// Missing variable
+	missing := "providers:\n  - type: github\n    access_token: ${GB_TEST_MISSING_TOKEN}\n"
+	if err := os.WriteFile(configFile, []byte(missing), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+	_, err = Load(configFile)
+	if err == nil || !strings.Contains(err.Error(), "GB_TEST_MISSING_TOKEN is not set") || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Expected missing variable error on line 3, got %v", err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("GB_TEST_VALUE", "value")
+	t.Setenv("GB_TEST_EMPTY", "")
+
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "plain", want: "plain"},
+		{input: "${GB_TEST_VALUE}", want: "value"},
+		{input: "a-${GB_TEST_VALUE}-${GB_TEST_VALUE}", want: "a-value-value"},
+		{input: "[${GB_TEST_EMPTY}]", want: "[]"},
+		{input: "$$GB_TEST_VALUE and $${GB_TEST_VALUE}", want: "$GB_TEST_VALUE and ${GB_TEST_VALUE}"},
+		{input: "pa$word$", want: "pa$word$"},
+		{input: "${GB_TEST_UNSET_VARIABLE}", wantErr: true},
+		{input: "${GB_TEST_VALUE", wantErr: true},
+		{input: "${}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := interpolate(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("interpolate() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if got != tt.want {
+				t.Errorf("interpolate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	tokenFile := filepath.Join(tmpDir, "token")
+	passwordFile := filepath.Join(tmpDir, "password")
+	if err := os.WriteFile(tokenFile, []byte("file_token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	if err := os.WriteFile(passwordFile, []byte("file_password"), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
 
-			// Check server URL
-			if provider.ServerURL != tc.serverURL {
-				t.Errorf("Expected server_url %s, got %s", tc.serverURL, provider.ServerURL)
+	tests := []struct {
+		name         string
+		content      string
+		wantToken    string
+		wantPassword string
+		wantErr      string
+	}{
+		{
+			name:      "Token file",
+			content:   "providers:\n  - type: github\n    target_dir: /backup\n    access_token_file: " + tokenFile + "\n",
+			wantToken: "file_token",
+		},
+		{
+			name:         "Password file",
+			content:      "providers:\n  - type: gitea\n    server_url: https://gitea.example.com\n    target_dir: /backup\n    use_basic_auth: true\n    username: user\n    password_file: " + passwordFile + "\n",
+			wantPassword: "file_password",
+		},
+		{
+			name:    "Missing file",
+			content: "providers:\n  - type: github\n    access_token_file: " + tokenFile + ".missing\n",
+			wantErr: "access_token_file",
+		},
+		{
+			name:    "Empty file",
+			content: "providers:\n  - type: github\n    password_file: " + configFile + ".empty\n",
+			wantErr: "password_file",
+		},
+		{
+			name:    "Token and token file",
+			content: "providers:\n  - type: github\n    access_token: token\n    access_token_file: " + tokenFile + "\n",
+			wantErr: "mutually exclusive",
+		},
+	}
+
+	if err := os.WriteFile(configFile+".empty", []byte("\n"), 0600); err != nil {
+		t.Fatalf("Failed to write empty file: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(configFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test config file: %v", err)
 			}
 
-			// Check authentication
-			if provider.AccessToken != tc.accessToken {
-				t.Errorf("Expected access_token %s, got %s", tc.accessToken, provider.AccessToken)
+			cfg, err := Load(configFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Load() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
 			}
-			if provider.Username != tc.username {
-				t.Errorf("Expected username %s, got %s", tc.username, provider.Username)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
 			}
-			if provider.Password != tc.password {
-				t.Errorf("Expected password %s, got %s", tc.password, provider.Password)
+			if cfg.Providers[0].AccessToken != tt.wantToken {
+				t.Errorf("Expected access_token %q, got %q", tt.wantToken, cfg.Providers[0].AccessToken)
 			}
-			if provider.UseBasicAuth != tc.useBasicAuth {
-				t.Errorf("Expected use_basic_auth %v, got %v", tc.useBasicAuth, provider.UseBasicAuth)
+			if cfg.Providers[0].Password != tt.wantPassword {
+				t.Errorf("Expected password %q, got %q", tt.wantPassword, cfg.Providers[0].Password)
 			}
-			if provider.SkipSslValidation != tc.skipSSLValidation {
-				t.Errorf("Expected skip_ssl_validation %v, got %v", tc.skipSSLValidation, provider.SkipSslValidation)
+		})
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	tests := []struct {
+		name    string
+		content string
+		checks  []ProviderCheck
+		want    []string
+	}{
+		{
+			name: "Valid config",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github
+`,
+		},
+		{
+			name: "Unknown keys",
+			content: `concurency: 2
+providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github
+    skip_fork: true
+`,
+			want: []string{
+				"line 1: concurency: unknown key",
+				"line 6: providers[0].skip_fork: unknown key",
+			},
+		},
+		{
+			name: "No providers",
+			content: `concurrency: 2
+`,
+			want: []string{"providers: at least one provider is required"},
+		},
+		{
+			name: "Required fields",
+			content: `providers:
+  - server_url: https://git.example.com
+  - type: gitea
+    target_dir: /backup/gitea
+`,
+			want: []string{
+				"line 2: providers[0].type: is required",
+				"line 2: providers[0].target_dir: is required",
+				"line 3: providers[1].server_url: is required for gitea providers",
+			},
+		},
+		{
+			name: "Invalid values",
+			content: `concurrency: -1
+providers:
+  - type: bitbucket
+    server_url: git.example.com
+    target_dir: /backup
+    visibility: secret
+    refs: branches
+    transport: git
+`,
+			want: []string{
+				"line 1: concurrency: must not be negative",
+				`line 3: providers[0].type: unsupported provider type "bitbucket" (must be gitea, github or gitlab)`,
+				"line 4: providers[0].server_url: must be an http or https URL",
+				`line 6: providers[0].visibility: invalid value "secret" (must be private, public or all)`,
+				`line 7: providers[0].refs: invalid value "branches" (must be heads-tags, all or custom)`,
+				`line 8: providers[0].transport: invalid value "git" (must be https or ssh)`,
+			},
+		},
+		{
+			name: "Provider labels",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github1
+  - type: github
+    access_token: token
+    target_dir: /backup/github2
+  - name: backups
+    type: gitea
+    server_url: https://gitea.example.com
+    target_dir: /backup/gitea1
+  - name: backups
+    type: gitea
+    server_url: https://gitea.example.com
+    target_dir: /backup/gitea2
+  - name: gitea (https://gitea.example.com)
+    type: gitea
+    server_url: https://gitea.example.com
+    target_dir: /backup/gitea3
+`,
+			want: []string{
+				"line 5: providers[1].name: is required to tell the provider apart from providers[0] (same type and server_url)",
+				"line 12: providers[3].name: is also the label of providers[2]",
+			},
+		},
+		{
+			name: "Refspecs",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github
+    refspecs:
+      - +refs/heads/*:refs/heads/*
+      - refs/notes/*
+      - ^refs/heads/tmp-*
+      - "refs/tags/v1:"
+`,
+			want: []string{
+				`line 7: providers[0].refspecs[1]: refspec "refs/notes/*" has no destination (must be <src>:<dst>)`,
+				`line 8: providers[0].refspecs[2]: negative refspec "^refs/heads/tmp-*" is not supported`,
+				`line 9: providers[0].refspecs[3]: refspec "refs/tags/v1:" has no destination (must be <src>:<dst>)`,
+			},
+		},
+		{
+			name: "Authentication",
+			content: `providers:
+  - type: github
+    target_dir: /backup/github
+    username: user
+  - type: gitlab
+    access_token: token
+    use_basic_auth: true
+    username: user
+    password: password
+    target_dir: /backup/gitlab
+  - type: gitea
+    server_url: https://gitea.example.com
+    use_basic_auth: true
+    target_dir: /backup/gitea
+`,
+			want: []string{
+				"line 4: providers[0].username: is only used with use_basic_auth: true",
+				"line 2: providers[0].access_token: is required for github providers",
+				"line 7: providers[1].use_basic_auth: is not supported by gitlab providers, use access_token",
+				"line 6: providers[1].access_token: cannot be combined with use_basic_auth",
+				"line 11: providers[2].username: is required with use_basic_auth",
+				"line 11: providers[2].password: is required with use_basic_auth",
+			},
+		},
+		{
+			name: "Option combinations",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github
+    groups:
+      - group
+    refspecs:
+      - +refs/heads/*:refs/heads/*
+    ssh_key_file: /keys/id_ed25519
+  - type: gitea
+    server_url: https://gitea.example.com
+    target_dir: /backup/gitea
+    refs: custom
+  - type: gitlab
+    access_token: token
+    target_dir: /backup/gitlab
+    include_metadata: true
+    include_wikis: true
+`,
+			want: []string{
+				"line 5: providers[0].groups: is only supported by gitlab providers",
+				"line 9: providers[0].ssh_key_file: is only used with transport: ssh",
+				"line 10: providers[1].refspecs: is required with refs: custom",
+				"line 17: providers[2].include_metadata: is only supported by gitea and github providers",
+				"line 18: providers[2].include_wikis: is only supported by gitea and github providers",
+			},
+		},
+		{
+			name: "Schedules",
+			content: `schedule: 0 25 * * *
+jitter: -5m
+providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+    schedule: "@every 6h"
+  - type: gitlab
+    access_token: token
+    target_dir: /backup/gitlab
+    schedule: "@sometimes"
+`,
+			want: []string{
+				`line 1: schedule: invalid schedule "0 25 * * *": invalid hour "25" (must be 0-23)`,
+				"line 2: jitter: must not be negative",
+				`line 11: providers[1].schedule: unknown schedule "@sometimes"`,
+			},
+		},
+		{
+			name: "Metrics listener",
+			content: `http_listen: localhost
+health_max_age: -1h
+providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+`,
+			want: []string{
+				`line 1: http_listen: invalid address "localhost" (must be [host]:port)`,
+				"line 2: health_max_age: must not be negative",
+			},
+		},
+		{
+			name: "Notifications",
+			content: `notifications:
+  - type: slack
+    url: hooks.slack.com/services/T000/B000/XXXX
+    to: [ops@example.com]
+  - type: email
+    smtp_port: 70000
+    smtp_tls: ssl
+    username: backup
+    from: backups
+    to: [ops@example.com, ops]
+    token: token
+    digest: "@sometimes"
+  - type: gotify
+    url: https://gotify.example.com
+  - type: pager
+providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+`,
+			want: []string{
+				"line 3: notifications[0].url: must be an http or https URL",
+				"line 4: notifications[0].to: is only used by email notifications",
+				"line 5: notifications[1].smtp_host: is required for email notifications",
+				"line 6: notifications[1].smtp_port: must be between 1 and 65535",
+				`line 7: notifications[1].smtp_tls: invalid value "ssl" (must be starttls or implicit)`,
+				"line 5: notifications[1].password: is required with username",
+				`line 9: notifications[1].from: invalid address "backups"`,
+				`line 10: notifications[1].to[1]: invalid address "ops"`,
+				"line 11: notifications[1].token: is only used by ntfy and gotify notifications",
+				`line 12: notifications[1].digest: unknown schedule "@sometimes"`,
+				"line 13: notifications[2].token: is required for gotify notifications",
+				`line 15: notifications[3].type: unsupported notification type "pager" (must be webhook, slack, ntfy, gotify or email)`,
+			},
+		},
+		{
+			name: "SSH files",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+    transport: ssh
+    ssh_key_file: /nonexistent/id_ed25519
+    known_hosts_file: /nonexistent/known_hosts
+`,
+			want: []string{
+				"line 6: providers[0].ssh_key_file: cannot be accessed: stat /nonexistent/id_ed25519: no such file or directory",
+				"line 7: providers[0].known_hosts_file: cannot be accessed: stat /nonexistent/known_hosts: no such file or directory",
+			},
+		},
+		{
+			name: "Duplicate target directories",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+  - type: gitlab
+    access_token: token
+    target_dir: /backup/
+`,
+			want: []string{"line 7: providers[1].target_dir: is also the target directory of providers[0]"},
+		},
+		{
+			name: "Type and interpolation errors",
+			content: `concurrency: many
+providers:
+  - type: github
+    access_token: ${GRB_TEST_UNSET_TOKEN}
+    target_dir: /backup
+`,
+			want: []string{
+				"line 4: environment variable GRB_TEST_UNSET_TOKEN is not set",
+				"line 1: cannot unmarshal !!str `many` into int",
+			},
+		},
+		{
+			name: "Release assets",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup/github
+    include_releases: true
+    max_asset_size: 10 parsecs
+  - type: gitea
+    server_url: https://gitea.example.com
+    target_dir: /backup/gitea
+    max_asset_size: 100MB
+  - type: gitlab
+    access_token: token
+    target_dir: /backup/gitlab
+    include_releases: true
+`,
+			want: []string{
+				`line 6: invalid size "10 parsecs"`,
+				"line 10: providers[1].max_asset_size: is only used with include_releases: true",
+				"line 14: providers[2].include_releases: is only supported by gitea and github providers",
+			},
+		},
+		{
+			name: "Additional checks",
+			content: `providers:
+  - type: github
+    access_token: token
+    target_dir: /backup
+    include:
+      - owner/repo
+      - re:[
+`,
+			checks: []ProviderCheck{func(provider *ProviderConfig) []FieldError {
+				return []FieldError{{Field: "include", Index: 1, Err: errors.New("invalid pattern")}}
+			}},
+			want: []string{"line 7: providers[0].include[1]: invalid pattern"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(configFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test config file: %v", err)
 			}
 
-			// Check include/exclude
-			if len(provider.Include) != len(tc.include) {
-				t.Errorf("Expected %d include entries, got %d", len(tc.include), len(provider.Include))
-			} else {
-				for i, inc := range tc.include {
-					if provider.Include[i] != inc {
-						t.Errorf("Expected include[%d] %s, got %s", i, inc, provider.Include[i])
-					}
+			_, err := Load(configFile, tt.checks...)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Load() error = %v, want nil", err)
 				}
+				return
 			}
 
-			if len(provider.Exclude) != len(tc.exclude) {
-				t.Errorf("Expected %d exclude entries, got %d", len(tc.exclude), len(provider.Exclude))
-			} else {
-				for i, exc := range tc.exclude {
-					if provider.Exclude[i] != exc {
-						t.Errorf("Expected exclude[%d] %s, got %s", i, exc, provider.Exclude[i])
-					}
-				}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Load() error = %v, want *ValidationError", err)
+			}
+			var got []string
+			for _, problem := range validationErr.Problems {
+				got = append(got, problem.String())
 			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() problems = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
 
-			// Check target dir
-			if provider.TargetDir != tc.targetDir {
-				t.Errorf("Expected target_dir %s, got %s", tc.targetDir, provider.TargetDir)
+func TestValidate(t *testing.T) {
+	cfg := &Config{Providers: []ProviderConfig{{Type: ProviderGitHub, TargetDir: "/backup"}}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "providers[0].access_token: is required for github providers") {
+		t.Errorf("Validate() error = %v, want missing access_token", err)
+	}
+
+	cfg.Providers[0].AccessToken = "token"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	content := `
+concurrency: 2
+providers:
+  - type: github
+    access_token: file_token
+    target_dir: /backup/github
+    skip_forks: true
+  - type: gitlab
+    access_token_file: /nonexistent/token
+    target_dir: /backup/gitlab
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	environ := []string{
+		"PATH=/usr/bin",
+		"GB_VERBOSE=true",
+		"GB_CONCURRENCY=4",
+		"GB_SCHEDULE=@daily",
+		"GB_TOKEN=env_token",
+		"GB_INCLUDE_REPOS=owner/repo1, owner/repo2",
+		"GB_PROVIDERS_1_ACCESS_TOKEN=gitlab_token",
+		"GB_PROVIDERS_2_TYPE=gitea",
+		"GB_PROVIDERS_2_SERVER_URL=https://gitea.example.com",
+		"GB_PROVIDERS_2_TARGET_DIR=/backup/gitea",
+		"GB_PROVIDERS_2_SKIP_ARCHIVED=true",
+		"GB_NOTIFICATIONS_0_TYPE=ntfy",
+		"GB_NOTIFICATIONS_0_URL=https://ntfy.sh/backups",
+		"GB_NOTIFICATIONS_0_ON_FAILURE_ONLY=true",
+	}
+	overrides := map[string]string{
+		"concurrency":             "8",
+		"providers[0].skip_forks": "false",
+	}
+
+	cfg, err := Build(configFile, environ, overrides)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	// Flags take precedence over the environment, which takes precedence over the file
+	if cfg.Concurrency != 8 {
+		t.Errorf("Expected concurrency 8, got %d", cfg.Concurrency)
+	}
+	if cfg.Schedule != "@daily" {
+		t.Errorf("Expected schedule @daily, got %s", cfg.Schedule)
+	}
+	if len(cfg.Providers) != 3 {
+		t.Fatalf("Expected 3 providers, got %d", len(cfg.Providers))
+	}
+	if cfg.Providers[0].AccessToken != "env_token" || cfg.Providers[0].SkipForks || cfg.Providers[0].TargetDir != "/backup/github" {
+		t.Errorf("Unexpected first provider: %+v", cfg.Providers[0])
+	}
+	if !reflect.DeepEqual(cfg.Providers[0].Include, []string{"owner/repo1", "owner/repo2"}) {
+		t.Errorf("Expected include [owner/repo1 owner/repo2], got %v", cfg.Providers[0].Include)
+	}
+	// The token replaces the token file of the config file
+	if cfg.Providers[1].AccessToken != "gitlab_token" || cfg.Providers[1].AccessTokenFile != "" {
+		t.Errorf("Expected the gitlab token from the environment, got %q (file %q)", cfg.Providers[1].AccessToken, cfg.Providers[1].AccessTokenFile)
+	}
+	if cfg.Providers[2].Type != ProviderGitea || cfg.Providers[2].ServerURL != "https://gitea.example.com" || !cfg.Providers[2].SkipArchived {
+		t.Errorf("Unexpected provider from the environment: %+v", cfg.Providers[2])
+	}
+	wantNotifications := []NotificationConfig{{Type: NotificationNtfy, URL: "https://ntfy.sh/backups", OnFailureOnly: true}}
+	if !reflect.DeepEqual(cfg.Notifications, wantNotifications) {
+		t.Errorf("Expected notifications %+v, got %+v", wantNotifications, cfg.Notifications)
+	}
+
+	// Without a config file
+	cfg, err = Build("", []string{"GB_PROVIDER=github", "GB_TOKEN=token", "GB_TARGET_DIR=/backup", "GB_BACKUP_INTERVAL=3600", "GB_JITTER=5m"}, nil)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if len(cfg.Providers) != 1 || cfg.Providers[0].Type != ProviderGitHub || cfg.Providers[0].TargetDir != "/backup" {
+		t.Errorf("Unexpected providers from the environment: %+v", cfg.Providers)
+	}
+	if cfg.Schedule != "@every 3600s" {
+		t.Errorf("Expected schedule @every 3600s from the backup interval, got %s", cfg.Schedule)
+	}
+	if cfg.Jitter != 5*time.Minute {
+		t.Errorf("Expected jitter 5m from GB_JITTER, got %v", cfg.Jitter)
+	}
+}
+
+func TestUnknownEnvVars(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"GB_VERBOSE=true",
+		"GB_TOKEN=token",
+		"GB_SCHEDULE_JITTER=5m",
+		"GB_BACKUP_INTERVAL=3600",
+		"GB_CONCURENCY=4",
+		"GB_PROVIDERS_0_TARGETDIR=/backup",
+		"GB_SKIP_FORK=true",
+	}
+
+	// Invalid list item variables are configuration problems, not unknown variables
+	got := UnknownEnvVars(environ, "GB_VERBOSE")
+	want := []string{"GB_CONCURENCY", "GB_SCHEDULE_JITTER", "GB_SKIP_FORK"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnknownEnvVars() = %v, want %v", got, want)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	environ := []string{
+		"GB_PROVIDER=github",
+		"GB_TOKEN=token",
+		"GB_TARGET_DIR=/backup",
+		"GB_SKIP_FORKS=maybe",
+		"GB_PROVIDERS_0_TARGETDIR=/backup",
+		"GB_PROVIDERS_X_TYPE=github",
+		"GB_JITTER=soon",
+		"GB_BACKUP_INTERVAL=daily",
+		"GB_NOTIFICATIONS_0_CHANNEL=backups",
+	}
+	_, err := Build("", environ, map[string]string{"providers[0].unknown": "value"})
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Build() error = %v, want *ValidationError", err)
+	}
+	var got []string
+	for _, problem := range validationErr.Problems {
+		got = append(got, problem.String())
+	}
+	want := []string{
+		`GB_JITTER: invalid duration "soon"`,
+		"GB_NOTIFICATIONS_0_CHANNEL: unknown key",
+		"GB_PROVIDERS_0_TARGETDIR: unknown key",
+		"GB_PROVIDERS_X_TYPE: expected GB_PROVIDERS_<index>_<KEY>",
+		`GB_SKIP_FORKS: invalid boolean "maybe"`,
+		`GB_BACKUP_INTERVAL: invalid number of seconds "daily"`,
+		`providers[0].unknown: unknown key "providers[0].unknown"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build() problems = %q, want %q", got, want)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ByteSize
+		wantErr bool
+	}{
+		{value: "1024", want: 1024},
+		{value: "10B", want: 10},
+		{value: "500MB", want: 500 * 1000 * 1000},
+		{value: "2 GiB", want: 2 << 30},
+		{value: "1.5kib", want: 1536},
+		{value: "0", want: 0},
+		{value: "", wantErr: true},
+		{value: "10 parsecs", wantErr: true},
+		{value: "MB", wantErr: true},
+		{value: "-5MB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseByteSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseByteSize() = %d, want %d", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestSet(t *testing.T) {
+	cfg := &Config{}
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{key: "concurrency", value: "3"},
+		{key: "jitter", value: "5m"},
+		{key: "providers[1].type", value: "gitlab"},
+		{key: "providers[1].groups", value: "group1,,group2 "},
+		{key: "providers[1].use_basic_auth", value: "true"},
+		{key: "providers[1].max_asset_size", value: "1.5GiB"},
+		{key: "providers[1].max_asset_size", value: "-1", wantErr: true},
+		{key: "concurrency", value: "many", wantErr: true},
+		{key: "providers", value: "github", wantErr: true},
+		{key: "providers[-1].type", value: "github", wantErr: true},
+		{key: "providers[0].unknown", value: "value", wantErr: true},
+		{key: "notifications[0].token_file", value: "/run/secrets/ntfy"},
+		{key: "notifications[0].token", value: "ntfy_token"},
+		{key: "notifications", value: "slack", wantErr: true},
+		{key: "schedule[0].type", value: "github", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := cfg.Set(tt.key, tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q, %q) error = %v, wantErr %v", tt.key, tt.value, err, tt.wantErr)
+		}
+	}
+
+	if cfg.Concurrency != 3 || cfg.Jitter != 5*time.Minute {
+		t.Errorf("Expected concurrency 3 and jitter 5m, got %d and %v", cfg.Concurrency, cfg.Jitter)
+	}
+	if len(cfg.Providers) != 2 || cfg.Providers[1].Type != ProviderGitLab || !cfg.Providers[1].UseBasicAuth {
+		t.Errorf("Unexpected providers: %+v", cfg.Providers)
+	}
+	if cfg.Providers[1].MaxAssetSize != 3<<29 {
+		t.Errorf("Expected max asset size %d, got %d", 3<<29, cfg.Providers[1].MaxAssetSize)
+	}
+	if !reflect.DeepEqual(cfg.Providers[1].Groups, []string{"group1", "group2"}) {
+		t.Errorf("Expected groups [group1 group2], got %v", cfg.Providers[1].Groups)
+	}
+	// The token replaces the token file
+	if len(cfg.Notifications) != 1 || cfg.Notifications[0].Token != "ntfy_token" || cfg.Notifications[0].TokenFile != "" {
+		t.Errorf("Unexpected notifications: %+v", cfg.Notifications)
+	}
+}
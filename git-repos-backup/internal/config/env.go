@@ -0,0 +1,269 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables configuring the tool
+const EnvPrefix = "GB_"
+
+// envListPrefixes maps the prefixes of the indexed list item variables (`GB_<LIST>_<n>_<KEY>`)
+// to the keys of the lists
+var envListPrefixes = map[string]string{
+	EnvPrefix + "PROVIDERS_":     "providers",
+	EnvPrefix + "NOTIFICATIONS_": "notifications",
+}
+
+// envAliases maps the legacy variable names to their configuration keys
+var envAliases = map[string]string{
+	"PROVIDER":      "providers[0].type",
+	"TOKEN":         "providers[0].access_token",
+	"INCLUDE_REPOS": "providers[0].include",
+	"EXCLUDE_REPOS": "providers[0].exclude",
+}
+
+// envBackupInterval is the legacy backup interval in seconds, used when no schedule is configured
+const envBackupInterval = EnvPrefix + "BACKUP_INTERVAL"
+
+// applyEnv sets the configuration values defined by `GB_*` environment variables:
+//   - `GB_<KEY>` for the top-level keys (e.g. `GB_CONCURRENCY`, `GB_SCHEDULE`)
+//   - `GB_PROVIDERS_<n>_<KEY>` for the keys of the provider at index n (e.g. `GB_PROVIDERS_1_ACCESS_TOKEN`)
+//   - `GB_NOTIFICATIONS_<n>_<KEY>` for the keys of the notification at index n (e.g. `GB_NOTIFICATIONS_0_URL`)
+//   - `GB_<KEY>` for the other provider keys, and the legacy `GB_PROVIDER`, `GB_TOKEN`, `GB_INCLUDE_REPOS`
+//     and `GB_EXCLUDE_REPOS`, for the first provider
+//
+// Keys are the YAML keys in upper case; lists are comma-separated.
+// Variables that are not configuration keys (e.g. `GB_VERBOSE`) are ignored, see UnknownEnvVars.
+func (c *Config) applyEnv(environ []string, v *validator) {
+	env := make(map[string]string)
+	var names []string
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		env[name] = value
+		names = append(names, name)
+	}
+	// Apply the variables in a stable order, so providers are added and problems reported deterministically
+	sort.Strings(names)
+
+	for _, name := range names {
+		key, problem := envKey(name)
+		if problem != nil {
+			v.problems = append(v.problems, *problem)
+			continue
+		}
+		if key == "" {
+			continue
+		}
+
+		if err := c.Set(key, env[name]); err != nil {
+			v.problems = append(v.problems, Problem{Path: name, Message: err.Error()})
+		}
+	}
+
+	if interval, ok := env[envBackupInterval]; ok && c.Schedule == "" && interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil || seconds < 1 {
+			v.problems = append(v.problems, Problem{Path: envBackupInterval, Message: fmt.Sprintf("invalid number of seconds %q", interval)})
+		} else {
+			c.Schedule = fmt.Sprintf("@every %ds", seconds)
+		}
+	}
+}
+
+// envKey returns the configuration key set by a `GB_*` variable (see applyEnv), or an empty key for
+// the variables that are not configuration keys. A problem is returned for invalid list item variables.
+func envKey(name string) (string, *Problem) {
+	key := strings.ToLower(strings.TrimPrefix(name, EnvPrefix))
+
+	if prefix, list, ok := envList(name); ok {
+		index, field, ok := strings.Cut(strings.TrimPrefix(name, prefix), "_")
+		n, err := strconv.Atoi(index)
+		if !ok || err != nil || n < 0 {
+			return "", &Problem{Path: name, Message: fmt.Sprintf("expected %s<index>_<KEY>", prefix)}
+		}
+		if _, ok := yamlFields(listType(list))[strings.ToLower(field)]; !ok {
+			return "", &Problem{Path: name, Message: "unknown key"}
+		}
+		return fmt.Sprintf("%s[%d].%s", list, n, strings.ToLower(field)), nil
+	}
+	if alias, ok := envAliases[strings.TrimPrefix(name, EnvPrefix)]; ok {
+		return alias, nil
+	}
+	if _, ok := yamlFields(reflect.TypeOf(Config{}))[key]; ok && listType(key) == nil {
+		return key, nil
+	}
+	if _, ok := yamlFields(reflect.TypeOf(ProviderConfig{}))[key]; ok {
+		return "providers[0]." + key, nil
+	}
+	return "", nil
+}
+
+// UnknownEnvVars returns the names of the `GB_*` variables of environ that are neither configuration
+// keys nor one of the known variables read by the command (e.g. `GB_VERBOSE`), such as misspelled
+// or renamed variables, in alphabetical order
+func UnknownEnvVars(environ []string, known ...string) []string {
+	isKnown := map[string]bool{envBackupInterval: true}
+	for _, name := range known {
+		isKnown[name] = true
+	}
+
+	var unknown []string
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, EnvPrefix) || isKnown[name] {
+			continue
+		}
+		if key, problem := envKey(name); key == "" && problem == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Set sets a configuration value from its string representation.
+// The key is a top-level YAML key (e.g. `concurrency`) or a list item YAML key prefixed by
+// the list key and the item index (e.g. `providers[0].access_token`); missing items are added.
+// Lists of values are comma-separated.
+func (c *Config) Set(key string, value string) error {
+	target := reflect.ValueOf(c).Elem()
+	field := key
+	if list, rest, ok := strings.Cut(key, "["); ok {
+		index, rest, ok := strings.Cut(rest, "].")
+		n, err := strconv.Atoi(index)
+		if !ok || err != nil || n < 0 || listType(list) == nil {
+			return fmt.Errorf("invalid key %q", key)
+		}
+		items := target.Field(yamlFields(target.Type())[list])
+		for items.Len() <= n {
+			items.Set(reflect.Append(items, reflect.Zero(items.Type().Elem())))
+		}
+		target = items.Index(n)
+		field = rest
+	}
+
+	fields := yamlFields(target.Type())
+	i, ok := fields[field]
+	if !ok || (target.Type() == reflect.TypeOf(Config{}) && listType(field) != nil) {
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if err := setValue(target.Field(i), value); err != nil {
+		return err
+	}
+
+	// A secret replaces the file it would otherwise be read from, and conversely
+	if other, ok := fields[secretFileKeys[field]]; ok {
+		target.Field(other).SetString("")
+	}
+	return nil
+}
+
+// envList returns the prefix and the list key of an indexed list item variable
+func envList(name string) (string, string, bool) {
+	for prefix, list := range envListPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return prefix, list, true
+		}
+	}
+	return "", "", false
+}
+
+// listType returns the item type of a top-level list of structs (e.g. `providers`), or nil for the other keys
+func listType(key string) reflect.Type {
+	t := reflect.TypeOf(Config{})
+	i, ok := yamlFields(t)[key]
+	if !ok {
+		return nil
+	}
+	if fieldType := t.Field(i).Type; fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Struct {
+		return fieldType.Elem()
+	}
+	return nil
+}
+
+// secretFileKeys maps the secret keys to the keys of the files they can be read from, and conversely
+var secretFileKeys = map[string]string{
+	"access_token":      "access_token_file",
+	"access_token_file": "access_token",
+	"password":          "password_file",
+	"password_file":     "password",
+	"token":             "token_file",
+	"token_file":        "token",
+}
+
+// durationType is the type of the duration fields
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// byteSizeType is the type of the size fields
+var byteSizeType = reflect.TypeOf(ByteSize(0))
+
+// setValue sets a field from its string representation
+func setValue(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == byteSizeType:
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(size))
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported value type %s", field.Type())
+	}
+	return nil
+}
+
+// yamlFields maps the YAML keys of a struct type to the indexes of its fields
+func yamlFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := yamlKey(t.Field(i)); key != "-" {
+			fields[key] = i
+		}
+	}
+	return fields
+}
+
+// yamlKey returns the YAML key of a struct field (its lower case name when not tagged)
+func yamlKey(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolateNode replaces the `${ENV_VAR}` references in all the scalar values of a YAML tree
+// with the values of the environment variables. `$$` escapes a literal `$`.
+// Invalid references and missing variables are reported as problems.
+func interpolateNode(node *yaml.Node, v *validator) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			interpolateNode(child, v)
+		}
+	case yaml.MappingNode:
+		// Keys are never interpolated
+		for i := 1; i < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i], v)
+		}
+	case yaml.ScalarNode:
+		value, err := interpolate(node.Value)
+		if err != nil {
+			v.problems = append(v.problems, Problem{Line: node.Line, Message: err.Error()})
+			return
+		}
+		if value != node.Value {
+			node.Value = value
+			// Let plain scalars be resolved again (e.g. `concurrency: ${CONCURRENCY}` as an int)
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+}
+
+// interpolate replaces the `${ENV_VAR}` references in a string with the values of the environment variables
+func interpolate(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '$' || i+1 >= len(value) {
+			b.WriteByte(c)
+			continue
+		}
+
+		switch value[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(value[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", value)
+			}
+			name := value[i+2 : i+2+end]
+			if name == "" {
+				return "", fmt.Errorf("empty variable reference in %q", value)
+			}
+			envValue, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			b.WriteString(envValue)
+			i += end + 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// readSecretFile reads a secret from a file (e.g. a Docker or Kubernetes secret), without the trailing newline
+func readSecretFile(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", filename)
+	}
+	return secret, nil
+}
+
+// resolveSecretFiles loads the secrets of the providers configured through `access_token_file` and `password_file`,
+// and those of the notifications configured through `token_file` and `password_file`
+func (c *Config) resolveSecretFiles(v *validator) {
+	for i := range c.Providers {
+		provider := &c.Providers[i]
+		path := fmt.Sprintf("providers[%d]", i)
+		resolveSecretFile(&provider.AccessToken, provider.AccessTokenFile, path, "access_token", v)
+		resolveSecretFile(&provider.Password, provider.PasswordFile, path, "password", v)
+	}
+	for i := range c.Notifications {
+		notification := &c.Notifications[i]
+		path := fmt.Sprintf("notifications[%d]", i)
+		resolveSecretFile(&notification.Token, notification.TokenFile, path, "token", v)
+		resolveSecretFile(&notification.Password, notification.PasswordFile, path, "password", v)
+	}
+}
+
+// resolveSecretFile reads the secret of the `<key>` value from the file of the `<key>_file` value, if any
+func resolveSecretFile(secret *string, filename string, path string, key string, v *validator) {
+	if filename == "" {
+		return
+	}
+	if *secret != "" {
+		v.add(path+"."+key+"_file", "%s and %s_file are mutually exclusive", key, key)
+	} else if value, err := readSecretFile(filename); err != nil {
+		v.add(path+"."+key+"_file", "%v", err)
+	} else {
+		*secret = value
+	}
+}
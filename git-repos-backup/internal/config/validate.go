@@ -0,0 +1,461 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a configuration problem found by the validation
+type Problem struct {
+	// Path locates the value in the configuration (e.g. `providers[0].target_dir`)
+	Path string
+	// Line is the line of the value in the configuration file (0 when unknown)
+	Line    int
+	Message string
+}
+
+// String formats the problem as `line <n>: <path>: <message>`
+func (p Problem) String() string {
+	var parts []string
+	if p.Line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d", p.Line))
+	}
+	if p.Path != "" {
+		parts = append(parts, p.Path)
+	}
+	return strings.Join(append(parts, p.Message), ": ")
+}
+
+// ValidationError is returned for configurations with problems
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Error implements the error interface, listing all the problems
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Sprintf("invalid configuration, %d problem(s):\n  - %s", len(e.Problems), strings.Join(problems, "\n  - "))
+}
+
+// FieldError is a problem with a provider field found by a ProviderCheck
+type FieldError struct {
+	// Field is the YAML key of the field
+	Field string
+	// Index is the index of the invalid list item, or -1 for the whole field
+	Index int
+	Err   error
+}
+
+// ProviderCheck is an additional provider check, for values validated by other packages
+// (e.g. the repository filter patterns)
+type ProviderCheck func(provider *ProviderConfig) []FieldError
+
+// Validate checks the required fields and the combinations of options of all providers.
+// It returns a *ValidationError listing all the problems found.
+func (c *Config) Validate(checks ...ProviderCheck) error {
+	if problems := c.validate(nil, checks); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validator collects problems, locating them in the configuration file
+type validator struct {
+	// lines holds the line of every value of the configuration file, indexed by path
+	lines    map[string]int
+	problems []Problem
+}
+
+// add adds a problem, located at the line of the value or of its closest parent
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Path: path, Line: v.lineOf(path), Message: fmt.Sprintf(format, args...)})
+}
+
+// lineOf returns the line of a value, or of its closest parent if the value is not in the file
+func (v *validator) lineOf(path string) int {
+	for path != "" {
+		if line, ok := v.lines[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// checkKeys reports the keys of a YAML tree that are not fields of the type it is decoded into,
+// and records the line of every value
+func checkKeys(node *yaml.Node, t reflect.Type, path string, v *validator) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			checkKeys(child, t, path, v)
+		}
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if name := yamlKey(field); name != "-" {
+				fields[name] = field.Type
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := key.Value
+			if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			v.lines[keyPath] = key.Line
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				v.add(keyPath, "unknown key")
+				continue
+			}
+			checkKeys(value, fieldType, keyPath, v)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return
+		}
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			v.lines[itemPath] = item.Line
+			checkKeys(item, t.Elem(), itemPath, v)
+		}
+	}
+}
+
+// decodeProblem converts a YAML decoding error (`line <n>: <message>`) to a problem
+func decodeProblem(message string) Problem {
+	var line int
+	if _, err := fmt.Sscanf(message, "line %d:", &line); err == nil {
+		if i := strings.Index(message, ": "); i >= 0 {
+			return Problem{Line: line, Message: message[i+2:]}
+		}
+	}
+	return Problem{Message: message}
+}
+
+// validate checks all providers, locating the problems with the lines of the configuration file, if any
+func (c *Config) validate(lines map[string]int, checks []ProviderCheck) []Problem {
+	v := &validator{lines: lines}
+	c.validateWith(v, checks)
+	return v.problems
+}
+
+// validateWith checks all providers, adding the problems to a validator
+func (c *Config) validateWith(v *validator, checks []ProviderCheck) {
+	if c.Concurrency < 0 {
+		v.add("concurrency", "must not be negative")
+	}
+	if c.Schedule != "" {
+		if _, err := schedule.Parse(c.Schedule); err != nil {
+			v.add("schedule", "%v", err)
+		}
+	}
+	if c.Jitter < 0 {
+		v.add("jitter", "must not be negative")
+	}
+	if c.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPListen); err != nil {
+			v.add("http_listen", "invalid address %q (must be [host]:port)", c.HTTPListen)
+		}
+	}
+	if c.HealthMaxAge < 0 {
+		v.add("health_max_age", "must not be negative")
+	}
+	if len(c.Providers) == 0 {
+		v.add("providers", "at least one provider is required")
+	}
+
+	targetDirs := make(map[string]int)
+	labels := make(map[string]int)
+	for i := range c.Providers {
+		provider := &c.Providers[i]
+		path := fmt.Sprintf("providers[%d]", i)
+
+		validateProvider(provider, path, v)
+
+		// Backups of different providers must not overwrite each other
+		if provider.TargetDir != "" {
+			dir, err := filepath.Abs(provider.TargetDir)
+			if err != nil {
+				dir = filepath.Clean(provider.TargetDir)
+			}
+			if other, ok := targetDirs[dir]; ok {
+				v.add(path+".target_dir", "is also the target directory of providers[%d]", other)
+			} else {
+				targetDirs[dir] = i
+			}
+		}
+
+		// Reports and metrics identify the providers by their label
+		if provider.Type != "" {
+			if other, ok := labels[provider.Label()]; !ok {
+				labels[provider.Label()] = i
+			} else if provider.Name != "" {
+				v.add(path+".name", "is also the label of providers[%d]", other)
+			} else {
+				v.add(path+".name", "is required to tell the provider apart from providers[%d] (same type and server_url)", other)
+			}
+		}
+
+		for _, check := range checks {
+			for _, fieldErr := range check(provider) {
+				fieldPath := path + "." + fieldErr.Field
+				if fieldErr.Index >= 0 {
+					fieldPath = fmt.Sprintf("%s[%d]", fieldPath, fieldErr.Index)
+				}
+				v.add(fieldPath, "%v", fieldErr.Err)
+			}
+		}
+	}
+
+	for i := range c.Notifications {
+		validateNotification(&c.Notifications[i], fmt.Sprintf("notifications[%d]", i), v)
+	}
+}
+
+// validateProvider checks the required fields and the combinations of options of a provider
+func validateProvider(provider *ProviderConfig, path string, v *validator) {
+	switch provider.Type {
+	case ProviderGitea, ProviderGitHub, ProviderGitLab:
+	case "":
+		v.add(path+".type", "is required")
+	default:
+		v.add(path+".type", "unsupported provider type %q (must be %s, %s or %s)", provider.Type, ProviderGitea, ProviderGitHub, ProviderGitLab)
+	}
+
+	if provider.ServerURL == "" {
+		if provider.Type == ProviderGitea {
+			v.add(path+".server_url", "is required for %s providers", provider.Type)
+		}
+	} else if u, err := url.Parse(provider.ServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(path+".server_url", "must be an http or https URL")
+	}
+
+	if provider.TargetDir == "" {
+		v.add(path+".target_dir", "is required")
+	}
+	if provider.Concurrency < 0 {
+		v.add(path+".concurrency", "must not be negative")
+	}
+	if provider.Schedule != "" {
+		if _, err := schedule.Parse(provider.Schedule); err != nil {
+			v.add(path+".schedule", "%v", err)
+		}
+	}
+
+	// Authentication
+	hasToken := provider.AccessToken != "" || provider.AccessTokenFile != ""
+	hasPassword := provider.Password != "" || provider.PasswordFile != ""
+	if provider.UseBasicAuth {
+		if provider.Type == ProviderGitLab {
+			v.add(path+".use_basic_auth", "is not supported by %s providers, use access_token", provider.Type)
+		}
+		if provider.Username == "" {
+			v.add(path+".username", "is required with use_basic_auth")
+		}
+		if !hasPassword {
+			v.add(path+".password", "is required with use_basic_auth")
+		}
+		if hasToken {
+			v.add(path+".access_token", "cannot be combined with use_basic_auth")
+		}
+	} else {
+		if provider.Username != "" {
+			v.add(path+".username", "is only used with use_basic_auth: true")
+		}
+		if hasPassword {
+			v.add(path+".password", "is only used with use_basic_auth: true")
+		}
+		if !hasToken && (provider.Type == ProviderGitHub || provider.Type == ProviderGitLab) {
+			v.add(path+".access_token", "is required for %s providers", provider.Type)
+		}
+	}
+
+	if len(provider.Groups) > 0 && provider.Type != ProviderGitLab {
+		v.add(path+".groups", "is only supported by %s providers", ProviderGitLab)
+	}
+	if provider.IncludeMetadata && provider.Type == ProviderGitLab {
+		v.add(path+".include_metadata", "is only supported by %s and %s providers", ProviderGitea, ProviderGitHub)
+	}
+	if provider.IncludeWikis && provider.Type == ProviderGitLab {
+		v.add(path+".include_wikis", "is only supported by %s and %s providers", ProviderGitea, ProviderGitHub)
+	}
+	if provider.IncludeReleases && provider.Type == ProviderGitLab {
+		v.add(path+".include_releases", "is only supported by %s and %s providers", ProviderGitea, ProviderGitHub)
+	}
+	if provider.MaxAssetSize != 0 && !provider.IncludeReleases {
+		v.add(path+".max_asset_size", "is only used with include_releases: true")
+	}
+
+	if provider.CACertFile != "" {
+		if _, err := os.Stat(provider.CACertFile); err != nil {
+			v.add(path+".ca_cert_file", "cannot be accessed: %v", err)
+		}
+	}
+
+	switch provider.Visibility {
+	case "", VisibilityAll, VisibilityPrivate, VisibilityPublic:
+	default:
+		v.add(path+".visibility", "invalid value %q (must be %s, %s or %s)", provider.Visibility, VisibilityPrivate, VisibilityPublic, VisibilityAll)
+	}
+
+	// Refs
+	switch provider.Refs {
+	case "", RefSetHeadsTags, RefSetAll:
+		if len(provider.Refspecs) > 0 && provider.Refs != "" {
+			v.add(path+".refspecs", "is only used with refs: %s", RefSetCustom)
+		}
+	case RefSetCustom:
+		if len(provider.Refspecs) == 0 {
+			v.add(path+".refspecs", "is required with refs: %s", RefSetCustom)
+		}
+	default:
+		v.add(path+".refs", "invalid value %q (must be %s, %s or %s)", provider.Refs, RefSetHeadsTags, RefSetAll, RefSetCustom)
+	}
+	if provider.Refs == "" || provider.Refs == RefSetCustom {
+		// Refs fetched without a destination are only written to FETCH_HEAD, not stored in the backup
+		for i, refspec := range provider.Refspecs {
+			refspecPath := fmt.Sprintf("%s.refspecs[%d]", path, i)
+			if strings.HasPrefix(refspec, "^") {
+				v.add(refspecPath, "negative refspec %q is not supported", refspec)
+			} else if _, dst, _ := strings.Cut(refspec, ":"); dst == "" {
+				v.add(refspecPath, "refspec %q has no destination (must be <src>:<dst>)", refspec)
+			}
+		}
+	}
+
+	// Transport
+	switch provider.Transport {
+	case "", TransportHTTPS:
+		if provider.SSHKeyFile != "" {
+			v.add(path+".ssh_key_file", "is only used with transport: %s", TransportSSH)
+		}
+		if provider.KnownHostsFile != "" {
+			v.add(path+".known_hosts_file", "is only used with transport: %s", TransportSSH)
+		}
+	case TransportSSH:
+		if provider.SSHKeyFile != "" {
+			if _, err := os.Stat(provider.SSHKeyFile); err != nil {
+				v.add(path+".ssh_key_file", "cannot be accessed: %v", err)
+			}
+		}
+		if provider.KnownHostsFile != "" {
+			if _, err := os.Stat(provider.KnownHostsFile); err != nil {
+				v.add(path+".known_hosts_file", "cannot be accessed: %v", err)
+			}
+		}
+	default:
+		v.add(path+".transport", "invalid value %q (must be %s or %s)", provider.Transport, TransportHTTPS, TransportSSH)
+	}
+}
+
+// validateNotification checks the required fields and the combinations of options of a notification
+func validateNotification(notification *NotificationConfig, path string, v *validator) {
+	switch notification.Type {
+	case NotificationWebhook, NotificationSlack, NotificationNtfy, NotificationGotify:
+		if notification.URL == "" {
+			v.add(path+".url", "is required for %s notifications", notification.Type)
+		} else if u, err := url.Parse(notification.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(path+".url", "must be an http or https URL")
+		}
+		for _, field := range []struct {
+			key string
+			set bool
+		}{
+			{"smtp_host", notification.SMTPHost != ""},
+			{"smtp_port", notification.SMTPPort != 0},
+			{"smtp_tls", notification.SMTPTLS != ""},
+			{"username", notification.Username != ""},
+			{"password", notification.Password != "" || notification.PasswordFile != ""},
+			{"from", notification.From != ""},
+			{"to", len(notification.To) > 0},
+		} {
+			if field.set {
+				v.add(path+"."+field.key, "is only used by %s notifications", NotificationEmail)
+			}
+		}
+	case NotificationEmail:
+		if notification.URL != "" {
+			v.add(path+".url", "is not used by %s notifications, use smtp_host", notification.Type)
+		}
+		if notification.SMTPHost == "" {
+			v.add(path+".smtp_host", "is required for %s notifications", notification.Type)
+		}
+		if notification.SMTPPort < 0 || notification.SMTPPort > 65535 {
+			v.add(path+".smtp_port", "must be between 1 and 65535")
+		}
+		switch notification.SMTPTLS {
+		case "", SMTPTLSStartTLS, SMTPTLSImplicit:
+		default:
+			v.add(path+".smtp_tls", "invalid value %q (must be %s or %s)", notification.SMTPTLS, SMTPTLSStartTLS, SMTPTLSImplicit)
+		}
+		hasPassword := notification.Password != "" || notification.PasswordFile != ""
+		if notification.Username != "" && !hasPassword {
+			v.add(path+".password", "is required with username")
+		} else if notification.Username == "" && hasPassword {
+			v.add(path+".username", "is required with password")
+		}
+		if notification.From == "" {
+			v.add(path+".from", "is required for %s notifications", notification.Type)
+		} else if _, err := mail.ParseAddress(notification.From); err != nil {
+			v.add(path+".from", "invalid address %q", notification.From)
+		}
+		if len(notification.To) == 0 {
+			v.add(path+".to", "is required for %s notifications", notification.Type)
+		}
+		for i, to := range notification.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				v.add(fmt.Sprintf("%s.to[%d]", path, i), "invalid address %q", to)
+			}
+		}
+	case "":
+		v.add(path+".type", "is required")
+	default:
+		v.add(path+".type", "unsupported notification type %q (must be %s, %s, %s, %s or %s)", notification.Type,
+			NotificationWebhook, NotificationSlack, NotificationNtfy, NotificationGotify, NotificationEmail)
+	}
+
+	hasToken := notification.Token != "" || notification.TokenFile != ""
+	switch notification.Type {
+	case NotificationGotify:
+		if !hasToken {
+			v.add(path+".token", "is required for %s notifications", notification.Type)
+		}
+	case NotificationWebhook, NotificationSlack, NotificationEmail:
+		if hasToken {
+			v.add(path+".token", "is only used by %s and %s notifications", NotificationNtfy, NotificationGotify)
+		}
+	}
+
+	if notification.Digest != "" {
+		if _, err := schedule.Parse(notification.Digest); err != nil {
+			v.add(path+".digest", "%v", err)
+		}
+	}
+}
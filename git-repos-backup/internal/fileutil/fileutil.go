@@ -0,0 +1,55 @@
+// Package fileutil provides the file helpers shared by the backup outputs and measurements
+package fileutil
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic writes data to the file at path through a temporary file in the same directory,
+// renamed over path once written, so that readers never see a partially written file
+func WriteAtomic(path string, data []byte) error {
+	name := filepath.Base(path)
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// DirUsage returns the number and total size of the regular files in a directory tree,
+// ignoring the unreadable entries (a missing directory is empty)
+func DirUsage(dir string) (int, int64) {
+	var count int
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				count++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return count, size
+}
@@ -0,0 +1,61 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.json")
+
+	for _, content := range []string{"first\n", "second\n"} {
+		if err := WriteAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("WriteAtomic() error = %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("WriteAtomic() wrote %q, want %q", data, content)
+		}
+	}
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the written file, got %d entries", len(entries))
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected file mode 0644, got %v (%v)", info.Mode().Perm(), err)
+	}
+
+	// Writing to a missing directory fails
+	if err := WriteAtomic(filepath.Join(dir, "missing", "file.json"), nil); err == nil {
+		t.Error("Expected error for missing directory, got nil")
+	}
+}
+
+func TestDirUsage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "repo.git", "objects"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	for path, size := range map[string]int{"repo.git/HEAD": 23, "repo.git/objects/pack": 1000} {
+		if err := os.WriteFile(filepath.Join(dir, path), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	if count, size := DirUsage(dir); count != 2 || size != 1023 {
+		t.Errorf("DirUsage() = %d, %d, want 2, 1023", count, size)
+	}
+	if count, size := DirUsage(filepath.Join(dir, "missing")); count != 0 || size != 0 {
+		t.Errorf("DirUsage() of a missing directory = %d, %d, want 0, 0", count, size)
+	}
+}
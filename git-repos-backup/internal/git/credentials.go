@@ -0,0 +1,66 @@
+package git
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+)
+
+// basicAuthCredentials returns the username and password git authenticates with over HTTP,
+// following the conventions of each provider for access tokens
+func basicAuthCredentials(provider *config.ProviderConfig) (string, string, bool) {
+	switch {
+	case provider.UseBasicAuth:
+		return provider.Username, provider.Password, true
+	case provider.AccessToken == "":
+		return "", "", false
+	case provider.Type == config.ProviderGitHub:
+		return "x-access-token", provider.AccessToken, true
+	case provider.Type == config.ProviderGitLab:
+		// GitLab expects tokens as the password of the "oauth2" user
+		return "oauth2", provider.AccessToken, true
+	default:
+		// Gitea accepts tokens as the username, with "x-oauth-basic" as the password
+		return provider.AccessToken, "x-oauth-basic", true
+	}
+}
+
+// CredentialEnv returns the environment variables giving git the provider credentials for a repository URL.
+// The credentials are sent as an `http.<origin>/.extraHeader` config entry set through the
+// GIT_CONFIG_COUNT/GIT_CONFIG_KEY_<n>/GIT_CONFIG_VALUE_<n> variables (git 2.31 or newer),
+// so they never appear in the command line, and only to the origin of the repository URL.
+func CredentialEnv(provider *config.ProviderConfig, repoUrl string) []string {
+	username, password, ok := basicAuthCredentials(provider)
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(repoUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil
+	}
+
+	// Keep the config entries already passed through the environment
+	index := 0
+	if count, err := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT")); err == nil && count > 0 {
+		index = count
+	}
+
+	token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", index+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.%s://%s/.extraHeader", index, u.Scheme, u.Host),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: Basic %s", index, token),
+	}
+}
+
+// GetAuthGitCommand returns a git command authenticating to the repository URL with the provider credentials
+func GetAuthGitCommand(provider *config.ProviderConfig, repoUrl string, elems ...string) *exec.Cmd {
+	cmd := GetGitCommand(provider, elems...)
+	cmd.Env = append(cmd.Env, CredentialEnv(provider, repoUrl)...)
+	return cmd
+}
@@ -0,0 +1,118 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidURL is returned for repository URLs that cannot be used for fetching
+var ErrInvalidURL = errors.New("invalid URL")
+
+// FetchStage identifies the step of a repository fetch that failed
+type FetchStage string
+
+const (
+	// StagePrepare is the creation of the repository directory
+	StagePrepare FetchStage = "create repository directory"
+	// StageURL is the preparation of the clone URL
+	StageURL FetchStage = "prepare clone URL"
+	// StageInit is the initialization of the bare repository
+	StageInit FetchStage = "initialize repository"
+	// StageFetch is the fetch of the repository refs
+	StageFetch FetchStage = "fetch repository"
+	// StageHead is the update of HEAD to the remote default branch
+	StageHead FetchStage = "update HEAD"
+	// StageLFS is the fetch of the LFS objects
+	StageLFS FetchStage = "fetch LFS objects"
+	// StageWiki is the lookup of the wiki repository of a repository
+	StageWiki FetchStage = "look up wiki"
+)
+
+// FetchError is returned when fetching a repository fails
+type FetchError struct {
+	// Repo is the full name of the repository
+	Repo  string
+	Stage FetchStage
+	Err   error
+}
+
+// Error implements the error interface
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// CommandError is returned when a git command exits with an error
+type CommandError struct {
+	// Command is the git subcommand (arguments are omitted as they can contain credentials)
+	Command string
+	Err     error
+	// Stderr is the last line written by git to its standard error
+	Stderr string
+}
+
+// Error implements the error interface
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("git %s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("git %s: %v: %s", e.Command, e.Err, e.Stderr)
+}
+
+// Unwrap returns the underlying error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// maxStderrTail is the number of bytes of git standard error kept for error messages
+const maxStderrTail = 4096
+
+// stderrTail is an io.Writer keeping the last bytes written to it
+type stderrTail struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Write implements the io.Writer interface
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > maxStderrTail {
+		t.buf = t.buf[len(t.buf)-maxStderrTail:]
+	}
+	return len(p), nil
+}
+
+// LastLine returns the last non-empty line written to the writer
+func (t *stderrTail) LastLine() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := strings.FieldsFunc(string(t.buf), func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// lastStderrLine returns the last line of the standard error captured by exec.Cmd.Output
+func lastStderrLine(err error) string {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return ""
+	}
+	tail := &stderrTail{}
+	tail.Write(exitErr.Stderr)
+	return tail.LastLine()
+}
@@ -3,12 +3,17 @@ package git
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
 )
 
@@ -16,106 +21,286 @@ import (
 // It can be replaced in tests to mock command execution.
 var ExecCommand = exec.Command
 
-// CloneRepository clones a repository to the target directory
-func FetchRepository(provider *config.ProviderConfig, repo repository.Repository, verbose bool) error {
+// CommandOutput holds the writers the output of git commands is copied to
+type CommandOutput struct {
+	Stdout *output.PrefixWriter
+	Stderr *output.PrefixWriter
+}
+
+// NewCommandOutput creates writers prefixing each line of git output with the repository name,
+// so the output of repositories fetched concurrently remains readable
+func NewCommandOutput(repoName string) *CommandOutput {
+	prefix := fmt.Sprintf("[%s] ", repoName)
+	return &CommandOutput{
+		Stdout: output.NewPrefixWriter(output.Stdout, prefix),
+		Stderr: output.NewPrefixWriter(output.Stderr, prefix),
+	}
+}
+
+// Flush writes any buffered incomplete line
+func (o *CommandOutput) Flush() {
+	o.Stdout.Flush()
+	o.Stderr.Flush()
+}
+
+// FetchResult describes the changes made by a repository fetch
+type FetchResult struct {
+	RepoDir string
+	// Created is set when the bare repository was initialized by this fetch
+	Created bool
+	// RefsChanged is the number of refs created, updated or deleted
+	RefsChanged int
+	// BytesTransferred is the growth of the repository object store
+	BytesTransferred int64
+	// LFS describes the LFS objects of the repository, when they are backed up
+	LFS *LFSResult
+	// Refs holds the object names of the refs after the fetch, indexed by ref name
+	Refs map[string]string
+	// DefaultBranch is the remote default branch HEAD was kept on, empty if it could not be looked up
+	DefaultBranch string
+}
+
+// FetchRepository fetches a repository into a bare repository in the target directory.
+// It is safe to call concurrently for different repositories.
+func FetchRepository(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*FetchResult, error) {
+	out := NewCommandOutput(repo.FullName)
+	defer out.Flush()
+
+	result := &FetchResult{}
 	repoDir, err := GetRepoPath(provider.TargetDir, repo.Login, repo.Name, verbose)
 	if err != nil {
-		log.Fatalf("Failed to create repo directory: %v", err)
+		return result, &FetchError{Repo: repo.FullName, Stage: StagePrepare, Err: err}
 	}
+	result.RepoDir = repoDir
 
-	// Prepare clone URL with authentication if needed
-	repoUrl, err := GetRepoUrl(provider, repo.URL)
+	// Prepare clone URL
+	repoUrl, err := CloneURL(provider, repo)
+	if err == nil {
+		repoUrl, err = GetRepoUrl(provider, repoUrl)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create clone URL: %v", err)
+		return result, &FetchError{Repo: repo.FullName, Stage: StageURL, Err: err}
 	}
 
 	// Init repository if it doesn't exist
 	if !RepoExists(repoDir, verbose) {
-		err := RunGitInit(repoDir, verbose)
-		if err != nil {
-			log.Fatalf("Failed to init repository: %v", err)
+		if err := RunGitInit(repoDir, out, verbose); err != nil {
+			return result, &FetchError{Repo: repo.FullName, Stage: StageInit, Err: err}
 		}
+		result.Created = true
 	}
 
+	// Snapshot refs and object store size to report the changes made by the fetch
+	refsBefore, _ := ListRefs(repoDir)
+	_, sizeBefore := fileutil.DirUsage(filepath.Join(repoDir, "objects"))
+
 	// Fetch repository
-	return RunGitFetch(provider, repoDir, repoUrl, repo.FullName, verbose)
+	if err := RunGitFetch(provider, repoDir, repoUrl, repo.FullName, out, verbose); err != nil {
+		return result, &FetchError{Repo: repo.FullName, Stage: StageFetch, Err: err}
+	}
+
+	refsAfter, _ := ListRefs(repoDir)
+	result.RefsChanged = countChangedRefs(refsBefore, refsAfter)
+	result.Refs = refsAfter
+
+	// Keep HEAD pointing at the remote default branch, so that clones of the backup check it out
+	defaultBranch := repo.DefaultBranch
+	if defaultBranch == "" {
+		if defaultBranch, err = RemoteDefaultBranch(provider, repoUrl); err != nil {
+			// The repository was fetched, only its HEAD is not updated
+			log.Printf("Failed to look up the default branch of %s, HEAD left unchanged: %v", repo.FullName, err)
+			defaultBranch = ""
+		}
+	}
+	result.DefaultBranch = defaultBranch
+	if defaultBranch != "" {
+		if _, ok := refsAfter["refs/heads/"+defaultBranch]; ok {
+			if err := UpdateHead(repoDir, defaultBranch, repo.FullName, out, verbose); err != nil {
+				return result, &FetchError{Repo: repo.FullName, Stage: StageHead, Err: err}
+			}
+		} else if verbose {
+			fmt.Fprintf(out.Stdout, "----> Default branch %s was not fetched, HEAD left unchanged\n", defaultBranch)
+		}
+	}
+	if _, sizeAfter := fileutil.DirUsage(filepath.Join(repoDir, "objects")); sizeAfter > sizeBefore {
+		result.BytesTransferred = sizeAfter - sizeBefore
+	}
+
+	// Fetch the LFS objects of all the refs, as the fetch only stores their pointers
+	if provider.LFS {
+		if result.LFS, err = RunLFSFetch(provider, repoDir, repoUrl, repo.FullName, out, verbose); err != nil {
+			return result, &FetchError{Repo: repo.FullName, Stage: StageLFS, Err: err}
+		}
+	}
+
+	return result, nil
+}
+
+// ListRefs returns the object names of all the refs of a repository, indexed by ref name
+func ListRefs(repoDir string) (map[string]string, error) {
+	cmd := ExecCommand("git", "-C", repoDir, "for-each-ref", "--format=%(objectname) %(refname)")
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, &CommandError{Command: "for-each-ref", Err: err}
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// countChangedRefs returns the number of refs created, updated or deleted between two snapshots
+func countChangedRefs(before map[string]string, after map[string]string) int {
+	changed := 0
+	for name, object := range after {
+		if before[name] != object {
+			changed++
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed++
+		}
+	}
+	return changed
 }
 
-func RunGitFetch(provider *config.ProviderConfig, repoDir string, repoUrl string, repoName string, verbose bool) error {
+// RunGitFetch fetches the refs selected by the provider ref set, copying git output to out
+func RunGitFetch(provider *config.ProviderConfig, repoDir string, repoUrl string, repoName string, out *CommandOutput, verbose bool) error {
+	refspecs, err := FetchRefspecs(provider)
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Fetching repository: %s", repoName)
-	cmd := GetGitCommand(provider, "-C", repoDir, "fetch", "--force", "--prune", "--tags", repoUrl, "refs/heads/*:refs/heads/*")
+	args := append([]string{"-C", repoDir, "fetch", "--force", "--prune", repoUrl}, refspecs...)
+	cmd := GetAuthGitCommand(provider, repoUrl, args...)
 	if verbose {
-		fmt.Printf("----> %s \n", cmd.String())
+		fmt.Fprintf(out.Stdout, "----> %s \n", cmd.String())
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return runCommand(cmd, "fetch", out)
 }
 
-func RunGitInit(repoDir string, verbose bool) error {
+// RemoteDefaultBranch returns the branch the HEAD of a remote repository points at,
+// or an empty string if the remote has no HEAD (e.g. an empty repository)
+func RemoteDefaultBranch(provider *config.ProviderConfig, repoUrl string) (string, error) {
+	cmd := GetAuthGitCommand(provider, repoUrl, "ls-remote", "--symref", repoUrl, "HEAD")
+	data, err := cmd.Output()
+	if err != nil {
+		return "", &CommandError{Command: "ls-remote", Err: err, Stderr: lastStderrLine(err)}
+	}
+
+	return symrefBranch(string(data)), nil
+}
+
+// symrefBranch returns the branch of the HEAD symref in `git ls-remote --symref` output,
+// reported as "ref: refs/heads/<branch>\tHEAD", or an empty string if there is none
+func symrefBranch(data string) string {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/")
+		}
+	}
+	return ""
+}
+
+// UpdateHead points the HEAD of a bare repository at a branch, if it points elsewhere
+func UpdateHead(repoDir string, branch string, repoName string, out *CommandOutput, verbose bool) error {
+	ref := "refs/heads/" + branch
+	current, err := ExecCommand("git", "-C", repoDir, "symbolic-ref", "--quiet", "HEAD").Output()
+	if err == nil && strings.TrimSpace(string(current)) == ref {
+		return nil
+	}
+
+	log.Printf("Setting HEAD of %s to %s", repoName, branch)
+	cmd := ExecCommand("git", "-C", repoDir, "symbolic-ref", "HEAD", ref)
+	if verbose {
+		fmt.Fprintf(out.Stdout, "----> %s \n", cmd.String())
+	}
+
+	return runCommand(cmd, "symbolic-ref", out)
+}
+
+// RunGitInit initializes a bare repository, copying git output to out
+func RunGitInit(repoDir string, out *CommandOutput, verbose bool) error {
 	log.Printf("Initializing repository in path: %s", repoDir)
 	cmd := ExecCommand("git", "-C", repoDir, "init", "--bare", "--quiet")
 	if verbose {
-		fmt.Printf("----> %s \n", cmd.String())
+		fmt.Fprintf(out.Stdout, "----> %s \n", cmd.String())
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return runCommand(cmd, "init", out)
+}
+
+// runCommand runs a git command, copying its output to out.
+// Failures are returned as *CommandError, including the last line git wrote to stderr.
+func runCommand(cmd *exec.Cmd, command string, out *CommandOutput) error {
+	tail := &stderrTail{}
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = io.MultiWriter(out.Stderr, tail)
+	if err := cmd.Run(); err != nil {
+		return &CommandError{Command: command, Err: err, Stderr: tail.LastLine()}
+	}
+	return nil
 }
 
+// GetGitCommand returns a git command applying the provider TLS and SSH settings.
+// Git never prompts for credentials, as there is no terminal to answer.
 func GetGitCommand(provider *config.ProviderConfig, elems ...string) *exec.Cmd {
 	cmd := ExecCommand("git")
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	if provider.Transport == config.TransportSSH {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+sshCommand(provider))
+	}
 	if provider.SkipSslValidation {
 		cmd.Args = append(cmd.Args, "-c", "http.sslVerify=false")
 	}
+	if provider.CACertFile != "" {
+		cmd.Args = append(cmd.Args, "-c", "http.sslCAInfo="+provider.CACertFile)
+	}
 	if len(elems) > 0 {
 		cmd.Args = append(cmd.Args, elems...)
 	}
 	return cmd
 }
 
+// GetRepoUrl checks a clone URL. Credentials are never added to the URL,
+// they are passed to git through the environment (see CredentialEnv).
 func GetRepoUrl(provider *config.ProviderConfig, rawUrl string) (string, error) {
 	if len(rawUrl) < 10 {
-		return "", fmt.Errorf("invalid URL: %s", rawUrl)
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, rawUrl)
 	}
 
-	var protocol string
-	var cloneURL string
-
-	if rawUrl[0:7] == "http://" {
-		protocol = "http://"
-		cloneURL = rawUrl[7:]
-	} else if rawUrl[0:8] == "https://" {
-		protocol = "https://"
-		cloneURL = rawUrl[8:]
-	} else {
-		// SSH or other protocols
-		return rawUrl, nil
+	if strings.HasPrefix(rawUrl, "http://") || strings.HasPrefix(rawUrl, "https://") {
+		u, err := url.Parse(rawUrl)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("%w: %s", ErrInvalidURL, rawUrl)
+		}
+		// Drop credentials returned by the provider API, if any
+		u.User = nil
+		return u.String(), nil
 	}
 
-	if provider.UseBasicAuth {
-		// Insert username and password for basic authentication
-		cloneURL = fmt.Sprintf("%s%s:%s@%s",
-			protocol,
-			provider.Username,
-			provider.Password,
-			cloneURL)
-	} else if provider.AccessToken != "" {
-		// Use token authentication
-		cloneURL = fmt.Sprintf("%s%s@%s",
-			protocol,
-			provider.AccessToken,
-			cloneURL)
-	} else {
-		// SSH or other protocols
-		cloneURL = rawUrl
-	}
+	// SSH or other protocols
+	return rawUrl, nil
+}
 
-	return cloneURL, nil
+// RepoPath returns the path of the backup of a repository, without creating it
+func RepoPath(targetDir string, userName string, repoName string) string {
+	return filepath.Join(targetDir, userName, repoName)
 }
 
+// GetRepoPath returns the path of the backup of a repository (see RepoPath), creating its directories
 func GetRepoPath(targetDir string, userName string, repoName string, verbose bool) (string, error) {
 	userDir := filepath.Join(targetDir, userName)
 	if _, err := os.Stat(userDir); os.IsNotExist(err) {
@@ -125,16 +310,20 @@ func GetRepoPath(targetDir string, userName string, repoName string, verbose boo
 		if verbose {
 			log.Printf("----> Created directory: %s", userDir)
 		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to access user directory %s: %w", userDir, err)
 	}
 
-	repoDir := filepath.Join(userDir, repoName)
+	repoDir := RepoPath(targetDir, userName, repoName)
 	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(repoDir, 0755); err != nil {
-			return "", fmt.Errorf("failed to create user directory %s: %w", repoDir, err)
+			return "", fmt.Errorf("failed to create repository directory %s: %w", repoDir, err)
 		}
 		if verbose {
 			log.Printf("----> Created directory: %s", repoDir)
 		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to access repository directory %s: %w", repoDir, err)
 	}
 
 	return repoDir, nil
@@ -0,0 +1,129 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+)
+
+// LFSResult describes the LFS objects of a backup repository
+type LFSResult struct {
+	// Objects is the number of LFS objects stored in the backup
+	Objects int
+	// Size is the total size of the LFS objects stored in the backup
+	Size int64
+	// Missing is the number of LFS objects referenced by the repository but missing on the server
+	Missing int
+}
+
+// RunLFSFetch fetches the LFS objects of all the refs of a bare repository with `git lfs fetch --all`,
+// applying the same TLS settings and credentials as the repository fetch, and copying git output to out.
+// Objects missing on the server are counted in the result instead of failing the fetch, as long as
+// git lfs reported no other error (e.g. authentication, TLS or network failures).
+func RunLFSFetch(provider *config.ProviderConfig, repoDir string, repoUrl string, repoName string, out *CommandOutput, verbose bool) (*LFSResult, error) {
+	log.Printf("Fetching LFS objects: %s", repoName)
+	cmd := GetAuthGitCommand(provider, repoUrl, "-C", repoDir, "lfs", "fetch", "--all", repoUrl)
+	if verbose {
+		fmt.Fprintf(out.Stdout, "----> %s \n", cmd.String())
+	}
+
+	tail := &stderrTail{}
+	missing := &missingLFSObjects{}
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = io.MultiWriter(out.Stderr, tail, missing)
+	err := cmd.Run()
+
+	result := &LFSResult{Missing: missing.Count()}
+	result.Objects, result.Size = fileutil.DirUsage(filepath.Join(repoDir, "lfs", "objects"))
+	if err != nil && result.Missing == 0 {
+		return result, &CommandError{Command: "lfs fetch", Err: err, Stderr: tail.LastLine()}
+	}
+	// The last line only summarizes the failed objects, the other error is reported instead
+	if err != nil && missing.Failure() != "" {
+		return result, &CommandError{Command: "lfs fetch", Err: err, Stderr: missing.Failure()}
+	}
+	return result, nil
+}
+
+// missingLFSObjects is an io.Writer counting the objects git lfs reports missing on the server
+// (`[<oid>] Object does not exist on the server ...`), and keeping the first line reporting another error
+type missingLFSObjects struct {
+	mu      sync.Mutex
+	partial []byte
+	oids    map[string]bool
+	failure string
+}
+
+// Write implements the io.Writer interface
+func (m *missingLFSObjects) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.partial = append(m.partial, p...)
+	for {
+		i := bytes.IndexAny(m.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		m.addLine(string(m.partial[:i]))
+		m.partial = m.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// addLine records the object of an output line reporting a missing object, or the line itself when it
+// reports another error. Progress lines and the final summary of the failed objects are ignored.
+func (m *missingLFSObjects) addLine(line string) {
+	lower := strings.ToLower(strings.TrimSpace(line))
+	if !strings.Contains(lower, "does not exist on the server") {
+		if m.failure == "" && lower != "" && !strings.HasPrefix(lower, "fetch:") &&
+			!strings.HasPrefix(lower, "git lfs:") && !strings.HasPrefix(lower, "downloading lfs objects") &&
+			!strings.Contains(lower, "failed to fetch some objects") {
+			m.failure = strings.TrimSpace(line)
+		}
+		return
+	}
+	oid := line
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]"); end > 0 {
+			oid = line[1:end]
+		}
+	}
+	if m.oids == nil {
+		m.oids = make(map[string]bool)
+	}
+	m.oids[oid] = true
+}
+
+// Count returns the number of distinct objects reported missing
+func (m *missingLFSObjects) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flush()
+	return len(m.oids)
+}
+
+// Failure returns the first line reporting an error other than a missing object, if any
+func (m *missingLFSObjects) Failure() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flush()
+	return m.failure
+}
+
+// flush records the last output line when it is not terminated
+func (m *missingLFSObjects) flush() {
+	if len(m.partial) > 0 {
+		m.addLine(string(m.partial))
+		m.partial = nil
+	}
+}
@@ -0,0 +1,142 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
+)
+
+const (
+	// headsRefspec maps the remote branches to local branches
+	headsRefspec = "refs/heads/*:refs/heads/*"
+	// tagsRefspec maps the remote tags to local tags
+	tagsRefspec = "refs/tags/*:refs/tags/*"
+	// allRefspec mirrors all the refs advertised by the server
+	allRefspec = "+refs/*:refs/*"
+)
+
+// pullRequestRefs returns the ref namespaces holding the pull (merge) request refs of a provider
+func pullRequestRefs(providerType config.ProviderType) []string {
+	if providerType == config.ProviderGitLab {
+		return []string{"refs/merge-requests/*"}
+	}
+	// GitHub and Gitea
+	return []string{"refs/pull/*"}
+}
+
+// FetchRefspecs returns the `git fetch` refspecs selected by the provider ref set
+// (custom when only `refspecs` is configured).
+// Pull request refs are only fetched when enabled: in `all` mode they are excluded
+// with negative refspecs (git 2.29 or newer), otherwise they are added to the refspecs.
+func FetchRefspecs(provider *config.ProviderConfig) ([]string, error) {
+	refs := provider.Refs
+	if refs == "" && len(provider.Refspecs) > 0 {
+		refs = config.RefSetCustom
+	}
+
+	var refspecs []string
+	switch refs {
+	case "", config.RefSetHeadsTags:
+		refspecs = []string{headsRefspec, tagsRefspec}
+	case config.RefSetAll:
+		refspecs = []string{allRefspec}
+		if !provider.IncludePulls {
+			for _, ref := range pullRequestRefs(provider.Type) {
+				refspecs = append(refspecs, "^"+ref)
+			}
+		}
+		return refspecs, nil
+	case config.RefSetCustom:
+		if len(provider.Refspecs) == 0 {
+			return nil, fmt.Errorf("ref set %q requires at least one refspec", config.RefSetCustom)
+		}
+		refspecs = append(refspecs, provider.Refspecs...)
+	default:
+		return nil, fmt.Errorf("invalid ref set %q: must be %s, %s or %s",
+			provider.Refs, config.RefSetHeadsTags, config.RefSetAll, config.RefSetCustom)
+	}
+
+	if provider.IncludePulls {
+		for _, ref := range pullRequestRefs(provider.Type) {
+			refspecs = append(refspecs, "+"+ref+":"+ref)
+		}
+	}
+	return refspecs, nil
+}
+
+// RemoteRefs returns the refs a fetch of the repository would store in its backup, with the object names
+// listed by `git ls-remote` (indexed by local ref name), and the remote default branch,
+// to compare them with the backup without fetching
+func RemoteRefs(provider *config.ProviderConfig, repo repository.Repository) (map[string]string, string, error) {
+	repoUrl, err := CloneURL(provider, repo)
+	if err == nil {
+		repoUrl, err = GetRepoUrl(provider, repoUrl)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	refspecs, err := FetchRefspecs(provider)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cmd := GetAuthGitCommand(provider, repoUrl, "ls-remote", "--symref", repoUrl)
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, "", &CommandError{Command: "ls-remote", Err: err, Stderr: lastStderrLine(err)}
+	}
+
+	remote := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		// Peeled tags (`refs/tags/<tag>^{}`) are not stored by fetches
+		fields := strings.Fields(line)
+		if len(fields) == 2 && !strings.HasSuffix(fields[1], "^{}") {
+			remote[fields[1]] = fields[0]
+		}
+	}
+	return mapRefs(remote, refspecs), symrefBranch(string(data)), nil
+}
+
+// mapRefs maps remote refs to the local refs a fetch with the refspecs stores them in.
+// Refs excluded by a negative refspec, or matching no refspec with a destination, are left out.
+func mapRefs(remote map[string]string, refspecs []string) map[string]string {
+	local := make(map[string]string)
+	for name, object := range remote {
+		excluded := false
+		for _, refspec := range refspecs {
+			if pattern, negative := strings.CutPrefix(refspec, "^"); negative {
+				if _, ok := matchRef(pattern, name); ok {
+					excluded = true
+				}
+			}
+		}
+		if excluded {
+			continue
+		}
+		for _, refspec := range refspecs {
+			src, dst, ok := strings.Cut(strings.TrimPrefix(refspec, "+"), ":")
+			if !ok || dst == "" || strings.HasPrefix(refspec, "^") {
+				continue
+			}
+			if rest, ok := matchRef(src, name); ok {
+				local[strings.Replace(dst, "*", rest, 1)] = object
+				break
+			}
+		}
+	}
+	return local
+}
+
+// matchRef matches a ref name against a refspec source, returning the part matched by its `*`, if any
+func matchRef(pattern string, name string) (string, bool) {
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return "", name == pattern
+	}
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
@@ -0,0 +1,44 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
+)
+
+// CloneURL returns the URL a repository is fetched from with the provider transport
+func CloneURL(provider *config.ProviderConfig, repo repository.Repository) (string, error) {
+	if provider.Transport != config.TransportSSH {
+		return repo.URL, nil
+	}
+	if repo.SSHURL == "" {
+		return "", fmt.Errorf("%w: no SSH URL reported for %s", ErrInvalidURL, repo.FullName)
+	}
+	return repo.SSHURL, nil
+}
+
+// sshCommand returns the GIT_SSH_COMMAND value applying the provider SSH settings.
+// SSH never prompts (batch mode): unknown hosts are rejected in strict mode,
+// and otherwise added to the known hosts file on first connection.
+func sshCommand(provider *config.ProviderConfig) string {
+	args := []string{"ssh", "-o", "BatchMode=yes"}
+	if provider.SSHKeyFile != "" {
+		args = append(args, "-i", shellQuote(provider.SSHKeyFile), "-o", "IdentitiesOnly=yes")
+	}
+	if provider.KnownHostsFile != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+provider.KnownHostsFile))
+	}
+	if provider.StrictHostKey {
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes a value for the shell git runs GIT_SSH_COMMAND with
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,66 @@
+package git
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
+)
+
+// ErrNoWiki is returned when fetching the wiki of a repository that has none
+var ErrNoWiki = errors.New("repository has no wiki")
+
+// WikiRepository returns the wiki of a repository, stored by Gitea and GitHub in a separate
+// `<repo>.wiki.git` repository. It is backed up next to the repository, in `<repo>.wiki`.
+func WikiRepository(repo repository.Repository) repository.Repository {
+	return repository.Repository{
+		Id:       repo.Id,
+		Login:    repo.Login,
+		Name:     repo.Name + ".wiki",
+		FullName: repo.FullName + ".wiki",
+		URL:      wikiURL(repo.URL),
+		SSHURL:   wikiURL(repo.SSHURL),
+		Private:  repo.Private,
+	}
+}
+
+// wikiURL returns the URL of the wiki repository of a repository URL
+func wikiURL(repoUrl string) string {
+	if repoUrl == "" {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(repoUrl, "/"), ".git") + ".wiki.git"
+}
+
+// FetchWiki fetches the wiki of a repository into a bare repository next to the repository backup,
+// the same way as the repository itself.
+// ErrNoWiki is returned when the wiki is disabled, or when it has no page yet (its repository is
+// only created with the first page); nothing is written in that case.
+func FetchWiki(provider *config.ProviderConfig, repo repository.Repository, verbose bool) (*FetchResult, error) {
+	if !repo.HasWiki {
+		return &FetchResult{}, ErrNoWiki
+	}
+
+	wiki := WikiRepository(repo)
+	repoUrl, err := CloneURL(provider, wiki)
+	if err == nil {
+		repoUrl, err = GetRepoUrl(provider, repoUrl)
+	}
+	if err != nil {
+		return &FetchResult{}, &FetchError{Repo: wiki.FullName, Stage: StageURL, Err: err}
+	}
+
+	// Look the wiki up before creating its backup, reusing its HEAD for the fetch
+	defaultBranch, err := RemoteDefaultBranch(provider, repoUrl)
+	if err != nil {
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) && strings.Contains(strings.ToLower(cmdErr.Stderr), "not found") {
+			return &FetchResult{}, ErrNoWiki
+		}
+		return &FetchResult{}, &FetchError{Repo: wiki.FullName, Stage: StageWiki, Err: err}
+	}
+	wiki.DefaultBranch = defaultBranch
+
+	return FetchRepository(provider, wiki, verbose)
+}
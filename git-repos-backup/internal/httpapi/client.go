@@ -0,0 +1,310 @@
+// Package httpapi provides the HTTP client used to interact with Git provider APIs
+package httpapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
+)
+
+// DefaultTimeout is the maximum duration of a single API request
+const DefaultTimeout = 60 * time.Second
+
+// maxErrorBodyLength is the maximum number of response body bytes included in error messages
+const maxErrorBodyLength = 512
+
+var (
+	// ErrUnauthorized is matched by API errors with status 401
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is matched by API errors with status 403
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotFound is matched by API errors with status 404
+	ErrNotFound = errors.New("not found")
+	// ErrRateLimited is matched by API errors caused by an exhausted rate limit
+	ErrRateLimited = errors.New("rate limited")
+	// ErrServer is matched by API errors with a 5xx status
+	ErrServer = errors.New("server error")
+)
+
+// APIError is returned when a provider API responds with a non-2xx status code
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// Message is the error message extracted from the response body, if any
+	Message string
+	Body    []byte
+	// RateLimited is set when the response reports an exhausted rate limit
+	RateLimited bool
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	detail := e.Message
+	if detail == "" {
+		detail = strings.TrimSpace(string(e.Body))
+		if len(detail) > maxErrorBodyLength {
+			detail = detail[:maxErrorBodyLength] + "..."
+		}
+	}
+	if detail == "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.URL, e.Status, detail)
+}
+
+// Is allows matching API errors against the status sentinel errors with errors.Is
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.RateLimited
+	case ErrServer:
+		return e.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+// Response holds the result of a successful API request
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Client performs requests against a provider API
+type Client struct {
+	HTTPClient *http.Client
+	// Header contains the headers sent with every request
+	Header http.Header
+	// Username and Password are sent as basic authentication when Username is set
+	Username string
+	Password string
+	Verbose  bool
+	// RequestHook is called with every request right before it is sent.
+	// It can be used in tests to inspect or redirect requests.
+	RequestHook func(*http.Request)
+	// ResponseHook is called with every response before its status is checked.
+	// It can be used in tests to inspect or alter responses.
+	ResponseHook func(*http.Response)
+}
+
+// NewClient creates an API client using the TLS and authentication settings of a provider
+func NewClient(provider *config.ProviderConfig) (*Client, error) {
+	tlsConfig, err := TLSConfig(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client := &Client{
+		HTTPClient: &http.Client{
+			Transport: transport,
+			Timeout:   DefaultTimeout,
+		},
+		Header: http.Header{},
+	}
+	if provider.UseBasicAuth {
+		client.Username = provider.Username
+		client.Password = provider.Password
+	}
+
+	return client, nil
+}
+
+// TLSConfig builds the TLS configuration of a provider
+func TLSConfig(provider *config.ProviderConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: provider.SkipSslValidation,
+	}
+
+	if provider.CACertFile != "" {
+		pem, err := os.ReadFile(provider.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in CA certificate file %s", provider.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// Get performs a GET request against the specified URL
+func (c *Client) Get(url string) (*Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return c.Do(req)
+}
+
+// Do sends a request and returns the response if its status code is 2xx.
+// Any other status code results in an *APIError.
+func (c *Client) Do(req *http.Request) (*Response, error) {
+	resp, err := c.send(req, c.httpClient())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: failed to read response body: %w", req.Method, req.URL.String(), err)
+	}
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}, nil
+}
+
+// Stream sends a request and returns the response with its body left to be read by the caller,
+// if its status code is 2xx. Any other status code results in an *APIError.
+// Unlike Do, the request duration is not limited, so large bodies can be downloaded: the request
+// is only cancelled when no data is received for DefaultTimeout.
+// The caller must close the response body.
+func (c *Client) Stream(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(DefaultTimeout, cancel)
+
+	httpClient := *c.httpClient()
+	httpClient.Timeout = 0
+	resp, err := c.send(req.WithContext(ctx), &httpClient)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, timer: timer, cancel: cancel}
+	return resp, nil
+}
+
+// idleTimeoutBody is a response body cancelling its request when no data is read for DefaultTimeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+// Read implements the io.Reader interface
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(DefaultTimeout)
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// httpClient returns the HTTP client requests are sent with
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// send sends a request with the client headers and credentials.
+// Responses with a non-2xx status code are closed and returned as *APIError.
+func (c *Client) send(req *http.Request, httpClient *http.Client) (*http.Response, error) {
+	for key, values := range c.Header {
+		if req.Header.Get(key) != "" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if c.Verbose {
+		fmt.Fprintf(output.Stdout, "----> %s %s\n", req.Method, req.URL.String())
+	}
+	if c.RequestHook != nil {
+		c.RequestHook(req)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.String(), err)
+	}
+	if c.ResponseHook != nil {
+		c.ResponseHook(resp)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: failed to read response body: %w", req.Method, req.URL.String(), err)
+		}
+		return nil, &APIError{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			StatusCode:  resp.StatusCode,
+			Status:      resp.Status,
+			Message:     errorMessage(body),
+			Body:        body,
+			RateLimited: isRateLimited(resp),
+		}
+	}
+	return resp, nil
+}
+
+// errorMessage extracts the error message from a JSON error response body
+func errorMessage(body []byte) string {
+	var payload struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	if payload.Message != "" {
+		return payload.Message
+	}
+	return payload.Error
+}
+
+// isRateLimited reports whether a response was rejected because of an exhausted rate limit
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0"
+}
@@ -0,0 +1,219 @@
+package httpapi
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+)
+
+func TestClientGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("X-Total-Count", "1")
+			fmt.Fprint(w, `[{"id": 1}]`)
+		case "/unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "Bad credentials"}`)
+		case "/rate-limited":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+		case "/server-error":
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "<html>Bad Gateway</html>")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "404 Not Found"}`)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(&config.ProviderConfig{})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	// Successful request
+	resp, err := client.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != `[{"id": 1}]` {
+		t.Errorf("Get() = %d %s, want 200 [{\"id\": 1}]", resp.StatusCode, resp.Body)
+	}
+	if resp.Header.Get("X-Total-Count") != "1" {
+		t.Errorf("Expected X-Total-Count header 1, got %q", resp.Header.Get("X-Total-Count"))
+	}
+
+	// Error responses
+	tests := []struct {
+		path        string
+		want        error
+		wantMessage string
+	}{
+		{path: "/unauthorized", want: ErrUnauthorized, wantMessage: "Bad credentials"},
+		{path: "/rate-limited", want: ErrRateLimited, wantMessage: "API rate limit exceeded"},
+		{path: "/server-error", want: ErrServer, wantMessage: "Bad Gateway"},
+		{path: "/missing", want: ErrNotFound, wantMessage: "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := client.Get(server.URL + tt.path)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Get() error = %v, want %v", err, tt.want)
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Get() error = %T, want *APIError", err)
+			}
+			if !strings.Contains(apiErr.Error(), tt.wantMessage) {
+				t.Errorf("Error() = %q, should contain %q", apiErr.Error(), tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestClientHooksAndAuth(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(&config.ProviderConfig{
+		UseBasicAuth: true,
+		Username:     "user",
+		Password:     "pass",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	client.Header.Set("Accept", "application/json")
+
+	var hookedRequest, hookedResponse bool
+	client.RequestHook = func(req *http.Request) {
+		hookedRequest = true
+		req.Header.Set("X-Test", "1")
+	}
+	client.ResponseHook = func(resp *http.Response) {
+		hookedResponse = true
+	}
+
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if !hookedRequest || !hookedResponse {
+		t.Errorf("Expected both hooks to be called, got request=%v response=%v", hookedRequest, hookedResponse)
+	}
+	if received.Header.Get("X-Test") != "1" {
+		t.Error("Expected header set by the request hook to be sent")
+	}
+	if received.Header.Get("Accept") != "application/json" {
+		t.Errorf("Expected default Accept header, got %q", received.Header.Get("Accept"))
+	}
+	if username, password, ok := received.BasicAuth(); !ok || username != "user" || password != "pass" {
+		t.Errorf("Expected basic auth user:pass, got %s:%s (%v)", username, password, ok)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/asset" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+			return
+		}
+		if r.Header.Get("Accept") != "application/octet-stream" {
+			t.Errorf("Expected Accept header application/octet-stream, got %q", r.Header.Get("Accept"))
+		}
+		fmt.Fprint(w, "asset content")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(&config.ProviderConfig{})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	client.Header.Set("Accept", "application/json")
+
+	// The headers of the request take precedence over the client headers
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/asset", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := client.Stream(req)
+	if err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "asset content" {
+		t.Errorf("Stream() body = %q, %v, want %q", body, err, "asset content")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/missing", nil)
+	if _, err := client.Stream(req); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stream() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	// Skip SSL validation
+	tlsConfig, err := TLSConfig(&config.ProviderConfig{SkipSslValidation: true})
+	if err != nil {
+		t.Fatalf("TLSConfig() error = %v", err)
+	}
+	if !tlsConfig.InsecureSkipVerify {
+		t.Error("Expected InsecureSkipVerify to be set")
+	}
+
+	// Missing CA certificate file
+	if _, err := TLSConfig(&config.ProviderConfig{CACertFile: "nonexistent.pem"}); err == nil {
+		t.Error("Expected error for missing CA certificate file, got nil")
+	}
+
+	// Invalid CA certificate file
+	invalidFile := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalidFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("Failed to write test CA file: %v", err)
+	}
+	if _, err := TLSConfig(&config.ProviderConfig{CACertFile: invalidFile}); err == nil {
+		t.Error("Expected error for invalid CA certificate file, got nil")
+	}
+
+	// Server certificate trusted through the CA certificate file
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certificatePEM(server.Certificate().Raw), 0644); err != nil {
+		t.Fatalf("Failed to write test CA file: %v", err)
+	}
+
+	client, err := NewClient(&config.ProviderConfig{CACertFile: caFile})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if _, err := client.Get(server.URL); err != nil {
+		t.Errorf("Get() with CA certificate file error = %v", err)
+	}
+}
+
+// certificatePEM encodes a DER certificate as PEM
+func certificatePEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,243 @@
+// Package metrics exposes the outcome of the backup runs as Prometheus metrics and a health check
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
+)
+
+// fetchDurationBuckets are the upper bounds, in seconds, of the fetch duration histogram buckets
+var fetchDurationBuckets = []float64{1, 5, 15, 60, 300, 900, 3600}
+
+// providerMetrics holds the metrics of a provider
+type providerMetrics struct {
+	lastRun         time.Time
+	lastSuccess     time.Time
+	lastRunSuccess  bool
+	lastRunDuration time.Duration
+	// repos holds the repository counts of the last run, by status
+	repos map[report.Status]int
+	// reposTotal holds the repository counts of all the runs, by status
+	reposTotal       map[report.Status]int
+	bytesTransferred int64
+	diskUsage        int64
+
+	// Fetch duration histogram: cumulative bucket counts, sum and count
+	fetchBuckets []uint64
+	fetchSum     float64
+	fetchCount   uint64
+}
+
+// Metrics collects the outcome of the backup runs of the providers
+type Metrics struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	maxAge    time.Duration
+	names     []string
+	providers map[string]*providerMetrics
+}
+
+// New creates the metrics of a daemon started now.
+// The health check fails when the last successful backup of a provider is older than maxAge (0 disables it).
+func New(maxAge time.Duration) *Metrics {
+	return &Metrics{
+		startedAt: time.Now(),
+		maxAge:    maxAge,
+		providers: make(map[string]*providerMetrics),
+	}
+}
+
+// AddProvider registers a provider, so its metrics are exposed and its backups are health checked
+// before its first run
+func (m *Metrics) AddProvider(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.provider(name)
+}
+
+// provider returns the metrics of a provider, registering it if needed
+func (m *Metrics) provider(name string) *providerMetrics {
+	p, ok := m.providers[name]
+	if !ok {
+		p = &providerMetrics{
+			repos:        map[report.Status]int{},
+			reposTotal:   map[report.Status]int{},
+			fetchBuckets: make([]uint64, len(fetchDurationBuckets)),
+		}
+		m.providers[name] = p
+		m.names = append(m.names, name)
+		sort.Strings(m.names)
+	}
+	return p
+}
+
+// Record records the outcome of a run, including the disk usage of the target directories of its providers
+func (m *Metrics) Record(r *report.Report) {
+	// Measure the disk usage first, as it can take a while for large backups
+	diskUsage := make(map[string]int64, len(r.Providers))
+	for _, provider := range r.Providers {
+		_, diskUsage[provider.Name] = fileutil.DirUsage(provider.TargetDir)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, provider := range r.Providers {
+		p := m.provider(provider.Name)
+		p.lastRun = r.FinishedAt
+		p.lastRunSuccess = !provider.Failed()
+		if p.lastRunSuccess {
+			p.lastSuccess = r.FinishedAt
+		}
+		p.lastRunDuration = time.Duration(provider.Duration)
+		p.diskUsage = diskUsage[provider.Name]
+
+		p.repos = map[report.Status]int{}
+		for _, repo := range provider.Repos {
+			p.repos[repo.Status]++
+			p.reposTotal[repo.Status]++
+			p.bytesTransferred += repo.BytesTransferred
+			if repo.Status == report.StatusSkipped {
+				continue
+			}
+
+			seconds := time.Duration(repo.Duration).Seconds()
+			for i, bound := range fetchDurationBuckets {
+				if seconds <= bound {
+					p.fetchBuckets[i]++
+				}
+			}
+			p.fetchSum += seconds
+			p.fetchCount++
+		}
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gauge := func(name string, help string, value func(p *providerMetrics) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, provider := range m.names {
+			fmt.Fprintf(w, "%s{provider=\"%s\"} %s\n", name, escapeLabel(provider), formatValue(value(m.providers[provider])))
+		}
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	gauge("git_repos_backup_last_run_timestamp_seconds", "Time the last backup run of the provider finished.",
+		func(p *providerMetrics) float64 { return timestamp(p.lastRun) })
+	gauge("git_repos_backup_last_success_timestamp_seconds", "Time the last successful backup run of the provider finished.",
+		func(p *providerMetrics) float64 { return timestamp(p.lastSuccess) })
+	gauge("git_repos_backup_last_run_success", "Whether the last backup run of the provider succeeded (1) or failed (0).",
+		func(p *providerMetrics) float64 {
+			if p.lastRunSuccess {
+				return 1
+			}
+			return 0
+		})
+	gauge("git_repos_backup_last_run_duration_seconds", "Duration of the last backup run of the provider.",
+		func(p *providerMetrics) float64 { return p.lastRunDuration.Seconds() })
+	gauge("git_repos_backup_disk_usage_bytes", "Size of the backups of the provider on disk.",
+		func(p *providerMetrics) float64 { return float64(p.diskUsage) })
+
+	statusMetric := func(name string, help string, metricType string, counts func(p *providerMetrics) map[report.Status]int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+		for _, provider := range m.names {
+			for _, status := range report.Statuses {
+				fmt.Fprintf(w, "%s{provider=\"%s\",status=\"%s\"} %d\n", name, escapeLabel(provider), status, counts(m.providers[provider])[status])
+			}
+		}
+	}
+	statusMetric("git_repos_backup_repositories", "Repositories of the last backup run of the provider, by status.", "gauge",
+		func(p *providerMetrics) map[report.Status]int { return p.repos })
+	statusMetric("git_repos_backup_repositories_total", "Repositories of all the backup runs of the provider, by status.", "counter",
+		func(p *providerMetrics) map[report.Status]int { return p.reposTotal })
+
+	fmt.Fprintf(w, "# HELP git_repos_backup_bytes_transferred_total Bytes received by the repository fetches of the provider.\n")
+	fmt.Fprintf(w, "# TYPE git_repos_backup_bytes_transferred_total counter\n")
+	for _, provider := range m.names {
+		fmt.Fprintf(w, "git_repos_backup_bytes_transferred_total{provider=\"%s\"} %d\n", escapeLabel(provider), m.providers[provider].bytesTransferred)
+	}
+
+	name := "git_repos_backup_fetch_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the repository fetches of the provider.\n# TYPE %s histogram\n", name, name)
+	for _, provider := range m.names {
+		p := m.providers[provider]
+		label := escapeLabel(provider)
+		for i, bound := range fetchDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket{provider=\"%s\",le=\"%s\"} %d\n", name, label, formatValue(bound), p.fetchBuckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{provider=\"%s\",le=\"+Inf\"} %d\n", name, label, p.fetchCount)
+		fmt.Fprintf(w, "%s_sum{provider=\"%s\"} %s\n", name, label, formatValue(p.fetchSum))
+		fmt.Fprintf(w, "%s_count{provider=\"%s\"} %d\n", name, label, p.fetchCount)
+	}
+}
+
+// Health checks that the last successful backup of every provider is not older than the maximum age.
+// Providers without any successful backup are checked against the daemon start time.
+// It returns the list of problems, empty when healthy.
+func (m *Metrics) Health(now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxAge <= 0 {
+		return nil
+	}
+	var problems []string
+	for _, name := range m.names {
+		p := m.providers[name]
+		if p.lastSuccess.IsZero() {
+			if age := now.Sub(m.startedAt); age > m.maxAge {
+				problems = append(problems, fmt.Sprintf("%s: no successful backup since the start %s ago", name, age.Round(time.Second)))
+			}
+		} else if age := now.Sub(p.lastSuccess); age > m.maxAge {
+			problems = append(problems, fmt.Sprintf("%s: last successful backup %s ago", name, age.Round(time.Second)))
+		}
+	}
+	return problems
+}
+
+// Handler returns the HTTP handler serving `/metrics` and `/healthz`
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteText(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		problems := m.Health(time.Now())
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "unhealthy\n%s\n", strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatValue formats a sample value for the text exposition format
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
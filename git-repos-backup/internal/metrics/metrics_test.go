@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
+)
+
+// testReport returns the report of a run backing up a provider with two repositories
+func testReport(t *testing.T, targetDir string, failed bool) *report.Report {
+	t.Helper()
+
+	r := report.New("test")
+	provider := r.AddProvider(`team "a"`, "github", "", targetDir)
+	provider.AddRepo(report.RepoReport{Name: "owner/repo1", Status: report.StatusUpdated, Duration: report.Duration(2 * time.Second), BytesTransferred: 1024})
+	provider.AddRepo(report.RepoReport{Name: "owner/repo2", Status: report.StatusSkipped})
+	if failed {
+		provider.AddRepo(report.RepoReport{Name: "owner/repo3", Status: report.StatusFailed, Duration: report.Duration(500 * time.Millisecond), Error: "fetch failed"})
+	}
+	provider.Finish()
+	r.Finish()
+	return r
+}
+
+func TestWriteText(t *testing.T) {
+	targetDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(targetDir, "packfile"), make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	m := New(0)
+	m.AddProvider("gitea")
+	m.Record(testReport(t, targetDir, false))
+	m.Record(testReport(t, targetDir, true))
+
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	text := buf.String()
+
+	for _, want := range []string{
+		"# TYPE git_repos_backup_last_run_success gauge\n",
+		`git_repos_backup_last_run_success{provider="team \"a\""} 0`,
+		`git_repos_backup_last_run_success{provider="gitea"} 0`,
+		`git_repos_backup_last_run_timestamp_seconds{provider="gitea"} 0`,
+		`git_repos_backup_disk_usage_bytes{provider="team \"a\""} 4096`,
+		`git_repos_backup_repositories{provider="team \"a\"",status="failed"} 1`,
+		`git_repos_backup_repositories{provider="team \"a\"",status="updated"} 1`,
+		`git_repos_backup_repositories_total{provider="team \"a\"",status="updated"} 2`,
+		`git_repos_backup_repositories_total{provider="team \"a\"",status="skipped"} 2`,
+		`git_repos_backup_bytes_transferred_total{provider="team \"a\""} 2048`,
+		"# TYPE git_repos_backup_fetch_duration_seconds histogram\n",
+		`git_repos_backup_fetch_duration_seconds_bucket{provider="team \"a\"",le="1"} 1`,
+		`git_repos_backup_fetch_duration_seconds_bucket{provider="team \"a\"",le="5"} 3`,
+		`git_repos_backup_fetch_duration_seconds_bucket{provider="team \"a\"",le="+Inf"} 3`,
+		`git_repos_backup_fetch_duration_seconds_sum{provider="team \"a\""} 4.5`,
+		`git_repos_backup_fetch_duration_seconds_count{provider="team \"a\""} 3`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("WriteText() output should contain %q, got:\n%s", want, text)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	targetDir := t.TempDir()
+	now := time.Now()
+
+	// Disabled
+	m := New(0)
+	m.AddProvider("github")
+	if problems := m.Health(now.Add(time.Hour)); len(problems) != 0 {
+		t.Errorf("Health() = %v, want healthy when disabled", problems)
+	}
+
+	// Providers without a successful backup are checked against the start time
+	m = New(time.Hour)
+	m.AddProvider(`team "a"`)
+	if problems := m.Health(now); len(problems) != 0 {
+		t.Errorf("Health() = %v, want healthy right after the start", problems)
+	}
+	if problems := m.Health(now.Add(2 * time.Hour)); len(problems) != 1 {
+		t.Errorf("Health() = %v, want unhealthy without any successful backup", problems)
+	}
+
+	// A failed run does not count as a successful backup
+	m.Record(testReport(t, targetDir, true))
+	if problems := m.Health(now.Add(2 * time.Hour)); len(problems) != 1 {
+		t.Errorf("Health() = %v, want unhealthy after a failed backup", problems)
+	}
+
+	m.Record(testReport(t, targetDir, false))
+	if problems := m.Health(time.Now().Add(30 * time.Minute)); len(problems) != 0 {
+		t.Errorf("Health() = %v, want healthy after a successful backup", problems)
+	}
+	problems := m.Health(time.Now().Add(2 * time.Hour))
+	if len(problems) != 1 || !strings.Contains(problems[0], "last successful backup") {
+		t.Errorf("Health() = %v, want unhealthy when the last successful backup is too old", problems)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New(time.Nanosecond)
+	m.AddProvider("github")
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `git_repos_backup_last_run_success{provider="github"} 0`) {
+		t.Errorf("GET /metrics = %d %s", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text content type, got %s", contentType)
+	}
+
+	time.Sleep(time.Millisecond)
+	resp, err = http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "github: no successful backup") {
+		t.Errorf("GET /healthz = %d %s, want 503", resp.StatusCode, body)
+	}
+}
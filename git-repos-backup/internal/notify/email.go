@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+)
+
+// emailSender sends the summary by email through an SMTP server.
+// The connection uses implicit TLS, or STARTTLS when the server supports it; credentials are only sent
+// over TLS or to localhost.
+type emailSender struct {
+	host     string
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+	// implicitTLS connects over TLS instead of upgrading the connection with STARTTLS
+	implicitTLS bool
+	// rootCAs verifies the certificate of the server, the system roots when nil
+	rootCAs *x509.CertPool
+}
+
+// newEmailSender creates the sender of an email notification
+func newEmailSender(cfg config.NotificationConfig) *emailSender {
+	implicitTLS := cfg.SMTPTLS == config.SMTPTLSImplicit ||
+		(cfg.SMTPTLS == "" && cfg.SMTPPort == config.ImplicitTLSSMTPPort)
+	port := cfg.SMTPPort
+	if port == 0 && implicitTLS {
+		port = config.ImplicitTLSSMTPPort
+	} else if port == 0 {
+		port = config.DefaultSMTPPort
+	}
+	return &emailSender{
+		host:        cfg.SMTPHost,
+		addr:        net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(port)),
+		username:    cfg.Username,
+		password:    cfg.Password,
+		from:        cfg.From,
+		to:          cfg.To,
+		implicitTLS: implicitTLS,
+	}
+}
+
+// Send implements the Sender interface
+func (s *emailSender) Send(ctx context.Context, summary *Summary) error {
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	to := make([]string, len(s.to))
+	for i, address := range s.to {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("invalid to address: %w", err)
+		}
+		to[i] = parsed.Address
+	}
+
+	tlsConfig := &tls.Config{ServerName: s.host, RootCAs: s.rootCAs}
+	var conn net.Conn
+	if s.implicitTLS {
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !s.implicitTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			return fmt.Errorf("failed to send email to %s: %w", address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(s.message(summary)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return client.Quit()
+}
+
+// message formats the summary as a plain text email message
+func (s *emailSender) message(summary *Summary) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", summary.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(summary.Text(), "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxErrorBodyLength is the maximum number of response body bytes included in error messages
+const maxErrorBodyLength = 512
+
+// webhookSender posts the summary as JSON, with its text in the `text` field
+type webhookSender struct {
+	url string
+}
+
+// Send implements the Sender interface
+func (s *webhookSender) Send(ctx context.Context, summary *Summary) error {
+	payload := struct {
+		*Summary
+		Text string `json:"text"`
+	}{summary, summary.Text()}
+	return postJSON(ctx, s.url, payload, nil)
+}
+
+// slackSender posts the summary to a Slack or Mattermost incoming webhook
+type slackSender struct {
+	url string
+}
+
+// Send implements the Sender interface
+func (s *slackSender) Send(ctx context.Context, summary *Summary) error {
+	payload := map[string]string{
+		"text": summary.Title + "\n```\n" + summary.Text() + "```",
+	}
+	return postJSON(ctx, s.url, payload, nil)
+}
+
+// ntfySender publishes the summary to an ntfy topic
+type ntfySender struct {
+	url   string
+	token string
+}
+
+// Send implements the Sender interface
+func (s *ntfySender) Send(ctx context.Context, summary *Summary) error {
+	headers := map[string]string{
+		"Title":    summary.Title,
+		"Priority": "default",
+		"Tags":     "white_check_mark",
+	}
+	if !summary.Success {
+		headers["Priority"] = "high"
+		headers["Tags"] = "warning"
+	}
+	if s.token != "" {
+		headers["Authorization"] = "Bearer " + s.token
+	}
+	return post(ctx, s.url, "text/plain; charset=utf-8", []byte(summary.Text()), headers)
+}
+
+// Priorities of the Gotify messages
+const (
+	gotifySuccessPriority = 2
+	gotifyFailurePriority = 8
+)
+
+// gotifySender pushes the summary to a Gotify server
+type gotifySender struct {
+	url   string
+	token string
+}
+
+// Send implements the Sender interface
+func (s *gotifySender) Send(ctx context.Context, summary *Summary) error {
+	payload := map[string]interface{}{
+		"title":    summary.Title,
+		"message":  summary.Text(),
+		"priority": gotifySuccessPriority,
+	}
+	if !summary.Success {
+		payload["priority"] = gotifyFailurePriority
+	}
+	return postJSON(ctx, strings.TrimSuffix(s.url, "/")+"/message", payload, map[string]string{"X-Gotify-Key": s.token})
+}
+
+// postJSON posts a JSON payload
+func postJSON(ctx context.Context, url string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	return post(ctx, url, "application/json", body, headers)
+}
+
+// post posts a request body, expecting a 2xx response.
+// The errors do not include the URL, as it can contain credentials (e.g. the webhook URLs).
+func post(ctx context.Context, endpoint string, contentType string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid notification URL")
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+		if message := strings.TrimSpace(string(detail)); message != "" {
+			return fmt.Errorf("unexpected response status %s: %s", resp.Status, message)
+		}
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
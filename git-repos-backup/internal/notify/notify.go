@@ -0,0 +1,265 @@
+// Package notify sends summaries of the backup runs to webhooks, chat and push services and email
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/schedule"
+)
+
+// sendTimeout is the maximum duration of sending a notification
+const sendTimeout = 30 * time.Second
+
+// maxFailures is the maximum number of failures listed in the summary text
+const maxFailures = 20
+
+// Failure is a provider or repository that could not be backed up
+type Failure struct {
+	Provider string `json:"provider"`
+	// Repository is empty when the provider failed as a whole
+	Repository string `json:"repository,omitempty"`
+	Error      string `json:"error"`
+}
+
+// Summary summarizes one or more backup runs
+type Summary struct {
+	Title      string    `json:"title"`
+	Success    bool      `json:"success"`
+	Runs       int       `json:"runs"`
+	FailedRuns int       `json:"failed_runs"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Duration is the total duration of the runs
+	Duration report.Duration       `json:"duration_seconds"`
+	Counts   map[report.Status]int `json:"counts"`
+	Failures []Failure             `json:"failures"`
+}
+
+// Summarize summarizes the reports of finished runs, in chronological order
+func Summarize(reports []*report.Report) *Summary {
+	s := &Summary{
+		Success:  true,
+		Runs:     len(reports),
+		Counts:   map[report.Status]int{},
+		Failures: []Failure{},
+	}
+	for i, r := range reports {
+		if i == 0 {
+			s.StartedAt = r.StartedAt
+		}
+		s.FinishedAt = r.FinishedAt
+		s.Duration += r.Duration
+		if !r.Success {
+			s.Success = false
+			s.FailedRuns++
+		}
+		for status, count := range r.Counts {
+			s.Counts[status] += count
+		}
+		for _, provider := range r.Providers {
+			if provider.Error != "" {
+				s.Failures = append(s.Failures, Failure{Provider: provider.Name, Error: provider.Error})
+			}
+			for _, repo := range provider.Repos {
+				if repo.Status == report.StatusFailed {
+					s.Failures = append(s.Failures, Failure{Provider: provider.Name, Repository: repo.Name, Error: repo.Error})
+				}
+			}
+		}
+	}
+
+	switch {
+	case s.Runs > 1 && s.Success:
+		s.Title = fmt.Sprintf("git-repos-backup: %d backup runs succeeded", s.Runs)
+	case s.Runs > 1:
+		s.Title = fmt.Sprintf("git-repos-backup: %d of %d backup runs failed (%d failure(s))", s.FailedRuns, s.Runs, len(s.Failures))
+	case s.Success:
+		s.Title = "git-repos-backup: backup succeeded"
+	default:
+		s.Title = fmt.Sprintf("git-repos-backup: backup failed (%d failure(s))", len(s.Failures))
+	}
+	return s
+}
+
+// Text returns the summary as plain text, without the title
+func (s *Summary) Text() string {
+	var b strings.Builder
+
+	counts := make([]string, 0, len(report.Statuses))
+	for _, status := range report.Statuses {
+		counts = append(counts, fmt.Sprintf("%d %s", s.Counts[status], status))
+	}
+	fmt.Fprintf(&b, "Repositories: %s\n", strings.Join(counts, ", "))
+	if s.Runs > 1 {
+		fmt.Fprintf(&b, "Runs: %d (%d failed), from %s to %s\n", s.Runs, s.FailedRuns,
+			s.StartedAt.Format(time.RFC3339), s.FinishedAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "Finished: %s\n", s.FinishedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Duration: %s\n", s.Duration)
+
+	if len(s.Failures) > 0 {
+		fmt.Fprintln(&b, "Failures:")
+		for i, failure := range s.Failures {
+			if i == maxFailures {
+				fmt.Fprintf(&b, "  ... and %d more\n", len(s.Failures)-maxFailures)
+				break
+			}
+			if failure.Repository == "" {
+				fmt.Fprintf(&b, "  - %s: %s\n", failure.Provider, failure.Error)
+			} else {
+				fmt.Fprintf(&b, "  - %s [%s]: %s\n", failure.Repository, failure.Provider, failure.Error)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Sender sends summaries to a service
+type Sender interface {
+	Send(ctx context.Context, s *Summary) error
+}
+
+// NewSender creates the sender of a notification
+func NewSender(cfg config.NotificationConfig) (Sender, error) {
+	switch cfg.Type {
+	case config.NotificationWebhook:
+		return &webhookSender{url: cfg.URL}, nil
+	case config.NotificationSlack:
+		return &slackSender{url: cfg.URL}, nil
+	case config.NotificationNtfy:
+		return &ntfySender{url: cfg.URL, token: cfg.Token}, nil
+	case config.NotificationGotify:
+		return &gotifySender{url: cfg.URL, token: cfg.Token}, nil
+	case config.NotificationEmail:
+		return newEmailSender(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported notification type: %s", cfg.Type)
+	}
+}
+
+// target is a configured notification
+type target struct {
+	name          string
+	sender        Sender
+	onFailureOnly bool
+	// digest is the schedule of the digests, nil when every run is notified
+	digest schedule.Schedule
+
+	mu sync.Mutex
+	// pending holds the reports of the runs since the last digest
+	pending []*report.Report
+}
+
+// Notifier sends the summaries of the runs to the configured notifications
+type Notifier struct {
+	targets []*target
+}
+
+// New creates the notifier of the configured notifications
+func New(cfgs []config.NotificationConfig) (*Notifier, error) {
+	n := &Notifier{}
+	for _, cfg := range cfgs {
+		t := &target{name: cfg.Name, onFailureOnly: cfg.OnFailureOnly}
+		if t.name == "" {
+			t.name = string(cfg.Type)
+		}
+
+		sender, err := NewSender(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s notification: %w", t.name, err)
+		}
+		t.sender = sender
+
+		if cfg.Digest != "" {
+			if t.digest, err = schedule.Parse(cfg.Digest); err != nil {
+				return nil, fmt.Errorf("%s notification: %w", t.name, err)
+			}
+		}
+		n.targets = append(n.targets, t)
+	}
+	return n, nil
+}
+
+// Notify sends the summary of a finished run to the notifications without digest,
+// and queues it for the next digest of the others.
+// Failures to send notifications are logged.
+func (n *Notifier) Notify(r *report.Report) {
+	for _, t := range n.targets {
+		if t.digest != nil {
+			t.mu.Lock()
+			t.pending = append(t.pending, r)
+			t.mu.Unlock()
+			continue
+		}
+		t.send([]*report.Report{r})
+	}
+}
+
+// Flush sends the digests of the runs queued since the previous ones
+func (n *Notifier) Flush() {
+	for _, t := range n.targets {
+		if t.digest != nil {
+			t.flush()
+		}
+	}
+}
+
+// Run sends the digests on their schedules until ctx is cancelled.
+// The runs queued at that time are left for Flush.
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range n.targets {
+		if t.digest == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			for {
+				timer := time.NewTimer(time.Until(t.digest.Next(time.Now())))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+					t.flush()
+				}
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// flush sends the digest of the pending runs, if any
+func (t *target) flush() {
+	t.mu.Lock()
+	reports := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if len(reports) > 0 {
+		t.send(reports)
+	}
+}
+
+// send sends the summary of runs, unless they all succeeded and only failures are notified
+func (t *target) send(reports []*report.Report) {
+	s := Summarize(reports)
+	if s.Success && t.onFailureOnly {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := t.sender.Send(ctx, s); err != nil {
+		log.Printf("Failed to send the %s notification: %v", t.name, err)
+	}
+}
@@ -0,0 +1,482 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/report"
+)
+
+// testReport returns the report of a finished run, with a failed repository when failed is set
+func testReport(failed bool) *report.Report {
+	r := report.New("test")
+	provider := r.AddProvider("github", "github", "", "/backup")
+	provider.AddRepo(report.RepoReport{Name: "owner/repo1", Status: report.StatusUpdated})
+	if failed {
+		provider.AddRepo(report.RepoReport{Name: "owner/repo2", Status: report.StatusFailed, Error: "fetch failed"})
+	}
+	provider.Finish()
+	r.Finish()
+	return r
+}
+
+// request is a request received by a test server
+type request struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+// testServer starts an HTTP server recording the requests it receives
+func testServer(t *testing.T, status int) (*httptest.Server, func() []request) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, request{path: r.URL.Path, headers: r.Header, body: string(body)})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]request(nil), requests...)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := Summarize([]*report.Report{testReport(false)})
+	if !s.Success || s.Title != "git-repos-backup: backup succeeded" || len(s.Failures) != 0 {
+		t.Errorf("Summarize() = %+v, want a successful run", s)
+	}
+
+	s = Summarize([]*report.Report{testReport(true)})
+	if s.Success || s.Title != "git-repos-backup: backup failed (1 failure(s))" {
+		t.Errorf("Summarize() = %+v, want a failed run", s)
+	}
+	if !strings.Contains(s.Text(), "  - owner/repo2 [github]: fetch failed\n") {
+		t.Errorf("Text() should list the failed repository, got:\n%s", s.Text())
+	}
+
+	s = Summarize([]*report.Report{testReport(true), testReport(false), testReport(true)})
+	if s.Runs != 3 || s.FailedRuns != 2 || s.Counts[report.StatusUpdated] != 3 || len(s.Failures) != 2 {
+		t.Errorf("Summarize() = %+v, want the totals of 3 runs", s)
+	}
+	if s.Title != "git-repos-backup: 2 of 3 backup runs failed (2 failure(s))" {
+		t.Errorf("Summarize() title = %q", s.Title)
+	}
+	if !strings.HasPrefix(s.Text(), "Repositories: 0 new, 3 updated, 0 unchanged, 2 failed, 0 skipped\nRuns: 3 (2 failed), from ") {
+		t.Errorf("Text() = %q", s.Text())
+	}
+
+	// The failures listed in the text are limited
+	r := report.New("test")
+	provider := r.AddProvider("github", "github", "", "/backup")
+	for i := 0; i < maxFailures+5; i++ {
+		provider.AddRepo(report.RepoReport{Name: "owner/repo", Status: report.StatusFailed, Error: "fetch failed"})
+	}
+	r.Finish()
+	if text := Summarize([]*report.Report{r}).Text(); !strings.HasSuffix(text, "  ... and 5 more\n") {
+		t.Errorf("Text() should truncate the failures, got:\n%s", text)
+	}
+}
+
+func TestSenders(t *testing.T) {
+	summary := Summarize([]*report.Report{testReport(true)})
+
+	tests := []struct {
+		name        string
+		cfg         config.NotificationConfig
+		wantPath    string
+		wantHeaders map[string]string
+		wantBody    []string
+	}{
+		{
+			name:        "Webhook",
+			cfg:         config.NotificationConfig{Type: config.NotificationWebhook},
+			wantPath:    "/hook",
+			wantHeaders: map[string]string{"Content-Type": "application/json"},
+			wantBody:    []string{`"success":false`, `"failed_runs":1`, `"repository":"owner/repo2"`, `"text":"Repositories: `},
+		},
+		{
+			name:     "Slack",
+			cfg:      config.NotificationConfig{Type: config.NotificationSlack},
+			wantPath: "/hook",
+			wantBody: []string{`{"text":"git-repos-backup: backup failed (1 failure(s))\n` + "```"},
+		},
+		{
+			name:        "Ntfy",
+			cfg:         config.NotificationConfig{Type: config.NotificationNtfy, Token: "tk_secret"},
+			wantPath:    "/hook",
+			wantHeaders: map[string]string{"Title": summary.Title, "Priority": "high", "Authorization": "Bearer tk_secret"},
+			wantBody:    []string{"owner/repo2 [github]: fetch failed"},
+		},
+		{
+			name:        "Gotify",
+			cfg:         config.NotificationConfig{Type: config.NotificationGotify, Token: "app_token"},
+			wantPath:    "/hook/message",
+			wantHeaders: map[string]string{"X-Gotify-Key": "app_token"},
+			wantBody:    []string{`"priority":8`, `"title":"git-repos-backup: backup failed (1 failure(s))"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := testServer(t, http.StatusOK)
+			tt.cfg.URL = server.URL + "/hook"
+			sender, err := NewSender(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewSender() error = %v", err)
+			}
+			if err := sender.Send(context.Background(), summary); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			got := requests()
+			if len(got) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(got))
+			}
+			if got[0].path != tt.wantPath {
+				t.Errorf("Request path = %s, want %s", got[0].path, tt.wantPath)
+			}
+			for name, want := range tt.wantHeaders {
+				if value := got[0].headers.Get(name); value != want {
+					t.Errorf("Header %s = %q, want %q", name, value, want)
+				}
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(got[0].body, want) {
+					t.Errorf("Request body should contain %q, got %s", want, got[0].body)
+				}
+			}
+			if tt.cfg.Type == config.NotificationWebhook && !json.Valid([]byte(got[0].body)) {
+				t.Errorf("Request body is not valid JSON: %s", got[0].body)
+			}
+		})
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	summary := Summarize([]*report.Report{testReport(false)})
+
+	server, _ := testServer(t, http.StatusForbidden)
+	sender, _ := NewSender(config.NotificationConfig{Type: config.NotificationSlack, URL: server.URL + "/services/secret"})
+	err := sender.Send(context.Background(), summary)
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Errorf("Send() error = %v, want the response status", err)
+	}
+
+	// The webhook URLs are not included in the errors, as they contain credentials
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	sender, _ = NewSender(config.NotificationConfig{Type: config.NotificationWebhook, URL: "http://" + addr + "/hooks/secret"})
+	err = sender.Send(context.Background(), summary)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Send() error = %v, want an error without the URL", err)
+	}
+}
+
+// smtpServer is a minimal SMTP server recording the messages it receives
+type smtpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+// startSMTPServer starts an SMTP server on a local port, accepting only TLS connections when tlsConfig is set
+func startSMTPServer(t *testing.T, tlsConfig *tls.Config) *smtpServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	s := &smtpServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve handles an SMTP session
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+
+		switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL", "RCPT":
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestEmailSender(t *testing.T) {
+	server := startSMTPServer(t, nil)
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	smtpPort, _ := strconv.Atoi(port)
+
+	sender, err := NewSender(config.NotificationConfig{
+		Type:     config.NotificationEmail,
+		SMTPHost: host,
+		SMTPPort: smtpPort,
+		Username: "backup",
+		Password: "smtp_password",
+		From:     "Backups <backup@example.com>",
+		To:       []string{"ops@example.com", "Admin <admin@example.com>"},
+	})
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+	if err := sender.Send(context.Background(), Summarize([]*report.Report{testReport(true)})); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	commands := strings.Join(server.commands, "\n")
+	for _, want := range []string{"AUTH PLAIN ", "MAIL FROM:<backup@example.com>", "RCPT TO:<ops@example.com>", "RCPT TO:<admin@example.com>"} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("SMTP commands should contain %q, got:\n%s", want, commands)
+		}
+	}
+	if len(server.messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(server.messages))
+	}
+	for _, want := range []string{
+		"From: Backups <backup@example.com>\r\n",
+		"To: ops@example.com, Admin <admin@example.com>\r\n",
+		"Subject: git-repos-backup: backup failed (1 failure(s))\r\n",
+		"  - owner/repo2 [github]: fetch failed\r\n",
+	} {
+		if !strings.Contains(server.messages[0], want) {
+			t.Errorf("Message should contain %q, got:\n%s", want, server.messages[0])
+		}
+	}
+}
+
+func TestEmailSenderImplicitTLS(t *testing.T) {
+	// The certificate of the test TLS server is valid for 127.0.0.1
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+
+	server := startSMTPServer(t, &tls.Config{Certificates: tlsServer.TLS.Certificates})
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	smtpPort, _ := strconv.Atoi(port)
+
+	sender, err := NewSender(config.NotificationConfig{
+		Type:     config.NotificationEmail,
+		SMTPHost: host,
+		SMTPPort: smtpPort,
+		SMTPTLS:  config.SMTPTLSImplicit,
+		Username: "backup",
+		Password: "smtp_password",
+		From:     "backup@example.com",
+		To:       []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+	sender.(*emailSender).rootCAs = roots
+	if err := sender.Send(context.Background(), Summarize([]*report.Report{testReport(true)})); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(server.messages))
+	}
+}
+
+func TestEmailSenderTLSMode(t *testing.T) {
+	tests := []struct {
+		port         int
+		tlsMode      string
+		wantAddr     string
+		wantImplicit bool
+	}{
+		{wantAddr: "smtp.example.com:587"},
+		{port: 465, wantAddr: "smtp.example.com:465", wantImplicit: true},
+		{tlsMode: config.SMTPTLSImplicit, wantAddr: "smtp.example.com:465", wantImplicit: true},
+		{port: 2465, tlsMode: config.SMTPTLSImplicit, wantAddr: "smtp.example.com:2465", wantImplicit: true},
+		{port: 465, tlsMode: config.SMTPTLSStartTLS, wantAddr: "smtp.example.com:465"},
+	}
+
+	for _, tt := range tests {
+		s := newEmailSender(config.NotificationConfig{SMTPHost: "smtp.example.com", SMTPPort: tt.port, SMTPTLS: tt.tlsMode})
+		if s.addr != tt.wantAddr || s.implicitTLS != tt.wantImplicit {
+			t.Errorf("newEmailSender(%d, %q) = %s (implicit TLS %v), want %s (implicit TLS %v)",
+				tt.port, tt.tlsMode, s.addr, s.implicitTLS, tt.wantAddr, tt.wantImplicit)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	every, digest, failures := newRecorder(), newRecorder(), newRecorder()
+	notifier, err := New([]config.NotificationConfig{
+		{Type: config.NotificationWebhook, URL: every.server.URL},
+		{Type: config.NotificationWebhook, URL: digest.server.URL, Digest: "@every 1h"},
+		{Type: config.NotificationWebhook, URL: failures.server.URL, OnFailureOnly: true},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer every.server.Close()
+	defer digest.server.Close()
+	defer failures.server.Close()
+
+	notifier.Notify(testReport(false))
+	notifier.Notify(testReport(true))
+	notifier.Notify(testReport(false))
+
+	if got := every.runs(); len(got) != 3 {
+		t.Errorf("Expected a notification per run, got %v", got)
+	}
+	if got := failures.runs(); len(got) != 1 || got[0].Success {
+		t.Errorf("Expected a notification of the failed run only, got %v", got)
+	}
+	if got := digest.runs(); len(got) != 0 {
+		t.Errorf("Expected the digest to be pending, got %v", got)
+	}
+
+	notifier.Flush()
+	if got := digest.runs(); len(got) != 1 || got[0].Runs != 3 || got[0].FailedRuns != 1 {
+		t.Errorf("Expected a digest of the 3 runs, got %v", got)
+	}
+
+	// Digests are only sent when runs are pending
+	notifier.Flush()
+	if got := digest.runs(); len(got) != 1 {
+		t.Errorf("Expected no digest without runs, got %v", got)
+	}
+}
+
+func TestNotifierRun(t *testing.T) {
+	digest := newRecorder()
+	defer digest.server.Close()
+	notifier, err := New([]config.NotificationConfig{{Type: config.NotificationWebhook, URL: digest.server.URL, Digest: "@every 1s"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		notifier.Run(ctx)
+		close(done)
+	}()
+
+	notifier.Notify(testReport(true))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(digest.runs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if got := digest.runs(); len(got) != 1 || got[0].Runs != 1 {
+		t.Errorf("Expected a scheduled digest, got %v", got)
+	}
+}
+
+// recorder is a webhook recording the summaries it receives
+type recorder struct {
+	server    *httptest.Server
+	mu        sync.Mutex
+	summaries []Summary
+}
+
+// newRecorder starts a webhook recording the summaries
+func newRecorder() *recorder {
+	r := &recorder{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var s Summary
+		json.NewDecoder(req.Body).Decode(&s)
+		r.mu.Lock()
+		r.summaries = append(r.summaries, s)
+		r.mu.Unlock()
+	}))
+	return r
+}
+
+// runs returns the summaries received
+func (r *recorder) runs() []Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Summary(nil), r.summaries...)
+}
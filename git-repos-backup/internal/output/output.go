@@ -0,0 +1,82 @@
+// Package output provides helpers to keep the output of concurrent operations readable
+// and free of secrets
+package output
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// writeMu serializes the lines written by all the prefix writers,
+// so lines of concurrent operations are never interleaved
+var writeMu sync.Mutex
+
+// PrefixWriter is an io.Writer that prefixes every line written to it.
+// Only complete lines are written to the underlying writer, each with a single Write call.
+type PrefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// NewPrefixWriter creates a writer prefixing every line written to w with prefix
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{
+		w:      w,
+		prefix: []byte(prefix),
+	}
+}
+
+// Write buffers p and writes all its complete lines to the underlying writer.
+// Carriage returns (used by git for progress updates) are treated as line endings.
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := p.buf[:i]
+		p.buf = p.buf[i+1:]
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := p.writeLine(line); err != nil {
+			return len(b), err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush writes any buffered incomplete line to the underlying writer
+func (p *PrefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(bytes.TrimSpace(p.buf)) == 0 {
+		p.buf = nil
+		return nil
+	}
+	line := p.buf
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+// writeLine writes a single prefixed line to the underlying writer
+func (p *PrefixWriter) writeLine(line []byte) error {
+	out := make([]byte, 0, len(p.prefix)+len(line)+1)
+	out = append(out, p.prefix...)
+	out = append(out, line...)
+	out = append(out, '\n')
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	_, err := p.w.Write(out)
+	return err
+}
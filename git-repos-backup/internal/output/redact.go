@@ -0,0 +1,97 @@
+package output
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces the secrets in redacted output
+const Mask = "********"
+
+// minSecretLength is the length below which values are not registered as secrets,
+// as masking them would garble unrelated output
+const minSecretLength = 4
+
+var (
+	secretsMu sync.RWMutex
+	// secrets holds the registered secrets, longest first
+	secrets []string
+
+	// urlUserinfoRegex matches the userinfo of HTTP(S) URLs: the user and the optional password
+	urlUserinfoRegex = regexp.MustCompile(`(?i)(https?://)([^/@\s:]*)(:[^/@\s]*)?@`)
+)
+
+// Stdout and Stderr are the redacting writers all the output of the tool goes through
+var (
+	Stdout io.Writer = NewRedactWriter(stdWriter(func() *os.File { return os.Stdout }))
+	Stderr io.Writer = NewRedactWriter(stdWriter(func() *os.File { return os.Stderr }))
+)
+
+// stdWriter writes to the current os.Stdout or os.Stderr, which can be replaced (e.g. in tests)
+type stdWriter func() *os.File
+
+// Write implements io.Writer
+func (f stdWriter) Write(p []byte) (int, error) {
+	return f().Write(p)
+}
+
+// RegisterSecret registers a value (access token, password) to be masked in all redacted output
+func RegisterSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	// Mask the longest secrets first, in case a secret contains another one
+	sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact masks the registered secrets and the URL credentials in s.
+// For URLs, the password is masked and the user kept (`user:********@`),
+// unless there is no password, in which case the user is masked, as it is usually a token.
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	secretsMu.RUnlock()
+
+	return urlUserinfoRegex.ReplaceAllStringFunc(s, func(userinfo string) string {
+		parts := urlUserinfoRegex.FindStringSubmatch(userinfo)
+		if parts[3] != "" {
+			return parts[1] + parts[2] + ":" + Mask + "@"
+		}
+		return parts[1] + Mask + "@"
+	})
+}
+
+// RedactWriter is an io.Writer that masks secrets before writing to the underlying writer.
+// Secrets are only masked within a single Write call, so it is meant to be written whole lines
+// (as the log package and PrefixWriter do).
+type RedactWriter struct {
+	w io.Writer
+}
+
+// NewRedactWriter creates a writer masking secrets before writing to w
+func NewRedactWriter(w io.Writer) *RedactWriter {
+	return &RedactWriter{w: w}
+}
+
+// Write redacts p and writes it to the underlying writer
+func (r *RedactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,302 @@
+// Package report provides the summary report of a backup run
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
+)
+
+// Status is the outcome of a repository backup
+type Status string
+
+const (
+	// StatusNew is reported for repositories backed up for the first time
+	StatusNew Status = "new"
+	// StatusUpdated is reported for repositories with changed refs
+	StatusUpdated Status = "updated"
+	// StatusUnchanged is reported for repositories without any changes
+	StatusUnchanged Status = "unchanged"
+	// StatusFailed is reported for repositories that could not be backed up
+	StatusFailed Status = "failed"
+	// StatusSkipped is reported for repositories excluded by filters, and for wikis that do not exist
+	StatusSkipped Status = "skipped"
+)
+
+// Statuses lists all the statuses in display order
+var Statuses = []Status{StatusNew, StatusUpdated, StatusUnchanged, StatusFailed, StatusSkipped}
+
+// maxTableErrorLength is the maximum length of the errors displayed in the table
+const maxTableErrorLength = 60
+
+// Duration is a time.Duration marshaled to JSON as a number of seconds
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(time.Duration(d).Seconds(), 'f', 3, 64)), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	seconds, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %w", err)
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// String returns the duration rounded for display
+func (d Duration) String() string {
+	return time.Duration(d).Round(time.Millisecond).String()
+}
+
+// RepoReport describes the backup of a single repository
+type RepoReport struct {
+	Name             string   `json:"name"`
+	Status           Status   `json:"status"`
+	Duration         Duration `json:"duration_seconds"`
+	BytesTransferred int64    `json:"bytes_transferred"`
+	RefsChanged      int      `json:"refs_changed"`
+	// LFS describes the LFS objects of the repository, when they are backed up
+	LFS   *LFSReport `json:"lfs,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// LFSReport describes the LFS objects of a repository backup
+type LFSReport struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// Missing is the number of objects missing on the server, which do not fail the backup
+	Missing int `json:"missing"`
+}
+
+// String returns the LFS objects for display
+func (l *LFSReport) String() string {
+	if l.Missing > 0 {
+		return fmt.Sprintf("%d (%s), %d missing", l.Objects, FormatBytes(l.Bytes), l.Missing)
+	}
+	return fmt.Sprintf("%d (%s)", l.Objects, FormatBytes(l.Bytes))
+}
+
+// ProviderReport describes the backup of all the repositories of a provider
+type ProviderReport struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	ServerURL string         `json:"server_url,omitempty"`
+	TargetDir string         `json:"target_dir"`
+	Duration  Duration       `json:"duration_seconds"`
+	Counts    map[Status]int `json:"counts"`
+	// Error is set when the provider failed as a whole (e.g. its repositories could not be listed)
+	Error string       `json:"error,omitempty"`
+	Repos []RepoReport `json:"repositories"`
+
+	startedAt time.Time
+}
+
+// Report describes a backup run
+type Report struct {
+	Version    string            `json:"version"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Duration   Duration          `json:"duration_seconds"`
+	Success    bool              `json:"success"`
+	Counts     map[Status]int    `json:"counts"`
+	Providers  []*ProviderReport `json:"providers"`
+}
+
+// New creates the report of a run starting now
+func New(version string) *Report {
+	return &Report{
+		Version:   version,
+		StartedAt: time.Now(),
+		Counts:    map[Status]int{},
+		Providers: []*ProviderReport{},
+	}
+}
+
+// AddProvider adds a provider to the report and starts timing it
+func (r *Report) AddProvider(name string, providerType string, serverURL string, targetDir string) *ProviderReport {
+	provider := &ProviderReport{
+		Name:      name,
+		Type:      providerType,
+		ServerURL: output.Redact(serverURL),
+		TargetDir: targetDir,
+		Counts:    map[Status]int{},
+		Repos:     []RepoReport{},
+		startedAt: time.Now(),
+	}
+	r.Providers = append(r.Providers, provider)
+	return provider
+}
+
+// AddRepo adds the outcome of a repository backup
+func (p *ProviderReport) AddRepo(repo RepoReport) {
+	repo.Error = output.Redact(repo.Error)
+	p.Repos = append(p.Repos, repo)
+	p.Counts[repo.Status]++
+}
+
+// Fail marks the whole provider as failed
+func (p *ProviderReport) Fail(err error) {
+	p.Error = output.Redact(err.Error())
+}
+
+// Finish stops timing the provider
+func (p *ProviderReport) Finish() {
+	p.Duration = Duration(time.Since(p.startedAt))
+}
+
+// Failed reports whether the provider or any of its repositories failed
+func (p *ProviderReport) Failed() bool {
+	return p.Error != "" || p.Counts[StatusFailed] > 0
+}
+
+// Finish stops timing the run and computes its totals
+func (r *Report) Finish() {
+	r.FinishedAt = time.Now()
+	r.Duration = Duration(r.FinishedAt.Sub(r.StartedAt))
+	r.Counts = map[Status]int{}
+	r.Success = true
+	for _, provider := range r.Providers {
+		for status, count := range provider.Counts {
+			r.Counts[status] += count
+		}
+		if provider.Failed() {
+			r.Success = false
+		}
+	}
+}
+
+// FailureCount returns the number of failed providers and repositories
+func (r *Report) FailureCount() int {
+	count := 0
+	for _, provider := range r.Providers {
+		if provider.Error != "" {
+			count++
+		}
+		count += provider.Counts[StatusFailed]
+	}
+	return count
+}
+
+// WriteTable writes the report as a human readable table, followed by the list of failures.
+// The LFS column is only written when LFS objects were backed up.
+func (r *Report) WriteTable(w io.Writer) {
+	hasLFS := false
+	for _, provider := range r.Providers {
+		for _, repo := range provider.Repos {
+			hasLFS = hasLFS || repo.LFS != nil
+		}
+	}
+	lfsColumn := func(value string) string {
+		if !hasLFS {
+			return ""
+		}
+		return value + "\t"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PROVIDER\tREPOSITORY\tSTATUS\tDURATION\tTRANSFERRED\tREFS\t%sERROR\n", lfsColumn("LFS"))
+	for _, provider := range r.Providers {
+		if provider.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t%s\t%s\t-\t-\t%s%s\n",
+				provider.Name, StatusFailed, provider.Duration, lfsColumn("-"), truncate(provider.Error, maxTableErrorLength))
+		}
+		for _, repo := range provider.Repos {
+			if repo.Status == StatusSkipped {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t%s\n", provider.Name, repo.Name, repo.Status, lfsColumn("-"))
+				continue
+			}
+			lfs := "-"
+			if repo.LFS != nil {
+				lfs = repo.LFS.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s%s\n",
+				provider.Name, repo.Name, repo.Status, repo.Duration, FormatBytes(repo.BytesTransferred),
+				repo.RefsChanged, lfsColumn(lfs), truncate(repo.Error, maxTableErrorLength))
+		}
+	}
+	tw.Flush()
+
+	counts := make([]string, 0, len(Statuses))
+	for _, status := range Statuses {
+		counts = append(counts, fmt.Sprintf("%d %s", r.Counts[status], status))
+	}
+	fmt.Fprintf(w, "\nBackup summary: %s (duration: %s)\n", strings.Join(counts, ", "), r.Duration)
+
+	var failedProviders, failedRepos, missingLFS []string
+	for _, provider := range r.Providers {
+		if provider.Error != "" {
+			failedProviders = append(failedProviders, fmt.Sprintf("  - %s: %s", provider.Name, provider.Error))
+		}
+		for _, repo := range provider.Repos {
+			if repo.Status == StatusFailed {
+				failedRepos = append(failedRepos, fmt.Sprintf("  - %s [%s]: %s", repo.Name, provider.Name, repo.Error))
+			}
+			if repo.LFS != nil && repo.LFS.Missing > 0 {
+				missingLFS = append(missingLFS, fmt.Sprintf("  - %s [%s]: %d object(s) missing on the server",
+					repo.Name, provider.Name, repo.LFS.Missing))
+			}
+		}
+	}
+
+	if len(failedProviders) > 0 {
+		fmt.Fprintln(w, "Failed providers:")
+		fmt.Fprintln(w, strings.Join(failedProviders, "\n"))
+	}
+	if len(failedRepos) > 0 {
+		fmt.Fprintln(w, "Failed repositories:")
+		fmt.Fprintln(w, strings.Join(failedRepos, "\n"))
+	}
+	if len(missingLFS) > 0 {
+		fmt.Fprintln(w, "Missing LFS objects:")
+		fmt.Fprintln(w, strings.Join(missingLFS, "\n"))
+	}
+}
+
+// WriteJSON writes the report as JSON to the specified file.
+// The file is replaced atomically, so readers never see a partial report.
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	if err := fileutil.WriteAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write report file: %w", err)
+	}
+
+	return nil
+}
+
+// FormatBytes formats a number of bytes using binary units
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// truncate shortens a single line version of s to at most max characters
+func truncate(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
@@ -0,0 +1,165 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestReport creates a report with a failed provider and a provider with all the statuses
+func newTestReport() *Report {
+	r := New("1.2.3")
+
+	gitea := r.AddProvider("gitea (https://gitea.example.com)", "gitea", "https://gitea.example.com", "/backups/gitea")
+	gitea.Fail(errors.New("GET https://gitea.example.com/api/v1/repos/search: 401 Unauthorized"))
+	gitea.Finish()
+
+	github := r.AddProvider("github", "github", "", "/backups/github")
+	github.AddRepo(RepoReport{Name: "owner/new", Status: StatusNew, Duration: Duration(2 * time.Second), BytesTransferred: 3 * 1024 * 1024, RefsChanged: 4})
+	github.AddRepo(RepoReport{Name: "owner/updated", Status: StatusUpdated, Duration: Duration(time.Second), BytesTransferred: 2048, RefsChanged: 1,
+		LFS: &LFSReport{Objects: 12, Bytes: 3584 * 1024, Missing: 2}})
+	github.AddRepo(RepoReport{Name: "owner/unchanged", Status: StatusUnchanged, Duration: Duration(500 * time.Millisecond)})
+	github.AddRepo(RepoReport{Name: "owner/broken", Status: StatusFailed, Error: "failed to fetch repository: git fetch: exit status 128: fatal: repository not found"})
+	github.AddRepo(RepoReport{Name: "owner/other", Status: StatusSkipped})
+	github.Finish()
+
+	r.Finish()
+	return r
+}
+
+func TestReportTotals(t *testing.T) {
+	r := newTestReport()
+
+	if r.Success {
+		t.Error("Expected report with failures not to be successful")
+	}
+	if r.FailureCount() != 2 {
+		t.Errorf("Expected 2 failures, got %d", r.FailureCount())
+	}
+	for _, status := range Statuses {
+		if r.Counts[status] != 1 {
+			t.Errorf("Expected 1 repository with status %s, got %d", status, r.Counts[status])
+		}
+	}
+
+	// A run without failures is successful
+	ok := New("1.2.3")
+	provider := ok.AddProvider("github", "github", "", "/backups")
+	provider.AddRepo(RepoReport{Name: "owner/repo", Status: StatusUnchanged})
+	provider.Finish()
+	ok.Finish()
+	if !ok.Success || ok.FailureCount() != 0 {
+		t.Errorf("Expected successful report, got success=%v failures=%d", ok.Success, ok.FailureCount())
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	newTestReport().WriteTable(&buf)
+	output := buf.String()
+
+	expected := []string{
+		"PROVIDER",
+		"owner/new",
+		"3.0 MiB",
+		"Backup summary: 1 new, 1 updated, 1 unchanged, 1 failed, 1 skipped",
+		"Failed providers:",
+		"  - gitea (https://gitea.example.com): GET https://gitea.example.com/api/v1/repos/search: 401 Unauthorized",
+		"Failed repositories:",
+		"  - owner/broken [github]: failed to fetch repository: git fetch: exit status 128: fatal: repository not found",
+		"LFS",
+		"12 (3.5 MiB), 2 missing",
+		"Missing LFS objects:",
+		"  - owner/updated [github]: 2 object(s) missing on the server",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Table should contain %q, got:\n%s", line, output)
+		}
+	}
+
+	// The LFS column is only written when LFS objects were backed up
+	r := New("1.2.3")
+	provider := r.AddProvider("github", "github", "", "/backups/github")
+	provider.AddRepo(RepoReport{Name: "owner/repo", Status: StatusUnchanged})
+	provider.Finish()
+	r.Finish()
+	buf.Reset()
+	r.WriteTable(&buf)
+	if strings.Contains(buf.String(), "LFS") {
+		t.Errorf("Table should not contain an LFS column, got:\n%s", buf.String())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	r := newTestReport()
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	if err := r.WriteJSON(path); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+
+	// Check the raw JSON field names used by monitoring
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	for _, key := range []string{"version", "started_at", "finished_at", "duration_seconds", "success", "counts", "providers"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("Expected key %q in JSON report", key)
+		}
+	}
+
+	// Check the round trip
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(decoded.Providers) != 2 || len(decoded.Providers[1].Repos) != 5 {
+		t.Fatalf("Unexpected decoded report: %+v", decoded)
+	}
+	repo := decoded.Providers[1].Repos[0]
+	if repo.Status != StatusNew || repo.RefsChanged != 4 || repo.BytesTransferred != 3*1024*1024 || repo.Duration != Duration(2*time.Second) {
+		t.Errorf("Unexpected decoded repository: %+v", repo)
+	}
+	if lfs := decoded.Providers[1].Repos[1].LFS; lfs == nil || *lfs != (LFSReport{Objects: 12, Bytes: 3584 * 1024, Missing: 2}) {
+		t.Errorf("Unexpected decoded LFS objects: %+v", lfs)
+	}
+	if decoded.Counts[StatusFailed] != 1 {
+		t.Errorf("Expected 1 failed repository in counts, got %d", decoded.Counts[StatusFailed])
+	}
+
+	// Writing to a missing directory fails
+	if err := r.WriteJSON(filepath.Join(t.TempDir(), "missing", "report.json")); err == nil {
+		t.Error("Expected error for missing directory, got nil")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatBytes(tt.bytes); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %s, want %s", tt.bytes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/httpapi"
+)
+
+// MetadataVersion is the format version of the metadata files
+const MetadataVersion = 1
+
+// Metadata files, in the metadata directory of a repository
+const (
+	IssuesFile         = "issues.json"
+	PullRequestsFile   = "pull_requests.json"
+	CommentsFile       = "comments.json"
+	ReviewCommentsFile = "review_comments.json"
+	LabelsFile         = "labels.json"
+	MilestonesFile     = "milestones.json"
+)
+
+// metadataSinceOverlap is subtracted from the time of the previous export when exporting incrementally,
+// so clock differences with the provider never cause updates to be missed
+const metadataSinceOverlap = 5 * time.Minute
+
+// MetadataFile is the content of a metadata file
+type MetadataFile struct {
+	Version int `json:"version"`
+	// SyncedAt is the time of the export, used as the `since` time of the next one
+	SyncedAt time.Time `json:"synced_at"`
+	// Items holds the objects returned by the provider API, sorted by id
+	Items []json.RawMessage `json:"items"`
+}
+
+// MetadataResult holds the number of items exported, by kind
+type MetadataResult struct {
+	Issues         int
+	PullRequests   int
+	Comments       int
+	ReviewComments int
+	Labels         int
+	Milestones     int
+}
+
+// String returns the counts of the items exported
+func (r *MetadataResult) String() string {
+	return fmt.Sprintf("%d issue(s), %d pull request(s), %d comment(s), %d review comment(s), %d label(s), %d milestone(s)",
+		r.Issues, r.PullRequests, r.Comments, r.ReviewComments, r.Labels, r.Milestones)
+}
+
+// MetadataDir returns the directory the metadata of a repository is exported to, next to its bare repository
+func MetadataDir(repoDir string) string {
+	return repoDir + ".metadata"
+}
+
+// metadataItem holds the fields of the metadata items used by the export
+type metadataItem struct {
+	Id        int64     `json:"id"`
+	Number    int       `json:"number"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// PullRequest is set for the pull requests listed as issues
+	PullRequest  json.RawMessage `json:"pull_request"`
+	CommentCount int             `json:"comments_count"`
+}
+
+// metadataAPI lists the metadata of a repository through the Gitea or GitHub API
+type metadataAPI struct {
+	client *httpapi.Client
+	// repoURL is the API URL of the repository
+	repoURL string
+	gitea   bool
+}
+
+// ExportMetadata exports the issues, pull requests, comments, review comments, labels and milestones
+// of a Gitea or GitHub repository as JSON files in dir (see MetadataDir).
+// Issues, pull requests and comments are exported incrementally, updating the items changed since
+// the previous export; labels and milestones are replaced.
+func ExportMetadata(provider *config.ProviderConfig, repo Repository, dir string, verbose bool) (*MetadataResult, error) {
+	api, err := newMetadataAPI(provider, repo, verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	result := &MetadataResult{}
+	syncedAt := time.Now().UTC()
+
+	// Issues (pull requests are listed as issues too, they are exported from their own listing)
+	result.Issues, err = updateMetadataFile(dir, IssuesFile, syncedAt, func(since time.Time) ([]json.RawMessage, error) {
+		items, err := api.list("/issues", sinceQuery(url.Values{"state": {"all"}}, since), time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		issues := items[:0]
+		for _, item := range items {
+			var info metadataItem
+			if json.Unmarshal(item, &info) == nil && (len(info.PullRequest) == 0 || string(info.PullRequest) == "null") {
+				issues = append(issues, item)
+			}
+		}
+		return issues, nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export issues: %w", err)
+	}
+
+	result.PullRequests, err = updateMetadataFile(dir, PullRequestsFile, syncedAt, api.listPulls)
+	if err != nil {
+		return result, fmt.Errorf("failed to export pull requests: %w", err)
+	}
+
+	// Comments of both issues and pull requests
+	result.Comments, err = updateMetadataFile(dir, CommentsFile, syncedAt, func(since time.Time) ([]json.RawMessage, error) {
+		return api.list("/issues/comments", sinceQuery(url.Values{}, since), time.Time{})
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export comments: %w", err)
+	}
+
+	result.ReviewComments, err = updateMetadataFile(dir, ReviewCommentsFile, syncedAt, func(since time.Time) ([]json.RawMessage, error) {
+		if api.gitea {
+			// The pull requests are listed again, as the pull requests file may have been
+			// exported after the previous export of the review comments
+			pulls, err := api.listPulls(since)
+			if err != nil {
+				return nil, err
+			}
+			return api.listGiteaReviewComments(pulls, since)
+		}
+		return api.list("/pulls/comments", sinceQuery(url.Values{}, since), time.Time{})
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export review comments: %w", err)
+	}
+
+	result.Labels, err = replaceMetadataFile(dir, LabelsFile, syncedAt, func() ([]json.RawMessage, error) {
+		return api.list("/labels", url.Values{}, time.Time{})
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export labels: %w", err)
+	}
+
+	result.Milestones, err = replaceMetadataFile(dir, MilestonesFile, syncedAt, func() ([]json.RawMessage, error) {
+		return api.list("/milestones", url.Values{"state": {"all"}}, time.Time{})
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export milestones: %w", err)
+	}
+
+	return result, nil
+}
+
+// newMetadataAPI creates the client of the API of a Gitea or GitHub repository
+func newMetadataAPI(provider *config.ProviderConfig, repo Repository, verbose bool) (*metadataAPI, error) {
+	owner, name, ok := strings.Cut(repo.FullName, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid repository name: %s", repo.FullName)
+	}
+	repoPath := url.PathEscape(owner) + "/" + url.PathEscape(name)
+
+	api := &metadataAPI{}
+	var headers map[string]string
+	switch provider.Type {
+	case config.ProviderGitea:
+		api.gitea = true
+		api.repoURL = fmt.Sprintf("%s/api/v1/repos/%s", strings.TrimSuffix(provider.ServerURL, "/"), repoPath)
+		headers = giteaHeaders(provider)
+	case config.ProviderGitHub:
+		api.repoURL = fmt.Sprintf("%s/repos/%s", gitHubAPIURL(provider), repoPath)
+		headers = gitHubHeaders(provider)
+	default:
+		return nil, fmt.Errorf("metadata export is not supported by %s providers", provider.Type)
+	}
+
+	client, err := newAPIClient(provider, headers, verbose)
+	if err != nil {
+		return nil, err
+	}
+	api.client = client
+	return api, nil
+}
+
+// sinceQuery adds the `since` parameter to a query, unless since is zero
+func sinceQuery(query url.Values, since time.Time) url.Values {
+	if !since.IsZero() {
+		query.Set("since", since.UTC().Format(time.RFC3339))
+	}
+	return query
+}
+
+// list retrieves all the pages of a repository listing.
+// For listings sorted from the most recently updated item, a non-zero until stops the listing
+// at the first page ending with an item updated before it.
+func (a *metadataAPI) list(path string, query url.Values, until time.Time) ([]json.RawMessage, error) {
+	pageSize := gitHubPageSize
+	if a.gitea {
+		pageSize = giteaPageSize
+		query.Set("limit", fmt.Sprint(pageSize))
+		query.Set("page", "1")
+	} else {
+		query.Set("per_page", fmt.Sprint(pageSize))
+	}
+	apiURL := a.repoURL + path + "?" + query.Encode()
+
+	var items []json.RawMessage
+	for page := 1; apiURL != ""; page++ {
+		resp, err := a.client.Get(apiURL)
+		if err != nil {
+			// GitHub responds 410 Gone for the issues of repositories with issues disabled
+			var apiErr *httpapi.APIError
+			if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusGone {
+				return items, nil
+			}
+			return nil, err
+		}
+
+		var pageItems []json.RawMessage
+		if err := json.Unmarshal(resp.Body, &pageItems); err != nil {
+			return nil, fmt.Errorf("failed to parse API response (page %d): %w", page, err)
+		}
+		items = append(items, pageItems...)
+
+		if len(pageItems) > 0 && !until.IsZero() {
+			var last metadataItem
+			if json.Unmarshal(pageItems[len(pageItems)-1], &last) == nil && last.UpdatedAt.Before(until) {
+				break
+			}
+		}
+
+		// Gitea caps the page size at its MAX_RESPONSE_ITEMS setting, which may be below the requested limit,
+		// and does not send Link headers for all listings: the last page is found from the X-Total-Count
+		// header, or else the Link header, or else the first empty page
+		if a.gitea {
+			if len(pageItems) == 0 {
+				break
+			}
+			if total := headerInt(resp.Header, "X-Total-Count"); total >= 0 {
+				if len(items) >= total {
+					break
+				}
+			} else if len(resp.Header.Values("Link")) > 0 && nextPageURL(resp.Header) == "" {
+				break
+			}
+			query.Set("page", fmt.Sprint(page+1))
+			apiURL = a.repoURL + path + "?" + query.Encode()
+		} else {
+			apiURL = nextPageURL(resp.Header)
+		}
+	}
+	return items, nil
+}
+
+// listPulls retrieves the pull requests updated since a time (all of them when since is zero).
+// Pull requests cannot be filtered by update time: they are listed from the most recently updated.
+func (a *metadataAPI) listPulls(since time.Time) ([]json.RawMessage, error) {
+	query := url.Values{"state": {"all"}, "sort": {"updated"}, "direction": {"desc"}}
+	if a.gitea {
+		query = url.Values{"state": {"all"}, "sort": {"recentupdate"}}
+	}
+	return a.list("/pulls", query, since)
+}
+
+// listGiteaReviewComments retrieves the review comments of the pull requests updated since a time,
+// as Gitea only lists them by review
+func (a *metadataAPI) listGiteaReviewComments(pulls []json.RawMessage, since time.Time) ([]json.RawMessage, error) {
+	var comments []json.RawMessage
+	for _, pull := range pulls {
+		var info metadataItem
+		if err := json.Unmarshal(pull, &info); err != nil || info.UpdatedAt.Before(since) {
+			continue
+		}
+
+		reviews, err := a.list(fmt.Sprintf("/pulls/%d/reviews", info.Number), url.Values{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		for _, review := range reviews {
+			var reviewInfo metadataItem
+			if err := json.Unmarshal(review, &reviewInfo); err != nil || reviewInfo.CommentCount == 0 {
+				continue
+			}
+			resp, err := a.client.Get(fmt.Sprintf("%s/pulls/%d/reviews/%d/comments", a.repoURL, info.Number, reviewInfo.Id))
+			if err != nil {
+				return nil, err
+			}
+			var reviewComments []json.RawMessage
+			if err := json.Unmarshal(resp.Body, &reviewComments); err != nil {
+				return nil, fmt.Errorf("failed to parse API response: %w", err)
+			}
+			comments = append(comments, reviewComments...)
+		}
+	}
+	return comments, nil
+}
+
+// updateMetadataFile merges the items updated since the previous export into a metadata file.
+// Files missing, unreadable or of another format version are exported from scratch.
+// It returns the number of items retrieved.
+func updateMetadataFile(dir string, name string, syncedAt time.Time, fetch func(since time.Time) ([]json.RawMessage, error)) (int, error) {
+	path := filepath.Join(dir, name)
+	var since time.Time
+	var items []json.RawMessage
+	if previous, err := readMetadataFile(path); err == nil && previous.Version == MetadataVersion {
+		since = previous.SyncedAt.Add(-metadataSinceOverlap)
+		items = previous.Items
+	}
+
+	updated, err := fetch(since)
+	if err != nil {
+		return 0, err
+	}
+	items, err = mergeMetadataItems(items, updated)
+	if err != nil {
+		return 0, err
+	}
+	return len(updated), writeMetadataFile(path, &MetadataFile{Version: MetadataVersion, SyncedAt: syncedAt, Items: items})
+}
+
+// replaceMetadataFile replaces a metadata file with all the items of a listing.
+// It returns the number of items retrieved.
+func replaceMetadataFile(dir string, name string, syncedAt time.Time, fetch func() ([]json.RawMessage, error)) (int, error) {
+	items, err := fetch()
+	if err != nil {
+		return 0, err
+	}
+	items, err = mergeMetadataItems(nil, items)
+	if err != nil {
+		return 0, err
+	}
+	return len(items), writeMetadataFile(filepath.Join(dir, name), &MetadataFile{Version: MetadataVersion, SyncedAt: syncedAt, Items: items})
+}
+
+// mergeMetadataItems replaces the items with the updated items of the same id and adds the others,
+// sorting them by id
+func mergeMetadataItems(items []json.RawMessage, updated []json.RawMessage) ([]json.RawMessage, error) {
+	byID := make(map[int64]json.RawMessage, len(items)+len(updated))
+	for _, item := range append(items, updated...) {
+		var info metadataItem
+		if err := json.Unmarshal(item, &info); err != nil {
+			return nil, fmt.Errorf("failed to parse item: %w", err)
+		}
+		byID[info.Id] = item
+	}
+
+	ids := make([]int64, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	merged := make([]json.RawMessage, len(ids))
+	for i, id := range ids {
+		merged[i] = byID[id]
+	}
+	return merged, nil
+}
+
+// readMetadataFile reads a metadata file
+func readMetadataFile(path string) (*MetadataFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file MetadataFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// writeMetadataFile writes a metadata file.
+// The file is replaced atomically, so an interrupted export never leaves a partial file.
+func writeMetadataFile(path string, file *MetadataFile) error {
+	if file.Items == nil {
+		file.Items = []json.RawMessage{}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(path), err)
+	}
+
+	return fileutil.WriteAtomic(path, append(data, '\n'))
+}
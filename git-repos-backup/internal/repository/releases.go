@@ -0,0 +1,310 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
+)
+
+// ReleasesFile is the metadata file of the releases, in the metadata directory of a repository
+const ReleasesFile = "releases.json"
+
+// ReleasesDir is the directory of the release assets, in the metadata directory of a repository.
+// The assets of each release are downloaded into a subdirectory named after its tag.
+const ReleasesDir = "releases"
+
+// AssetDigestsFile records the verified SHA-256 checksum of the downloaded release assets, in the
+// metadata directory of a repository. It maps the asset path, relative to the releases directory, to
+// its `sha256:<hex>` digest.
+const AssetDigestsFile = "release-assets.json"
+
+// partialSuffix is the suffix of the assets being downloaded
+const partialSuffix = ".part"
+
+// ReleasesResult holds the outcome of a releases export
+type ReleasesResult struct {
+	Releases int
+	// Downloaded is the number of assets downloaded
+	Downloaded int
+	// Existing is the number of assets already on disk
+	Existing int
+	// TooLarge is the number of assets not downloaded because of the size limit
+	TooLarge        int
+	BytesDownloaded int64
+}
+
+// String returns the counts of the releases and assets
+func (r *ReleasesResult) String() string {
+	return fmt.Sprintf("%d release(s), %d asset(s) downloaded (%d bytes), %d already on disk, %d above the size limit",
+		r.Releases, r.Downloaded, r.BytesDownloaded, r.Existing, r.TooLarge)
+}
+
+// releaseInfo holds the fields of the releases used to download their assets
+type releaseInfo struct {
+	Id      int64          `json:"id"`
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+// releaseAsset is a file attached to a release
+type releaseAsset struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// URL is the API URL of the asset (GitHub), its content is downloaded with `Accept: application/octet-stream`
+	URL                string `json:"url"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	// Digest is the checksum of the asset as `<algorithm>:<hex>` (GitHub only, e.g. `sha256:...`)
+	Digest string `json:"digest"`
+}
+
+// ExportReleases exports the releases of a Gitea or GitHub repository to the releases file of dir
+// (see MetadataDir), and downloads their assets into its releases directory.
+// Assets already on disk are skipped, unless the checksum reported by the provider differs from the
+// one recorded in the asset digests file. Interrupted downloads are resumed, and downloaded assets are
+// checked against the size and checksum reported by the provider before being kept.
+// Assets larger than the provider max_asset_size are skipped.
+func ExportReleases(provider *config.ProviderConfig, repo Repository, dir string, verbose bool) (*ReleasesResult, error) {
+	api, err := newMetadataAPI(provider, repo, verbose)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	// Releases are replaced on every export: edited and deleted releases are not kept
+	var releases []json.RawMessage
+	result := &ReleasesResult{}
+	result.Releases, err = replaceMetadataFile(dir, ReleasesFile, time.Now().UTC(), func() ([]json.RawMessage, error) {
+		releases, err = api.list("/releases", url.Values{}, time.Time{})
+		return releases, err
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to export releases: %w", err)
+	}
+
+	// The digests of the assets no longer released are dropped
+	recorded := readAssetDigests(dir)
+	digests := map[string]string{}
+
+	// A failed download does not prevent the other assets from being downloaded
+	var failed []error
+	for _, item := range releases {
+		var release releaseInfo
+		if err := json.Unmarshal(item, &release); err != nil {
+			return result, fmt.Errorf("failed to parse release: %w", err)
+		}
+		tagDir := safeFileName(release.TagName, fmt.Sprintf("release-%d", release.Id))
+		releaseDir := filepath.Join(dir, ReleasesDir, tagDir)
+
+		for _, asset := range release.Assets {
+			name := safeFileName(asset.Name, fmt.Sprintf("asset-%d", asset.Id))
+			path := filepath.Join(releaseDir, name)
+			key := tagDir + "/" + name
+			if info, err := os.Stat(path); err == nil && info.Size() == asset.Size {
+				if existingAssetValid(path, asset, recorded[key]) {
+					if hasSHA256(asset) {
+						digests[key] = asset.Digest
+					}
+					result.Existing++
+					continue
+				}
+				if verbose {
+					fmt.Fprintf(output.Stdout, "----> Downloading release asset %s of %s again (checksum changed)\n",
+						asset.Name, repo.FullName)
+				}
+			}
+			if provider.MaxAssetSize > 0 && asset.Size > int64(provider.MaxAssetSize) {
+				if verbose {
+					fmt.Fprintf(output.Stdout, "----> Skipping release asset %s of %s (%d bytes, above the size limit)\n",
+						asset.Name, repo.FullName, asset.Size)
+				}
+				result.TooLarge++
+				continue
+			}
+
+			if err := os.MkdirAll(releaseDir, 0755); err != nil {
+				return result, fmt.Errorf("failed to create release directory: %w", err)
+			}
+			n, err := api.downloadAsset(asset, path)
+			result.BytesDownloaded += n
+			if err != nil {
+				failed = append(failed, fmt.Errorf("%s: %w", asset.Name, err))
+				continue
+			}
+			if hasSHA256(asset) {
+				digests[key] = asset.Digest
+			}
+			result.Downloaded++
+		}
+	}
+
+	if !maps.Equal(digests, recorded) {
+		if err := writeAssetDigests(dir, digests); err != nil {
+			return result, err
+		}
+	}
+	if len(failed) > 0 {
+		return result, fmt.Errorf("failed to download %d release asset(s): %w", len(failed), errors.Join(failed...))
+	}
+	return result, nil
+}
+
+// existingAssetValid reports whether an asset already on disk with the expected size is backed up.
+// Assets without a SHA-256 checksum (Gitea) are only checked by size. Otherwise the checksum must match
+// the recorded one, or the file itself when no checksum was recorded yet.
+func existingAssetValid(path string, asset releaseAsset, recordedDigest string) bool {
+	if !hasSHA256(asset) {
+		return true
+	}
+	if recordedDigest != "" {
+		return strings.EqualFold(recordedDigest, asset.Digest)
+	}
+	return verifyAsset(path, asset) == nil
+}
+
+// hasSHA256 reports whether the provider reported the SHA-256 checksum of the asset
+func hasSHA256(asset releaseAsset) bool {
+	algorithm, _, ok := strings.Cut(asset.Digest, ":")
+	return ok && algorithm == "sha256"
+}
+
+// readAssetDigests returns the asset digests recorded in dir. A missing or unreadable file records no
+// digest, so that the assets on disk are verified again.
+func readAssetDigests(dir string) map[string]string {
+	digests := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(dir, AssetDigestsFile))
+	if err != nil {
+		return digests
+	}
+	if err := json.Unmarshal(data, &digests); err != nil {
+		return map[string]string{}
+	}
+	return digests
+}
+
+// writeAssetDigests replaces the asset digests file of dir
+func writeAssetDigests(dir string, digests map[string]string) error {
+	data, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", AssetDigestsFile, err)
+	}
+	return fileutil.WriteAtomic(filepath.Join(dir, AssetDigestsFile), append(data, '\n'))
+}
+
+// safeFileName returns a name usable as a single path element, or fallback for empty names
+func safeFileName(name string, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return fallback
+	}
+	return name
+}
+
+// downloadAsset downloads a release asset to path, resuming the partial download left by a previous
+// export, if any. The asset is written to path only once its size and checksum were verified.
+// It returns the number of bytes received.
+func (a *metadataAPI) downloadAsset(asset releaseAsset, path string) (int64, error) {
+	// GitHub only serves the assets of private repositories through the API
+	assetURL := asset.BrowserDownloadURL
+	if !a.gitea && asset.URL != "" {
+		assetURL = asset.URL
+	}
+	req, err := http.NewRequest(http.MethodGet, assetURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+
+	partPath := path + partialSuffix
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 && info.Size() < asset.Size {
+		offset = info.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := a.client.Stream(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Servers ignoring the range send the whole asset
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	} else {
+		offset = 0
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", filepath.Base(partPath), err)
+	}
+	// Read one byte more than expected to detect assets larger than reported
+	n, err := io.Copy(file, io.LimitReader(resp.Body, asset.Size-offset+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// The partial download is kept, to be resumed by the next export
+		return n, fmt.Errorf("failed to download: %w", err)
+	}
+
+	if err := verifyAsset(partPath, asset); err != nil {
+		os.Remove(partPath)
+		return n, err
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return n, fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return n, nil
+}
+
+// verifyAsset checks a downloaded asset against the size and, when reported, the SHA-256 checksum of the asset
+func verifyAsset(path string, asset releaseAsset) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	if size != asset.Size {
+		return fmt.Errorf("size mismatch: received %d bytes, expected %d", size, asset.Size)
+	}
+
+	if !hasSHA256(asset) {
+		return nil
+	}
+	_, digest, _ := strings.Cut(asset.Digest, ":")
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, digest) {
+		return fmt.Errorf("checksum mismatch: got sha256:%s, expected %s", sum, asset.Digest)
+	}
+	return nil
+}
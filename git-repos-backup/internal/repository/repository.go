@@ -3,11 +3,16 @@ package repository
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/httpapi"
 )
 
 // Repository represents a Git repository
@@ -17,11 +22,41 @@ type Repository struct {
 	Name     string `json:"name"`
 	FullName string `json:"full_name"`
 	URL      string // Clone URL
+	SSHURL   string `json:"ssh_url"`
+
+	Fork     bool `json:"fork"`
+	Archived bool `json:"archived"`
+	// Private is set for all the repositories that are not publicly visible
+	// (including Gitea and GitLab internal repositories)
+	Private  bool `json:"private"`
+	Mirror   bool `json:"mirror"`
+	Template bool `json:"template"`
+	// HasWiki is set when the wiki of the repository is enabled (Gitea and GitHub only)
+	HasWiki bool `json:"has_wiki"`
+	// Size is the repository size in KiB, as reported by the provider (0 if unknown)
+	Size          int64  `json:"size"`
+	DefaultBranch string `json:"default_branch"`
+	// PushedAt is the time of the last push (last update for Gitea, last activity for GitLab)
+	PushedAt time.Time `json:"pushed_at"`
+	Topics   []string  `json:"topics"`
 }
 
-// ExecCommand is a variable that holds the exec.Command function.
-// It can be replaced in tests to mock command execution.
-var ExecCommand = exec.Command
+// ErrIncompleteListing is returned when a provider reports more repositories
+// than could be retrieved by walking all the result pages
+var ErrIncompleteListing = errors.New("repository listing is incomplete")
+
+const (
+	// giteaPageSize is the page size requested from Gitea (its default maximum)
+	giteaPageSize = 50
+	// gitHubPageSize is the page size requested from GitHub (its maximum)
+	gitHubPageSize = 100
+	// gitLabPageSize is the page size requested from GitLab (its maximum)
+	gitLabPageSize = 100
+)
+
+// NewClient is a variable that holds the function creating the API client.
+// It can be replaced in tests to hook into API requests and responses.
+var NewClient = httpapi.NewClient
 
 // GetRepositories retrieves repositories from a Git provider
 func GetRepositories(provider *config.ProviderConfig, verbose bool) ([]Repository, error) {
@@ -30,140 +65,374 @@ func GetRepositories(provider *config.ProviderConfig, verbose bool) ([]Repositor
 		return getGiteaRepositories(provider, verbose)
 	case config.ProviderGitHub:
 		return getGitHubRepositories(provider, verbose)
+	case config.ProviderGitLab:
+		return getGitLabRepositories(provider, verbose)
 	default:
 		return nil, fmt.Errorf("unsupported provider type: %s", provider.Type)
 	}
 }
 
-// getGiteaRepositories retrieves repositories from a Gitea server
-func getGiteaRepositories(provider *config.ProviderConfig, verbose bool) ([]Repository, error) {
-	// Construct API URL
-	apiURL := fmt.Sprintf("%s/api/v1/repos/search", provider.ServerURL)
-
-	// Prepare curl command
-	cmd := ExecCommand("curl", "-s")
-
-	if provider.SkipSslValidation {
-		cmd.Args = append(cmd.Args, "--insecure")
+// newAPIClient creates an API client sending the specified headers with every request
+func newAPIClient(provider *config.ProviderConfig, headers map[string]string, verbose bool) (*httpapi.Client, error) {
+	client, err := NewClient(provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API client: %w", err)
+	}
+	client.Verbose = verbose
+	for key, value := range headers {
+		client.Header.Set(key, value)
 	}
+	return client, nil
+}
 
-	cmd.Args = append(cmd.Args, "-X", "GET") // Add method
-	cmd.Args = append(cmd.Args, apiURL)      // Add API URL
-	cmd.Args = append(cmd.Args, "-H", "accept: application/json")
+// giteaHeaders returns the headers of the Gitea API requests
+func giteaHeaders(provider *config.ProviderConfig) map[string]string {
+	headers := map[string]string{"Accept": "application/json"}
+	if !provider.UseBasicAuth && provider.AccessToken != "" {
+		headers["Authorization"] = fmt.Sprintf("token %s", provider.AccessToken)
+	}
+	return headers
+}
 
-	// Add authentication
-	if provider.UseBasicAuth {
-		cmd.Args = append(cmd.Args, "-u", fmt.Sprintf("%s:%s", provider.Username, provider.Password))
-	} else if provider.AccessToken != "" {
-		cmd.Args = append(cmd.Args, "-H", fmt.Sprintf("Authorization: token %s", provider.AccessToken))
+// gitHubAPIURL returns the base URL of the GitHub API (v3)
+func gitHubAPIURL(provider *config.ProviderConfig) string {
+	if provider.ServerURL != "" && !strings.Contains(provider.ServerURL, "github.com") {
+		// For GitHub Enterprise
+		return fmt.Sprintf("%s/api/v3", provider.ServerURL)
 	}
+	return "https://api.github.com"
+}
 
-	if verbose {
-		fmt.Printf("----> %s\n", cmd.String())
+// gitHubHeaders returns the headers of the GitHub API requests
+func gitHubHeaders(provider *config.ProviderConfig) map[string]string {
+	headers := map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+	if !provider.UseBasicAuth && provider.AccessToken != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", provider.AccessToken)
 	}
+	return headers
+}
 
-	// Execute command
-	output, err := cmd.Output()
+// getGiteaRepositories retrieves repositories from a Gitea server.
+// All pages are requested until the number of repositories reported
+// through the X-Total-Count header is reached.
+func getGiteaRepositories(provider *config.ProviderConfig, verbose bool) ([]Repository, error) {
+	client, err := newAPIClient(provider, giteaHeaders(provider), verbose)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch repositories from Gitea: %w", err)
+		return nil, err
 	}
 
-	// Parse response
-	var response struct {
-		Data []struct {
-			Id       int    `json:"id"`
-			Name     string `json:"name"`
-			FullName string `json:"full_name"`
-			CloneURL string `json:"clone_url"`
-			Owner    struct {
-				Login string `json:"login"`
-			} `json:"owner"`
-		} `json:"data"`
-	}
+	var repos []Repository
+	seen := make(map[int]bool)
+	total := -1
+	for page := 1; ; page++ {
+		// Construct API URL
+		apiURL := fmt.Sprintf("%s/api/v1/repos/search?page=%d&limit=%d", provider.ServerURL, page, giteaPageSize)
 
-	if err := json.Unmarshal(output, &response); err != nil {
-		return nil, fmt.Errorf("failed to parse Gitea API response: %w", err)
+		resp, err := client.Get(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch repositories from Gitea (page %d): %w", page, err)
+		}
+
+		// Parse response
+		var response struct {
+			OK   *bool `json:"ok"`
+			Data []struct {
+				Id            int       `json:"id"`
+				Name          string    `json:"name"`
+				FullName      string    `json:"full_name"`
+				CloneURL      string    `json:"clone_url"`
+				SSHURL        string    `json:"ssh_url"`
+				Fork          bool      `json:"fork"`
+				Archived      bool      `json:"archived"`
+				Private       bool      `json:"private"`
+				Internal      bool      `json:"internal"`
+				Mirror        bool      `json:"mirror"`
+				Template      bool      `json:"template"`
+				HasWiki       bool      `json:"has_wiki"`
+				Size          int64     `json:"size"`
+				DefaultBranch string    `json:"default_branch"`
+				UpdatedAt     time.Time `json:"updated_at"`
+				Topics        []string  `json:"topics"`
+				Owner         struct {
+					Login string `json:"login"`
+				} `json:"owner"`
+			} `json:"data"`
+		}
+
+		if err := json.Unmarshal(resp.Body, &response); err != nil {
+			return nil, fmt.Errorf("failed to parse Gitea API response (page %d): %w", page, err)
+		}
+		if response.OK != nil && !*response.OK {
+			return nil, fmt.Errorf("Gitea API reported a failed search (page %d)", page)
+		}
+
+		if total < 0 {
+			total = headerInt(resp.Header, "X-Total-Count")
+		}
+
+		// Convert to common Repository structure
+		for _, r := range response.Data {
+			if seen[r.Id] {
+				continue
+			}
+			seen[r.Id] = true
+			repos = append(repos, Repository{
+				Id:            r.Id,
+				Login:         r.Owner.Login,
+				Name:          r.Name,
+				FullName:      r.FullName,
+				URL:           r.CloneURL,
+				SSHURL:        r.SSHURL,
+				Fork:          r.Fork,
+				Archived:      r.Archived,
+				Private:       r.Private || r.Internal,
+				Mirror:        r.Mirror,
+				Template:      r.Template,
+				HasWiki:       r.HasWiki,
+				Size:          r.Size,
+				DefaultBranch: r.DefaultBranch,
+				PushedAt:      r.UpdatedAt,
+				Topics:        r.Topics,
+			})
+		}
+
+		// Without a total count, the listing ends with the first empty page
+		if len(response.Data) == 0 || (total >= 0 && len(repos) >= total) {
+			break
+		}
 	}
 
-	// Convert to common Repository structure
-	repos := make([]Repository, 0, len(response.Data))
-	for _, r := range response.Data {
-		repos = append(repos, Repository{
-			Id:       r.Id,
-			Login:    r.Owner.Login,
-			Name:     r.Name,
-			FullName: r.FullName,
-			URL:      r.CloneURL,
-		})
+	if total >= 0 && len(repos) < total {
+		return nil, fmt.Errorf("%w: received %d of %d repositories from Gitea", ErrIncompleteListing, len(repos), total)
 	}
 
 	return repos, nil
 }
 
-// getGitHubRepositories retrieves repositories from GitHub
+// getGitHubRepositories retrieves repositories from GitHub.
+// All pages are requested by following the `Link: rel="next"` headers.
 func getGitHubRepositories(provider *config.ProviderConfig, verbose bool) ([]Repository, error) {
-	// Construct API URL (GitHub API v3)
-	apiURL := "https://api.github.com/user/repos"
-	if provider.ServerURL != "" && !strings.Contains(provider.ServerURL, "github.com") {
-		// For GitHub Enterprise
-		apiURL = fmt.Sprintf("%s/api/v3/user/repos", provider.ServerURL)
+	apiURL := fmt.Sprintf("%s/user/repos?per_page=%d", gitHubAPIURL(provider), gitHubPageSize)
+
+	client, err := newAPIClient(provider, gitHubHeaders(provider), verbose)
+	if err != nil {
+		return nil, err
 	}
 
-	// Prepare curl command
-	cmd := ExecCommand("curl", "-s")
+	var repos []Repository
+	seen := make(map[int]bool)
+	for page := 1; apiURL != ""; page++ {
+		resp, err := client.Get(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch repositories from GitHub (page %d): %w", page, err)
+		}
+
+		// Parse response
+		var response []struct {
+			Id            int       `json:"id"`
+			Name          string    `json:"name"`
+			FullName      string    `json:"full_name"`
+			CloneURL      string    `json:"clone_url"`
+			SSHURL        string    `json:"ssh_url"`
+			Fork          bool      `json:"fork"`
+			Archived      bool      `json:"archived"`
+			Private       bool      `json:"private"`
+			Visibility    string    `json:"visibility"`
+			MirrorURL     string    `json:"mirror_url"`
+			IsTemplate    bool      `json:"is_template"`
+			HasWiki       bool      `json:"has_wiki"`
+			Size          int64     `json:"size"`
+			DefaultBranch string    `json:"default_branch"`
+			PushedAt      time.Time `json:"pushed_at"`
+			Topics        []string  `json:"topics"`
+			Owner         struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		}
+
+		if err := json.Unmarshal(resp.Body, &response); err != nil {
+			return nil, fmt.Errorf("failed to parse GitHub API response (page %d): %w", page, err)
+		}
+
+		// Convert to common Repository structure
+		for _, r := range response {
+			if seen[r.Id] {
+				continue
+			}
+			seen[r.Id] = true
+			repos = append(repos, Repository{
+				Id:            r.Id,
+				Login:         r.Owner.Login,
+				Name:          r.Name,
+				FullName:      r.FullName,
+				URL:           r.CloneURL,
+				SSHURL:        r.SSHURL,
+				Fork:          r.Fork,
+				Archived:      r.Archived,
+				Private:       r.Private || r.Visibility == "internal",
+				Mirror:        r.MirrorURL != "",
+				Template:      r.IsTemplate,
+				HasWiki:       r.HasWiki,
+				Size:          r.Size,
+				DefaultBranch: r.DefaultBranch,
+				PushedAt:      r.PushedAt,
+				Topics:        r.Topics,
+			})
+		}
 
-	if provider.SkipSslValidation {
-		cmd.Args = append(cmd.Args, "--insecure")
+		apiURL = nextPageURL(resp.Header)
 	}
 
-	cmd.Args = append(cmd.Args, "-X", "GET") // Add method
-	cmd.Args = append(cmd.Args, apiURL)      // Add API URL
-	cmd.Args = append(cmd.Args, "-H", "accept: application/vnd.github+json")
-	cmd.Args = append(cmd.Args, "-H", "X-GitHub-Api-Version: 2022-11-28")
+	return repos, nil
+}
 
-	// Add authentication
-	if provider.UseBasicAuth {
-		cmd.Args = append(cmd.Args, "-u", fmt.Sprintf("%s:%s", provider.Username, provider.Password))
-	} else if provider.AccessToken != "" {
-		cmd.Args = append(cmd.Args, "-H", fmt.Sprintf("Authorization: Bearer %s", provider.AccessToken))
+// getGitLabRepositories retrieves projects from GitLab (gitlab.com or self-managed).
+// It lists all projects the user is a member of (owned projects included) and,
+// for every configured group, the group projects including its subgroups.
+func getGitLabRepositories(provider *config.ProviderConfig, verbose bool) ([]Repository, error) {
+	// Construct API URL (GitLab API v4)
+	baseURL := "https://gitlab.com"
+	if provider.ServerURL != "" {
+		baseURL = strings.TrimSuffix(provider.ServerURL, "/")
 	}
 
-	if verbose {
-		fmt.Printf("----> %s\n", cmd.String())
+	apiURLs := []string{fmt.Sprintf("%s/api/v4/projects?membership=true&per_page=%d", baseURL, gitLabPageSize)}
+	for _, group := range provider.Groups {
+		apiURLs = append(apiURLs, fmt.Sprintf("%s/api/v4/groups/%s/projects?include_subgroups=true&per_page=%d",
+			baseURL, url.PathEscape(group), gitLabPageSize))
 	}
 
-	// Execute command
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch repositories from GitHub: %w", err)
+	// Projects can be returned by more than one listing, so keep the first occurrence only
+	seen := make(map[int]bool)
+	var repos []Repository
+	for _, apiURL := range apiURLs {
+		projects, err := getGitLabProjects(provider, apiURL, verbose)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range projects {
+			if seen[p.Id] {
+				continue
+			}
+			seen[p.Id] = true
+			repos = append(repos, p)
+		}
 	}
 
-	// Parse response
-	var response []struct {
-		Id       int    `json:"id"`
-		Name     string `json:"name"`
-		FullName string `json:"full_name"`
-		CloneURL string `json:"clone_url"`
-		Owner    struct {
-			Login string `json:"login"`
-		} `json:"owner"`
+	return repos, nil
+}
+
+// getGitLabProjects retrieves all the pages of a single GitLab API listing
+// by following the `Link: rel="next"` headers
+func getGitLabProjects(provider *config.ProviderConfig, apiURL string, verbose bool) ([]Repository, error) {
+	headers := map[string]string{"Accept": "application/json"}
+	if !provider.UseBasicAuth && provider.AccessToken != "" {
+		headers["PRIVATE-TOKEN"] = provider.AccessToken
 	}
 
-	if err := json.Unmarshal(output, &response); err != nil {
-		return nil, fmt.Errorf("failed to parse GitHub API response: %w", err)
+	client, err := newAPIClient(provider, headers, verbose)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert to common Repository structure
-	repos := make([]Repository, 0, len(response))
-	for _, r := range response {
-		repos = append(repos, Repository{
-			Id:       r.Id,
-			Login:    r.Owner.Login,
-			Name:     r.Name,
-			FullName: r.FullName,
-			URL:      r.CloneURL,
-		})
+	var repos []Repository
+	total := -1
+	for page := 1; apiURL != ""; page++ {
+		resp, err := client.Get(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch projects from GitLab (page %d): %w", page, err)
+		}
+
+		// Parse response
+		var response []struct {
+			Id                int       `json:"id"`
+			Path              string    `json:"path"`
+			PathWithNamespace string    `json:"path_with_namespace"`
+			HttpURLToRepo     string    `json:"http_url_to_repo"`
+			SSHURLToRepo      string    `json:"ssh_url_to_repo"`
+			Archived          bool      `json:"archived"`
+			Visibility        string    `json:"visibility"`
+			Mirror            bool      `json:"mirror"`
+			DefaultBranch     string    `json:"default_branch"`
+			LastActivityAt    time.Time `json:"last_activity_at"`
+			Topics            []string  `json:"topics"`
+			ForkedFromProject *struct {
+				Id int `json:"id"`
+			} `json:"forked_from_project"`
+			Namespace struct {
+				FullPath string `json:"full_path"`
+			} `json:"namespace"`
+		}
+
+		if err := json.Unmarshal(resp.Body, &response); err != nil {
+			return nil, fmt.Errorf("failed to parse GitLab API response (page %d): %w", page, err)
+		}
+
+		// GitLab omits X-Total for very large listings
+		if total < 0 {
+			total = headerInt(resp.Header, "X-Total")
+		}
+
+		// Convert to common Repository structure
+		for _, r := range response {
+			// GitLab reports neither templates nor, without statistics access, the repository size
+			repos = append(repos, Repository{
+				Id:            r.Id,
+				Login:         r.Namespace.FullPath,
+				Name:          r.Path,
+				FullName:      r.PathWithNamespace,
+				URL:           r.HttpURLToRepo,
+				SSHURL:        r.SSHURLToRepo,
+				Fork:          r.ForkedFromProject != nil,
+				Archived:      r.Archived,
+				Private:       r.Visibility != "public",
+				Mirror:        r.Mirror,
+				DefaultBranch: r.DefaultBranch,
+				PushedAt:      r.LastActivityAt,
+				Topics:        r.Topics,
+			})
+		}
+
+		apiURL = nextPageURL(resp.Header)
+	}
+
+	if total >= 0 && len(repos) < total {
+		return nil, fmt.Errorf("%w: received %d of %d projects from GitLab", ErrIncompleteListing, len(repos), total)
 	}
 
 	return repos, nil
 }
+
+// headerInt returns the integer value of a response header, or -1 if it is missing or invalid
+func headerInt(header http.Header, key string) int {
+	value, err := strconv.Atoi(strings.TrimSpace(header.Get(key)))
+	if err != nil || value < 0 {
+		return -1
+	}
+	return value
+}
+
+// nextPageURL returns the `rel="next"` URL of a Link response header, or an empty string on the last page
+func nextPageURL(header http.Header) string {
+	for _, link := range header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			segments := strings.Split(part, ";")
+			if len(segments) < 2 {
+				continue
+			}
+			target := strings.TrimSpace(segments[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range segments[1:] {
+				if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+					return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+				}
+			}
+		}
+	}
+	return ""
+}
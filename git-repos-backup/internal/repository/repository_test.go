@@ -1,41 +1,292 @@
 package repository
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/httpapi"
 )
 
-// Mock for exec.Command
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
-	cs := []string{"-test.run=TestHelperProcess", "--", command}
-	cs = append(cs, args...)
-	cmd := exec.Command(os.Args[0], cs...)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+// Mock provider API serving Gitea, GitHub and GitLab listings
+func fakeProviderAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.URL.Path == "/api/v1/repos/search":
+		// Gitea: 3 repositories over 2 pages (5 reported by the "short" server)
+		total := "3"
+		if strings.HasPrefix(r.Host, "gitea-short") {
+			total = "5"
+		}
+		if strings.HasPrefix(r.Host, "gitea-denied") {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "token is required"}`)
+			return
+		}
+		w.Header().Set("X-Total-Count", total)
+		switch query.Get("page") {
+		case "1":
+			fmt.Fprint(w, `{"ok": true, "data": [
+				{"id": 1, "name": "repo1", "full_name": "owner/repo1", "clone_url": "https://gitea.example.com/owner/repo1.git", "owner": {"login": "owner"},
+				 "fork": true, "archived": true, "internal": true, "mirror": true, "template": true, "has_wiki": true, "size": 2048,
+				 "default_branch": "main", "updated_at": "2024-05-01T10:00:00Z", "topics": ["go", "backup"]},
+				{"id": 2, "name": "repo2", "full_name": "owner/repo2", "clone_url": "https://gitea.example.com/owner/repo2.git", "ssh_url": "git@gitea.example.com:owner/repo2.git", "owner": {"login": "owner"}}
+			]}`)
+		case "2":
+			if total == "3" {
+				fmt.Fprint(w, `{"ok": true, "data": [
+					{"id": 3, "name": "repo3", "full_name": "owner/repo3", "clone_url": "https://gitea.example.com/owner/repo3.git", "owner": {"login": "owner"}}
+				]}`)
+				return
+			}
+			fmt.Fprint(w, `{"ok": true, "data": []}`)
+		default:
+			fmt.Fprint(w, `{"ok": true, "data": []}`)
+		}
 
-	// Add environment variables to control mock behavior
-	if len(args) > 0 {
-		if strings.Contains(strings.Join(args, " "), "gitea") {
-			cmd.Env = append(cmd.Env, "MOCK_GITEA=1")
-		} else if strings.Contains(strings.Join(args, " "), "github") {
-			cmd.Env = append(cmd.Env, "MOCK_GITHUB=1")
+	case r.URL.Path == "/user/repos" || r.URL.Path == "/api/v3/user/repos":
+		// GitHub: 3 repositories over 2 pages
+		if query.Get("page") == "2" {
+			fmt.Fprint(w, `[
+				{"id": 3, "name": "repo3", "full_name": "owner/repo3", "clone_url": "https://github.com/owner/repo3.git", "owner": {"login": "owner"}}
+			]`)
+			return
 		}
+		next := fmt.Sprintf("https://%s%s?per_page=100&page=2", r.Host, r.URL.Path)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="last"`, next, next))
+		fmt.Fprint(w, `[
+			{"id": 1, "name": "repo1", "full_name": "owner/repo1", "clone_url": "https://github.com/owner/repo1.git", "owner": {"login": "owner"},
+			 "fork": true, "archived": true, "private": true, "mirror_url": "https://example.com/upstream.git", "is_template": true, "has_wiki": true,
+			 "size": 512, "default_branch": "develop", "pushed_at": "2024-05-01T10:00:00Z", "topics": ["go"]},
+			{"id": 2, "name": "repo2", "full_name": "owner/repo2", "clone_url": "https://github.com/owner/repo2.git", "owner": {"login": "owner"}}
+		]`)
+
+	case r.URL.Path == "/api/v4/projects" || strings.HasPrefix(r.URL.Path, "/api/v4/groups/"):
+		// GitLab: the same 2 projects for the membership and group listings
+		w.Header().Set("X-Total", "2")
+		fmt.Fprint(w, `[
+			{"id": 1, "path": "repo1", "path_with_namespace": "group/subgroup/repo1", "http_url_to_repo": "https://gitlab.com/group/subgroup/repo1.git", "namespace": {"full_path": "group/subgroup"},
+			 "forked_from_project": {"id": 10}, "archived": true, "visibility": "internal", "mirror": true,
+			 "default_branch": "main", "last_activity_at": "2024-05-01T10:00:00Z", "topics": ["go"]},
+			{"id": 2, "path": "repo2", "path_with_namespace": "user/repo2", "http_url_to_repo": "https://gitlab.com/user/repo2.git", "namespace": {"full_path": "user"},
+			 "ssh_url_to_repo": "git@gitlab.com:user/repo2.git",
+			 "visibility": "public", "default_branch": "master"}
+		]`)
+
+	case strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/repos/owner/"):
+		fakeMetadataAPI(w, r)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
 	}
+}
 
-	return cmd
+// fakeAssets holds the content of the release assets served by the fake API, by id
+var fakeAssets = map[string]string{
+	"10": "release binary",
+	"11": strings.Repeat("x", 1000),
+	"12": "corrupted",
+	"13": "release notes",
 }
 
-func TestGetRepositories_Gitea(t *testing.T) {
-	// Save current ExecCommand and restore at end
-	oldExecCommand := ExecCommand
-	defer func() { ExecCommand = oldExecCommand }()
+// sha256Hex returns the hex SHA-256 checksum of s
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
 
-	// Mock exec.Command
-	ExecCommand = fakeExecCommand
+// fakeReleases is the GitHub release listing served by the fake API.
+// The checksum of asset 12 does not match its content.
+var fakeReleases = fmt.Sprintf(`[
+	{"id": 2, "tag_name": "v1.1/rc", "name": "RC", "body": "Candidate", "draft": false, "prerelease": true,
+	 "created_at": "2024-05-02T10:00:00Z", "published_at": "2024-05-02T11:00:00Z", "assets": [
+		{"id": 13, "name": "notes.txt", "size": 13, "url": "https://api.github.com/repos/owner/repo1/releases/assets/13",
+		 "browser_download_url": "https://github.com/owner/repo1/releases/download/v1.1/rc/notes.txt"}
+	]},
+	{"id": 1, "tag_name": "v1.0", "name": "First", "body": "Changelog", "draft": false, "prerelease": false,
+	 "created_at": "2024-05-01T10:00:00Z", "published_at": "2024-05-01T11:00:00Z", "assets": [
+		{"id": 10, "name": "app.tar.gz", "size": 14, "digest": "sha256:%s", "url": "https://api.github.com/repos/owner/repo1/releases/assets/10"},
+		{"id": 11, "name": "big.iso", "size": 1000, "url": "https://api.github.com/repos/owner/repo1/releases/assets/11"},
+		{"id": 12, "name": "bad.zip", "size": 9, "digest": "sha256:%s", "url": "https://api.github.com/repos/owner/repo1/releases/assets/12"}
+	]}
+]`, sha256Hex(fakeAssets["10"]), sha256Hex("expected"))
+
+// Mock Gitea and GitHub repository metadata listings.
+// Incremental requests (with a `since` parameter) receive an updated issue and a new one.
+// The listings fit in a single page: Gitea requests for the next pages receive an empty page.
+func fakeMetadataAPI(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+
+	if strings.HasPrefix(r.URL.Path, "/api/v1/repos/owner/capped-") {
+		fakeCappedListing(w, r)
+		return
+	}
+	// Gitea repository with pull requests over 2 pages, otherwise the same as repo1
+	if strings.HasPrefix(r.URL.Path, "/api/v1/repos/owner/twopages/") {
+		switch strings.TrimPrefix(r.URL.Path, "/api/v1/repos/owner/twopages") {
+		case "/pulls":
+			w.Header().Set("X-Total-Count", "2")
+			if r.URL.Query().Get("page") == "2" {
+				fmt.Fprint(w, `[{"id": 20, "number": 2, "title": "Change", "updated_at": "2024-05-02T10:00:00Z"}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"id": 50, "number": 5, "title": "Other", "updated_at": "2024-05-03T10:00:00Z"}]`)
+			return
+		case "/pulls/5/reviews":
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		r.URL.Path = strings.Replace(r.URL.Path, "/twopages/", "/repo1/", 1)
+	}
+	if page := r.URL.Query().Get("page"); page != "" && page != "1" {
+		fmt.Fprint(w, `[]`)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/v1") {
+	case "/repos/owner/repo1/issues":
+		if since != "" {
+			fmt.Fprint(w, `[{"id": 1, "number": 1, "title": "Bug (edited)", "updated_at": "2024-05-03T10:00:00Z"},
+				{"id": 3, "number": 3, "title": "Feature", "updated_at": "2024-05-03T11:00:00Z"}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"id": 1, "number": 1, "title": "Bug", "updated_at": "2024-05-01T10:00:00Z", "pull_request": null},
+			{"id": 2, "number": 2, "title": "Change", "updated_at": "2024-05-02T10:00:00Z", "pull_request": {"merged": false}}]`)
+	case "/repos/owner/repo1/pulls":
+		fmt.Fprint(w, `[{"id": 20, "number": 2, "title": "Change", "updated_at": "2024-05-02T10:00:00Z"}]`)
+	case "/repos/owner/repo1/issues/comments":
+		fmt.Fprint(w, `[{"id": 101, "body": "second"}, {"id": 100, "body": "first"}]`)
+	case "/repos/owner/repo1/pulls/comments":
+		fmt.Fprint(w, `[{"id": 200, "body": "nit"}]`)
+	case "/repos/owner/repo1/pulls/2/reviews":
+		fmt.Fprint(w, `[{"id": 30, "comments_count": 1}, {"id": 31, "comments_count": 0}]`)
+	case "/repos/owner/repo1/pulls/2/reviews/30/comments":
+		fmt.Fprint(w, `[{"id": 300, "body": "nit"}]`)
+	case "/repos/owner/repo1/labels":
+		fmt.Fprint(w, `[{"id": 5, "name": "bug"}, {"id": 4, "name": "feature"}]`)
+	case "/repos/owner/repo1/milestones":
+		fmt.Fprint(w, `[{"id": 7, "title": "v1.0"}]`)
+	case "/repos/owner/repo1/releases":
+		fmt.Fprint(w, fakeReleases)
+	case "/repos/owner/repo1/releases/assets/10", "/repos/owner/repo1/releases/assets/11",
+		"/repos/owner/repo1/releases/assets/12", "/repos/owner/repo1/releases/assets/13":
+		// Assets are served with Range support
+		content := fakeAssets[strings.TrimPrefix(r.URL.Path, "/repos/owner/repo1/releases/assets/")]
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	case "/repos/owner/noissues/issues":
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"message": "Issues are disabled for this repo"}`)
+	case "/repos/owner/noissues/pulls", "/repos/owner/noissues/issues/comments", "/repos/owner/noissues/pulls/comments",
+		"/repos/owner/noissues/labels", "/repos/owner/noissues/milestones":
+		fmt.Fprint(w, `[]`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+	}
+}
+
+// fakeCappedListing serves 75 issues from a Gitea server capping the pages at 30 items (MAX_RESPONSE_ITEMS),
+// whatever the requested limit, with the X-Total-Count header (capped-total), the Link header (capped-link)
+// or no paging header (capped-none)
+func fakeCappedListing(w http.ResponseWriter, r *http.Request) {
+	const total, pageSize = 75, 30
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/v1/repos/owner/") {
+	case "capped-total/issues":
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	case "capped-link/issues":
+		if page*pageSize < total {
+			next := fmt.Sprintf("https://%s%s?limit=%d&page=%d", r.Host, r.URL.Path, pageSize, page+1)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+		}
+	}
+
+	items := []string{}
+	for id := (page-1)*pageSize + 1; id <= min(page*pageSize, total); id++ {
+		items = append(items, fmt.Sprintf(`{"id": %d, "number": %d}`, id, id))
+	}
+	fmt.Fprint(w, "["+strings.Join(items, ",")+"]")
+}
+
+// hookClient replaces NewClient so that every API request is sent to a local test server.
+// The original host is preserved in the Host header and the requests are recorded.
+func hookClient(t *testing.T) *[]*http.Request {
+	server := httptest.NewServer(http.HandlerFunc(fakeProviderAPI))
+	serverURL, _ := url.Parse(server.URL)
+
+	var mu sync.Mutex
+	requests := &[]*http.Request{}
+
+	oldNewClient := NewClient
+	NewClient = func(provider *config.ProviderConfig) (*httpapi.Client, error) {
+		client, err := httpapi.NewClient(provider)
+		if err != nil {
+			return nil, err
+		}
+		client.RequestHook = func(req *http.Request) {
+			mu.Lock()
+			*requests = append(*requests, req.Clone(req.Context()))
+			mu.Unlock()
+			req.Host = req.URL.Host
+			req.URL.Scheme = serverURL.Scheme
+			req.URL.Host = serverURL.Host
+		}
+		return client, nil
+	}
+
+	t.Cleanup(func() {
+		NewClient = oldNewClient
+		server.Close()
+	})
+
+	return requests
+}
+
+// checkAttributes checks the attributes of a repository marked as fork, archived, private and mirror
+// by the fake API, and of a repository with none of these attributes
+func checkAttributes(t *testing.T, flagged Repository, plain Repository, defaultBranch string) {
+	t.Helper()
+	if !flagged.Fork || !flagged.Archived || !flagged.Private || !flagged.Mirror {
+		t.Errorf("Expected fork, archived, private and mirror to be set, got %+v", flagged)
+	}
+	if plain.Fork || plain.Archived || plain.Private || plain.Mirror || plain.Template || plain.HasWiki {
+		t.Errorf("Expected no attribute to be set, got %+v", plain)
+	}
+	if flagged.DefaultBranch != defaultBranch {
+		t.Errorf("Expected default branch %s, got %s", defaultBranch, flagged.DefaultBranch)
+	}
+	if want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC); !flagged.PushedAt.Equal(want) {
+		t.Errorf("Expected PushedAt %v, got %v", want, flagged.PushedAt)
+	}
+	if len(flagged.Topics) == 0 || flagged.Topics[0] != "go" {
+		t.Errorf("Expected topics [go ...], got %v", flagged.Topics)
+	}
+}
+
+func TestGetRepositories_Gitea(t *testing.T) {
+	requests := hookClient(t)
 
 	// Create test config
 	cfg := &config.ProviderConfig{
@@ -45,13 +296,48 @@ func TestGetRepositories_Gitea(t *testing.T) {
 	}
 
 	// Call the function under test
-	_, err := GetRepositories(cfg, false)
-
-	// In a real test, we would check the results here
-	// This is a minimal test to ensure the function doesn't panic
+	repos, err := GetRepositories(cfg, false)
 	if err != nil {
-		// Error is expected in test environment without actual command execution
-		// Just verify it's not a panic
+		t.Fatalf("GetRepositories() error = %v", err)
+	}
+
+	// All pages must be walked
+	if len(repos) != 3 {
+		t.Fatalf("Expected 3 repos, got %d", len(repos))
+	}
+	checkAttributes(t, repos[0], repos[1], "main")
+	if repos[1].SSHURL != "git@gitea.example.com:owner/repo2.git" {
+		t.Errorf("Expected SSH URL 'git@gitea.example.com:owner/repo2.git', got %s", repos[1].SSHURL)
+	}
+	if !repos[0].Template || !repos[0].HasWiki || repos[0].Size != 2048 {
+		t.Errorf("Expected template with wiki and size 2048, got %v, %v and %d", repos[0].Template, repos[0].HasWiki, repos[0].Size)
+	}
+	if got := (*requests)[0].Header.Get("Authorization"); got != "token faketoken" {
+		t.Errorf("Expected Authorization header 'token faketoken', got %q", got)
+	}
+
+	// Test a listing cut short (more repositories reported than returned)
+	shortCfg := &config.ProviderConfig{
+		Type:        config.ProviderGitea,
+		ServerURL:   "https://gitea-short.example.com",
+		AccessToken: "faketoken",
+	}
+	_, err = GetRepositories(shortCfg, false)
+	if !errors.Is(err, ErrIncompleteListing) {
+		t.Errorf("Expected ErrIncompleteListing for a listing cut short, got %v", err)
+	}
+
+	// Test an API error response
+	deniedCfg := &config.ProviderConfig{
+		Type:      config.ProviderGitea,
+		ServerURL: "https://gitea-denied.example.com",
+	}
+	_, err = GetRepositories(deniedCfg, false)
+	if !errors.Is(err, httpapi.ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "token is required") {
+		t.Errorf("Expected API message in error, got %v", err)
 	}
 
 	// Test with invalid provider type
@@ -71,25 +357,24 @@ func TestGetRepositories_Gitea(t *testing.T) {
 		Password:     "pass",
 		UseBasicAuth: true,
 	}
+	*requests = nil
 	_, err = GetRepositories(basicAuthCfg, false)
 	if err != nil {
-		// Just verify it's not a panic
+		t.Errorf("GetRepositories() with basic auth error = %v", err)
+	}
+	if username, password, ok := (*requests)[0].BasicAuth(); !ok || username != "user" || password != "pass" {
+		t.Errorf("Expected basic auth user:pass, got %s:%s (%v)", username, password, ok)
 	}
 
 	// Test with verbose
 	_, err = GetRepositories(cfg, true)
 	if err != nil {
-		// Just verify it's not a panic
+		t.Errorf("GetRepositories() with verbose error = %v", err)
 	}
 }
 
 func TestGetRepositories_GitHub(t *testing.T) {
-	// Save current ExecCommand and restore at end
-	oldExecCommand := ExecCommand
-	defer func() { ExecCommand = oldExecCommand }()
-
-	// Mock exec.Command
-	ExecCommand = fakeExecCommand
+	requests := hookClient(t)
 
 	// Create test config for GitHub.com
 	cfg := &config.ProviderConfig{
@@ -98,13 +383,24 @@ func TestGetRepositories_GitHub(t *testing.T) {
 	}
 
 	// Call the function under test
-	_, err := GetRepositories(cfg, false)
-
-	// In a real test, we would check the results here
-	// This is a minimal test to ensure the function doesn't panic
+	repos, err := GetRepositories(cfg, false)
 	if err != nil {
-		// Error is expected in test environment without actual command execution
-		// Just verify it's not a panic
+		t.Fatalf("GetRepositories() error = %v", err)
+	}
+
+	// The `Link: rel="next"` header must be followed
+	if len(repos) != 3 {
+		t.Fatalf("Expected 3 repos, got %d", len(repos))
+	}
+	checkAttributes(t, repos[0], repos[1], "develop")
+	if !repos[0].Template || !repos[0].HasWiki || repos[0].Size != 512 {
+		t.Errorf("Expected template with wiki and size 512, got %v, %v and %d", repos[0].Template, repos[0].HasWiki, repos[0].Size)
+	}
+	if (*requests)[0].URL.Host != "api.github.com" {
+		t.Errorf("Expected request to api.github.com, got %s", (*requests)[0].URL.Host)
+	}
+	if got := (*requests)[0].Header.Get("Authorization"); got != "Bearer faketoken" {
+		t.Errorf("Expected Authorization header 'Bearer faketoken', got %q", got)
 	}
 
 	// Test GitHub Enterprise config
@@ -113,9 +409,16 @@ func TestGetRepositories_GitHub(t *testing.T) {
 		ServerURL:   "https://github.example.com",
 		AccessToken: "faketoken",
 	}
-	_, err = GetRepositories(gheCfg, false)
+	*requests = nil
+	repos, err = GetRepositories(gheCfg, false)
 	if err != nil {
-		// Just verify it's not a panic
+		t.Errorf("GetRepositories() for GitHub Enterprise error = %v", err)
+	}
+	if len(repos) != 3 {
+		t.Errorf("Expected 3 repos, got %d", len(repos))
+	}
+	if (*requests)[0].URL.Path != "/api/v3/user/repos" {
+		t.Errorf("Expected GitHub Enterprise API path, got %s", (*requests)[0].URL.Path)
 	}
 
 	// Test with basic auth
@@ -127,13 +430,384 @@ func TestGetRepositories_GitHub(t *testing.T) {
 	}
 	_, err = GetRepositories(basicAuthCfg, false)
 	if err != nil {
-		// Just verify it's not a panic
+		t.Errorf("GetRepositories() with basic auth error = %v", err)
 	}
 
 	// Test with verbose
 	_, err = GetRepositories(cfg, true)
 	if err != nil {
-		// Just verify it's not a panic
+		t.Errorf("GetRepositories() with verbose error = %v", err)
+	}
+}
+
+func TestGetRepositories_GitLab(t *testing.T) {
+	requests := hookClient(t)
+
+	// Create test config for gitlab.com with an extra group
+	cfg := &config.ProviderConfig{
+		Type:        config.ProviderGitLab,
+		AccessToken: "faketoken",
+		Groups:      []string{"group/subgroup"},
+	}
+
+	repos, err := GetRepositories(cfg, false)
+	if err != nil {
+		t.Fatalf("GetRepositories() error = %v", err)
+	}
+
+	// Both listings return the same projects, so they must be deduplicated
+	if len(repos) != 2 {
+		t.Fatalf("Expected 2 repos, got %d", len(repos))
+	}
+
+	if repos[0].FullName != "group/subgroup/repo1" {
+		t.Errorf("Expected FullName 'group/subgroup/repo1', got %s", repos[0].FullName)
+	}
+	if repos[0].Login != "group/subgroup" {
+		t.Errorf("Expected Login 'group/subgroup', got %s", repos[0].Login)
+	}
+	if repos[0].Name != "repo1" {
+		t.Errorf("Expected Name 'repo1', got %s", repos[0].Name)
+	}
+	if repos[0].URL != "https://gitlab.com/group/subgroup/repo1.git" {
+		t.Errorf("Expected URL 'https://gitlab.com/group/subgroup/repo1.git', got %s", repos[0].URL)
+	}
+	checkAttributes(t, repos[0], repos[1], "main")
+	if repos[1].SSHURL != "git@gitlab.com:user/repo2.git" {
+		t.Errorf("Expected SSH URL 'git@gitlab.com:user/repo2.git', got %s", repos[1].SSHURL)
+	}
+	if got := (*requests)[0].Header.Get("PRIVATE-TOKEN"); got != "faketoken" {
+		t.Errorf("Expected PRIVATE-TOKEN header 'faketoken', got %q", got)
+	}
+	if got := (*requests)[1].URL.EscapedPath(); got != "/api/v4/groups/group%2Fsubgroup/projects" {
+		t.Errorf("Expected group projects path, got %s", got)
+	}
+
+	// Test self-managed GitLab with verbose
+	selfManagedCfg := &config.ProviderConfig{
+		Type:        config.ProviderGitLab,
+		ServerURL:   "https://gitlab.example.com/",
+		AccessToken: "faketoken",
+	}
+	_, err = GetRepositories(selfManagedCfg, true)
+	if err != nil {
+		t.Errorf("GetRepositories() for self-managed GitLab error = %v", err)
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	tests := []struct {
+		name string
+		link []string
+		want string
+	}{
+		{
+			name: "No Link header",
+			want: "",
+		},
+		{
+			name: "Next and last",
+			link: []string{`<https://api.example.com/repos?page=2>; rel="next", <https://api.example.com/repos?page=5>; rel="last"`},
+			want: "https://api.example.com/repos?page=2",
+		},
+		{
+			name: "Last page",
+			link: []string{`<https://api.example.com/repos?page=1>; rel="first", <https://api.example.com/repos?page=4>; rel="prev"`},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, link := range tt.link {
+				header.Add("Link", link)
+			}
+			if got := nextPageURL(header); got != tt.want {
+				t.Errorf("nextPageURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readMetadataIDs returns the ids of the items of a metadata file
+func readMetadataIDs(t *testing.T, dir string, name string) []int64 {
+	t.Helper()
+	file, err := readMetadataFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+	if file.Version != MetadataVersion || file.SyncedAt.IsZero() {
+		t.Errorf("Unexpected %s version %d and sync time %v", name, file.Version, file.SyncedAt)
+	}
+	ids := []int64{}
+	for _, item := range file.Items {
+		var info metadataItem
+		if err := json.Unmarshal(item, &info); err != nil {
+			t.Fatalf("Failed to parse %s item: %v", name, err)
+		}
+		ids = append(ids, info.Id)
+	}
+	return ids
+}
+
+func TestExportMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider config.ProviderConfig
+		// wantReviewComments are the ids of the review comments (listed by review in Gitea)
+		wantReviewComments []int64
+	}{
+		{
+			name:               "GitHub",
+			provider:           config.ProviderConfig{Type: config.ProviderGitHub, AccessToken: "github_token"},
+			wantReviewComments: []int64{200},
+		},
+		{
+			name:               "Gitea",
+			provider:           config.ProviderConfig{Type: config.ProviderGitea, ServerURL: "https://gitea.example.com/", AccessToken: "gitea_token"},
+			wantReviewComments: []int64{300},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := hookClient(t)
+			dir := MetadataDir(filepath.Join(t.TempDir(), "owner", "repo1"))
+			repo := Repository{Login: "owner", Name: "repo1", FullName: "owner/repo1"}
+
+			result, err := ExportMetadata(&tt.provider, repo, dir, false)
+			if err != nil {
+				t.Fatalf("ExportMetadata() error = %v", err)
+			}
+			want := MetadataResult{Issues: 1, PullRequests: 1, Comments: 2, ReviewComments: 1, Labels: 2, Milestones: 1}
+			if *result != want {
+				t.Errorf("ExportMetadata() = %+v, want %+v", *result, want)
+			}
+
+			// Pull requests listed as issues are left out, items are sorted by id
+			for name, want := range map[string][]int64{
+				IssuesFile:         {1},
+				PullRequestsFile:   {20},
+				CommentsFile:       {100, 101},
+				ReviewCommentsFile: tt.wantReviewComments,
+				LabelsFile:         {4, 5},
+				MilestonesFile:     {7},
+			} {
+				if got := readMetadataIDs(t, dir, name); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s ids = %v, want %v", name, got, want)
+				}
+			}
+			for _, req := range *requests {
+				if req.URL.Query().Get("since") != "" {
+					t.Errorf("Expected a full export, got request %s", req.URL)
+				}
+			}
+
+			// The next export only requests the items updated since the previous one
+			*requests = nil
+			if _, err := ExportMetadata(&tt.provider, repo, dir, false); err != nil {
+				t.Fatalf("ExportMetadata() error = %v", err)
+			}
+			if got := readMetadataIDs(t, dir, IssuesFile); !reflect.DeepEqual(got, []int64{1, 3}) {
+				t.Errorf("Expected issues [1 3] after the incremental export, got %v", got)
+			}
+			data, _ := os.ReadFile(filepath.Join(dir, IssuesFile))
+			if !strings.Contains(string(data), "Bug (edited)") {
+				t.Errorf("Expected the updated issue, got %s", data)
+			}
+			for _, req := range *requests {
+				if strings.HasSuffix(req.URL.Path, "/issues") && req.URL.Query().Get("since") == "" {
+					t.Errorf("Expected an incremental issues request, got %s", req.URL)
+				}
+			}
+		})
+	}
+
+	// Review comments are exported from the pull requests updated since their own previous export,
+	// even when the pull requests file was exported since (e.g. the review comments export failed)
+	hookClient(t)
+	gitea := &config.ProviderConfig{Type: config.ProviderGitea, ServerURL: "https://gitea.example.com", AccessToken: "gitea_token"}
+	pullsDir := MetadataDir(filepath.Join(t.TempDir(), "owner", "twopages"))
+	if err := os.MkdirAll(pullsDir, 0755); err != nil {
+		t.Fatalf("Failed to create metadata directory: %v", err)
+	}
+	pullsFile := &MetadataFile{Version: MetadataVersion, SyncedAt: time.Now().UTC()}
+	if err := writeMetadataFile(filepath.Join(pullsDir, PullRequestsFile), pullsFile); err != nil {
+		t.Fatalf("Failed to write %s: %v", PullRequestsFile, err)
+	}
+	if _, err := ExportMetadata(gitea, Repository{FullName: "owner/twopages"}, pullsDir, false); err != nil {
+		t.Fatalf("ExportMetadata() error = %v", err)
+	}
+	if got := readMetadataIDs(t, pullsDir, ReviewCommentsFile); !reflect.DeepEqual(got, []int64{300}) {
+		t.Errorf("%s ids = %v, want [300]", ReviewCommentsFile, got)
+	}
+
+	// Repositories with issues disabled export no issues
+	hookClient(t)
+	dir := t.TempDir()
+	provider := &config.ProviderConfig{Type: config.ProviderGitHub}
+	result, err := ExportMetadata(provider, Repository{FullName: "owner/noissues"}, dir, false)
+	if err != nil || result.Issues != 0 {
+		t.Errorf("ExportMetadata() = %+v, %v, want no issues", result, err)
+	}
+
+	// GitLab is not supported
+	provider = &config.ProviderConfig{Type: config.ProviderGitLab}
+	if _, err := ExportMetadata(provider, Repository{FullName: "owner/repo1"}, dir, false); err == nil {
+		t.Error("Expected an error for a GitLab provider, got nil")
+	}
+}
+
+func TestMetadataListPaging(t *testing.T) {
+	hookClient(t)
+	provider := &config.ProviderConfig{Type: config.ProviderGitea, ServerURL: "https://gitea.example.com", AccessToken: "gitea_token"}
+
+	// Pages capped below the requested limit do not end the listing
+	for _, name := range []string{"capped-total", "capped-link", "capped-none"} {
+		t.Run(name, func(t *testing.T) {
+			api, err := newMetadataAPI(provider, Repository{FullName: "owner/" + name}, false)
+			if err != nil {
+				t.Fatalf("newMetadataAPI() error = %v", err)
+			}
+			items, err := api.list("/issues", url.Values{}, time.Time{})
+			if err != nil {
+				t.Fatalf("list() error = %v", err)
+			}
+			if len(items) != 75 {
+				t.Errorf("list() returned %d items, want 75", len(items))
+			}
+		})
+	}
+}
+
+func TestExportReleases(t *testing.T) {
+	requests := hookClient(t)
+	dir := MetadataDir(filepath.Join(t.TempDir(), "owner", "repo1"))
+	provider := &config.ProviderConfig{Type: config.ProviderGitHub, AccessToken: "github_token", MaxAssetSize: 100}
+	repo := Repository{Login: "owner", Name: "repo1", FullName: "owner/repo1"}
+
+	// An interrupted download of app.tar.gz is resumed
+	releaseDir := filepath.Join(dir, ReleasesDir, "v1.0")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatalf("Failed to create release directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(releaseDir, "app.tar.gz.part"), []byte("release"), 0644); err != nil {
+		t.Fatalf("Failed to write partial asset: %v", err)
+	}
+
+	// The corrupted asset fails the export, the others are downloaded
+	result, err := ExportReleases(provider, repo, dir, false)
+	if err == nil || !strings.Contains(err.Error(), "bad.zip: checksum mismatch") {
+		t.Errorf("ExportReleases() error = %v, want a checksum mismatch for bad.zip", err)
+	}
+	want := ReleasesResult{Releases: 2, Downloaded: 2, TooLarge: 1, BytesDownloaded: 7 + 13 + 9}
+	if *result != want {
+		t.Errorf("ExportReleases() = %+v, want %+v", *result, want)
+	}
+
+	for path, content := range map[string]string{
+		filepath.Join("v1.0", "app.tar.gz"):   "release binary",
+		filepath.Join("v1.1_rc", "notes.txt"): "release notes",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, ReleasesDir, path))
+		if err != nil || string(data) != content {
+			t.Errorf("Asset %s = %q, %v, want %q", path, data, err, content)
+		}
+	}
+	for _, name := range []string{"big.iso", "big.iso.part", "bad.zip", "bad.zip.part", "app.tar.gz.part"} {
+		if _, err := os.Stat(filepath.Join(releaseDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to exist, got %v", name, err)
+		}
+	}
+	for _, req := range *requests {
+		if strings.HasSuffix(req.URL.Path, "/assets/10") && req.Header.Get("Range") != "bytes=7-" {
+			t.Errorf("Expected the download of app.tar.gz to be resumed, got Range %q", req.Header.Get("Range"))
+		}
+		if strings.Contains(req.URL.Path, "/assets/") && req.Header.Get("Accept") != "application/octet-stream" {
+			t.Errorf("Expected the asset content to be requested, got Accept %q", req.Header.Get("Accept"))
+		}
+	}
+
+	// Releases metadata
+	if got := readMetadataIDs(t, dir, ReleasesFile); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("%s ids = %v, want [1 2]", ReleasesFile, got)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, ReleasesFile))
+	for _, field := range []string{`"body": "Changelog"`, `"prerelease": true`, `"published_at": "2024-05-01T11:00:00Z"`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("Expected %s in %s, got %s", field, ReleasesFile, data)
+		}
+	}
+
+	// Assets already on disk are not downloaded again
+	*requests = nil
+	result, _ = ExportReleases(provider, repo, dir, false)
+	if result.Existing != 2 || result.Downloaded != 0 {
+		t.Errorf("ExportReleases() = %+v, want 2 existing assets", *result)
+	}
+	for _, req := range *requests {
+		if strings.HasSuffix(req.URL.Path, "/assets/10") || strings.HasSuffix(req.URL.Path, "/assets/13") {
+			t.Errorf("Unexpected download of an existing asset: %s", req.URL)
+		}
+	}
+
+	// Only the verified checksums are recorded
+	wantDigests := map[string]string{"v1.0/app.tar.gz": "sha256:" + sha256Hex(fakeAssets["10"])}
+	if got := readAssetDigests(dir); !reflect.DeepEqual(got, wantDigests) {
+		t.Errorf("%s = %v, want %v", AssetDigestsFile, got, wantDigests)
+	}
+
+	// An asset on disk without a recorded checksum is verified, and downloaded again when it does not match
+	appPath := filepath.Join(releaseDir, "app.tar.gz")
+	if err := os.Remove(filepath.Join(dir, AssetDigestsFile)); err != nil {
+		t.Fatalf("Failed to remove %s: %v", AssetDigestsFile, err)
+	}
+	if err := os.WriteFile(appPath, []byte("tampered binar"), 0644); err != nil {
+		t.Fatalf("Failed to write asset: %v", err)
+	}
+	result, _ = ExportReleases(provider, repo, dir, false)
+	if result.Existing != 1 || result.Downloaded != 1 {
+		t.Errorf("ExportReleases() = %+v, want 1 existing and 1 downloaded asset", *result)
+	}
+	if data, _ := os.ReadFile(appPath); string(data) != fakeAssets["10"] {
+		t.Errorf("Asset app.tar.gz = %q, want %q", data, fakeAssets["10"])
+	}
+
+	// An asset whose checksum changed upstream is downloaded again, even with the same size
+	oldAsset, oldReleases := fakeAssets["10"], fakeReleases
+	t.Cleanup(func() { fakeAssets["10"], fakeReleases = oldAsset, oldReleases })
+	fakeAssets["10"] = "rebuilt binary"
+	fakeReleases = strings.Replace(fakeReleases, sha256Hex(oldAsset), sha256Hex(fakeAssets["10"]), 1)
+	result, _ = ExportReleases(provider, repo, dir, false)
+	if result.Existing != 1 || result.Downloaded != 1 {
+		t.Errorf("ExportReleases() = %+v, want 1 existing and 1 downloaded asset", *result)
+	}
+	if data, _ := os.ReadFile(appPath); string(data) != fakeAssets["10"] {
+		t.Errorf("Asset app.tar.gz = %q, want %q", data, fakeAssets["10"])
+	}
+	wantDigests["v1.0/app.tar.gz"] = "sha256:" + sha256Hex(fakeAssets["10"])
+	if got := readAssetDigests(dir); !reflect.DeepEqual(got, wantDigests) {
+		t.Errorf("%s = %v, want %v", AssetDigestsFile, got, wantDigests)
+	}
+}
+
+func TestSafeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "v1.0", want: "v1.0"},
+		{name: "release/1.0", want: "release_1.0"},
+		{name: `..\evil`, want: ".._evil"},
+		{name: "..", want: "fallback"},
+		{name: "", want: "fallback"},
+	}
+
+	for _, tt := range tests {
+		if got := safeFileName(tt.name, "fallback"); got != tt.want {
+			t.Errorf("safeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
 	}
 }
 
@@ -167,80 +841,3 @@ func TestRepository(t *testing.T) {
 		t.Errorf("Expected URL 'https://example.com/owner/repo.git', got %s", repo.URL)
 	}
 }
-
-// This is a test helper process that will be executed when the tests run
-// It simulates the external command's behavior
-func TestHelperProcess(t *testing.T) {
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-		return
-	}
-
-	// Get the command and args that were passed to exec.Command
-	args := os.Args
-	for i, arg := range args {
-		if arg == "--" {
-			args = args[i+1:]
-			break
-		}
-	}
-
-	if len(args) < 1 {
-		os.Exit(1)
-	}
-
-	// Check which mock to provide
-	if args[0] == "curl" {
-		if os.Getenv("MOCK_GITEA") == "1" {
-			// Mock Gitea API response
-			fmt.Println(`{
-			  "data": [
-				{
-				  "id": 1,
-				  "name": "repo1",
-				  "full_name": "owner/repo1",
-				  "clone_url": "https://gitea.example.com/owner/repo1.git",
-				  "owner": {
-					"login": "owner"
-				  }
-				},
-				{
-				  "id": 2,
-				  "name": "repo2",
-				  "full_name": "owner/repo2",
-				  "clone_url": "https://gitea.example.com/owner/repo2.git",
-				  "owner": {
-					"login": "owner"
-				  }
-				}
-			  ]
-			}`)
-		} else if os.Getenv("MOCK_GITHUB") == "1" {
-			// Mock GitHub API response
-			fmt.Println(`[
-			  {
-				"id": 1,
-				"name": "repo1",
-				"full_name": "owner/repo1",
-				"clone_url": "https://github.com/owner/repo1.git",
-				"owner": {
-				  "login": "owner"
-				}
-			  },
-			  {
-				"id": 2,
-				"name": "repo2",
-				"full_name": "owner/repo2",
-				"clone_url": "https://github.com/owner/repo2.git",
-				"owner": {
-				  "login": "owner"
-				}
-			  }
-			]`)
-		} else {
-			// Default empty response
-			fmt.Println("{}")
-		}
-	}
-
-	os.Exit(0)
-}
@@ -0,0 +1,98 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 3 * * *"},
+		{expr: "*/15 * * * *"},
+		{expr: "0 1-5/2 1,15 jan-jun mon-fri"},
+		{expr: "30 4 * * 7"},
+		{expr: "@daily"},
+		{expr: "@every 90m"},
+		{expr: "", wantErr: true},
+		{expr: "0 3 * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "0 24 * * *", wantErr: true},
+		{expr: "0 0 0 * *", wantErr: true},
+		{expr: "0 0 * 13 *", wantErr: true},
+		{expr: "0 0 * * 8", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "0 0 30 2 *", wantErr: true},
+		{expr: "@fortnightly", wantErr: true},
+		{expr: "@every", wantErr: true},
+		{expr: "@every 10ms", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := Parse(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("Parse(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2025, time.January, 15, 10, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "0 3 * * *", want: time.Date(2025, time.January, 16, 3, 0, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", want: time.Date(2025, time.January, 15, 10, 45, 0, 0, time.UTC)},
+		{expr: "30 10 * * *", want: time.Date(2025, time.January, 16, 10, 30, 0, 0, time.UTC)},
+		{expr: "0 0 * * sun", want: time.Date(2025, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 * * 7", want: time.Date(2025, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 12 1 * *", want: time.Date(2025, time.February, 1, 12, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", want: time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricted days of month and of week match either
+		{expr: "0 0 1 * fri", want: time.Date(2025, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 8-18/4 * * *", want: time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC)},
+		{expr: "@hourly", want: time.Date(2025, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{expr: "@weekly", want: time.Date(2025, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{expr: "@monthly", want: time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "@yearly", want: time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "@every 6h", want: from.Add(6 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.expr, err)
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextLocation(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Bucharest")
+	if err != nil {
+		t.Skipf("Time zone database not available: %v", err)
+	}
+
+	s, err := Parse("30 3 * * *")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	// 03:30 does not exist on the day the clocks move forward, so the next run is the following day
+	from := time.Date(2025, time.March, 30, 1, 0, 0, 0, loc)
+	want := time.Date(2025, time.March, 31, 3, 30, 0, 0, loc)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+}
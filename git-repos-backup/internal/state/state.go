@@ -0,0 +1,145 @@
+// Package state provides the state of the incremental backups of a provider
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/fileutil"
+)
+
+// FileName is the name of the state file, in the target directory of a provider
+const FileName = ".git-repos-backup-state.json"
+
+// State records the repositories backed up by the previous runs of a provider.
+// Its methods are safe to call concurrently, and on a nil State (which records nothing).
+type State struct {
+	// Options identifies the fetch options the repositories were backed up with
+	Options string          `json:"options"`
+	Repos   map[string]Repo `json:"repos"`
+
+	mu sync.Mutex
+}
+
+// Repo is the state of a repository backup
+type Repo struct {
+	// PushedAt is the time of the last push reported by the provider when the repository was fetched
+	PushedAt  time.Time `json:"pushed_at"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// Refs holds the object names of the refs after the fetch, indexed by ref name
+	Refs map[string]string `json:"refs"`
+	// DefaultBranch is the remote default branch the HEAD of the backup was kept on by the fetch
+	DefaultBranch string `json:"default_branch,omitempty"`
+}
+
+// Path returns the path of the state file of a provider target directory
+func Path(targetDir string) string {
+	return filepath.Join(targetDir, FileName)
+}
+
+// New creates an empty state for the given fetch options
+func New(options string) *State {
+	return &State{Options: options, Repos: make(map[string]Repo)}
+}
+
+// Load reads the state file at path.
+// An empty state is returned when the file does not exist, or when the repositories were
+// backed up with other fetch options (e.g. other refs), so that they are all fetched again.
+func Load(path string, options string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return New(options), nil
+	}
+	if err != nil {
+		return New(options), fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	s := New(options)
+	if err := json.Unmarshal(data, s); err != nil {
+		return New(options), fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if s.Options != options || s.Repos == nil {
+		return New(options), nil
+	}
+	return s, nil
+}
+
+// Unchanged returns true when a repository was fetched with the same push time, and when current
+// confirms that the refs and default branch recorded after that fetch are still current
+// (e.g. on the remote and in the backup).
+// Repositories without push time or without recorded refs are never unchanged.
+func (s *State) Unchanged(name string, pushedAt time.Time, current func(recorded Repo) bool) bool {
+	if s == nil || pushedAt.IsZero() {
+		return false
+	}
+	s.mu.Lock()
+	repo, ok := s.Repos[name]
+	s.mu.Unlock()
+	if !ok || !repo.PushedAt.Equal(pushedAt) || len(repo.Refs) == 0 {
+		return false
+	}
+
+	return current(repo)
+}
+
+// Record records the fetch of a repository
+func (s *State) Record(name string, pushedAt time.Time, refs map[string]string, defaultBranch string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Repos[name] = Repo{PushedAt: pushedAt, FetchedAt: time.Now().UTC(), Refs: refs, DefaultBranch: defaultBranch}
+}
+
+// Forget removes a repository, so that it is fetched by the next run
+func (s *State) Forget(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Repos, name)
+}
+
+// Prune removes the repositories not in names (e.g. deleted or excluded repositories)
+func (s *State) Prune(names []string) {
+	if s == nil {
+		return
+	}
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.Repos {
+		if !keep[name] {
+			delete(s.Repos, name)
+		}
+	}
+}
+
+// Save writes the state to the file at path, replacing it atomically
+func (s *State) Save(path string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	if err := fileutil.WriteAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
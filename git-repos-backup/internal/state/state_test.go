@@ -0,0 +1,119 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	path := Path(dir)
+	pushedAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	refs := map[string]string{"refs/heads/main": "0123456789abcdef0123456789abcdef01234567"}
+
+	// A missing state file gives an empty state
+	s, err := Load(path, "refs/heads/*:refs/heads/*")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(s.Repos) != 0 {
+		t.Errorf("Load() = %+v, want an empty state", s.Repos)
+	}
+
+	s.Record("owner/repo", pushedAt, refs, "main")
+	s.Record("owner/deleted", pushedAt, refs, "main")
+	s.Prune([]string{"owner/repo"})
+	if err := s.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		options   string
+		wantRepos int
+	}{
+		{name: "Same options", options: "refs/heads/*:refs/heads/*", wantRepos: 1},
+		{name: "Changed options", options: "+refs/*:refs/*", wantRepos: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := Load(path, tt.options)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if len(loaded.Repos) != tt.wantRepos {
+				t.Errorf("Load() repos = %d, want %d", len(loaded.Repos), tt.wantRepos)
+			}
+			if repo, ok := loaded.Repos["owner/repo"]; ok && (!repo.PushedAt.Equal(pushedAt) || repo.Refs["refs/heads/main"] != refs["refs/heads/main"] || repo.DefaultBranch != "main") {
+				t.Errorf("Load() repo = %+v, want pushed at %v with refs %v on main", repo, pushedAt, refs)
+			}
+		})
+	}
+
+	// An invalid state file gives an empty state and an error
+	if err := os.WriteFile(path, []byte("{invalid"), 0644); err != nil {
+		t.Fatalf("Failed to write state file: %v", err)
+	}
+	if s, err := Load(path, ""); err == nil || s == nil || len(s.Repos) != 0 {
+		t.Errorf("Load() = %v, %v, want an empty state and an error", s, err)
+	}
+
+	// Saving to a missing directory fails
+	if err := s.Save(filepath.Join(dir, "missing", FileName)); err == nil {
+		t.Error("Expected error for missing directory, got nil")
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	pushedAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	refs := map[string]string{"refs/heads/main": "abc", "refs/tags/v1": "def"}
+
+	s := New("")
+	s.Record("owner/repo", pushedAt, refs, "main")
+	s.Record("owner/empty", pushedAt, map[string]string{}, "")
+
+	tests := []struct {
+		name        string
+		repo        string
+		pushedAt    time.Time
+		refsCurrent bool
+		want        bool
+	}{
+		{name: "Unchanged", repo: "owner/repo", pushedAt: pushedAt, refsCurrent: true, want: true},
+		{name: "New push", repo: "owner/repo", pushedAt: pushedAt.Add(time.Minute), refsCurrent: true},
+		{name: "Unknown push time", repo: "owner/repo", refsCurrent: true},
+		{name: "Unknown repository", repo: "owner/other", pushedAt: pushedAt, refsCurrent: true},
+		{name: "Changed refs", repo: "owner/repo", pushedAt: pushedAt},
+		{name: "Empty repository", repo: "owner/empty", pushedAt: pushedAt, refsCurrent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := func(recorded Repo) bool {
+				if recorded.Refs["refs/tags/v1"] != "def" || recorded.DefaultBranch != "main" {
+					t.Errorf("Unchanged() checked %+v, want refs %v on main", recorded, refs)
+				}
+				return tt.refsCurrent
+			}
+			if got := s.Unchanged(tt.repo, tt.pushedAt, current); got != tt.want {
+				t.Errorf("Unchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A nil state records nothing
+	current := func(Repo) bool { return true }
+	var empty *State
+	empty.Record("owner/repo", pushedAt, refs, "main")
+	if empty.Unchanged("owner/repo", pushedAt, current) {
+		t.Error("Unchanged() = true for a nil state, want false")
+	}
+
+	s.Forget("owner/repo")
+	if s.Unchanged("owner/repo", pushedAt, current) {
+		t.Error("Unchanged() = true for a forgotten repository, want false")
+	}
+}
@@ -6,65 +6,141 @@ import (
 	"strings"
 
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/config"
+	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/output"
 	"github.com/adeotek/adeotek-tools/git-repos-backup/internal/repository"
 )
 
-// FilterRepositories applies include and exclude filters from config
+// CheckPatterns checks that all the include and exclude entries of a provider are valid patterns.
+// It is a config.ProviderCheck, run with the configuration validation.
+func CheckPatterns(provider *config.ProviderConfig) []config.FieldError {
+	var problems []config.FieldError
+	for _, filter := range []struct {
+		field   string
+		entries []string
+	}{{"include", provider.Include}, {"exclude", provider.Exclude}} {
+		for i, entry := range filter.entries {
+			if _, err := ParsePattern(entry); err != nil {
+				problems = append(problems, config.FieldError{Field: filter.field, Index: i, Err: err})
+			}
+		}
+	}
+	return problems
+}
+
+// FilterRepositories applies attribute, include and exclude filters from config.
+// The attribute filters (skip_forks, skip_archived, skip_mirrors, skip_templates and
+// visibility) are applied first, then the include filter (an empty include filter selects
+// all repositories), then the exclude filter, so exclude always wins.
+// Filter entries can be exact full names, owner entries (`owner/`), glob patterns
+// or regular expressions (`re:...`). Invalid entries never match, so filters
+// should be checked with CheckPatterns first.
 func FilterRepositories(repos []repository.Repository, provider *config.ProviderConfig, verbose bool) []repository.Repository {
-	// If neither include nor exclude is specified, return all repos
-	if len(provider.Include) == 0 && len(provider.Exclude) == 0 {
+	// If no filter is specified, return all repos
+	if len(provider.Include) == 0 && len(provider.Exclude) == 0 && !hasAttributeFilters(provider) {
 		return repos
 	}
 
-	// Create a map for faster lookup
-	includeMap := make(map[string]bool)
-	for _, name := range provider.Include {
-		includeMap[name] = true
-	}
+	include := parseValidPatterns(provider.Include)
+	exclude := parseValidPatterns(provider.Exclude)
 
 	if verbose {
-		includeList := make([]string, 0, len(includeMap))
-		for name := range includeMap {
-			includeList = append(includeList, name)
-		}
-		if len(includeMap) == 0 {
-			fmt.Printf("----> `include` filter is empty\n")
+		if len(include) == 0 {
+			fmt.Fprintf(output.Stdout, "----> `include` filter is empty\n")
 		} else {
-			fmt.Printf("----> `include` filter: %s\n", strings.Join(includeList, ", "))
-		}
-	}
-
-	excludeMap := make(map[string]bool)
-	for _, name := range provider.Exclude {
-		excludeMap[name] = true
-	}
-
-	if verbose {
-		excludeList := make([]string, 0, len(excludeMap))
-		for name := range excludeMap {
-			excludeList = append(excludeList, name)
+			fmt.Fprintf(output.Stdout, "----> `include` filter: %s\n", strings.Join(provider.Include, ", "))
 		}
-		if len(excludeList) == 0 {
-			fmt.Printf("----> `exclude` filter is empty\n")
+		if len(exclude) == 0 {
+			fmt.Fprintf(output.Stdout, "----> `exclude` filter is empty\n")
 		} else {
-			fmt.Printf("----> `exclude` filter: %s\n", strings.Join(excludeList, ", "))
+			fmt.Fprintf(output.Stdout, "----> `exclude` filter: %s\n", strings.Join(provider.Exclude, ", "))
 		}
 	}
 
 	var filtered []repository.Repository
 	for _, repo := range repos {
-		// If include list is specified, only include repos in that list
+		// Skip repos rejected by an attribute filter
+		if option := rejectingAttributeFilter(repo, provider); option != "" {
+			if verbose {
+				fmt.Fprintf(output.Stdout, "----> %s: skipped by `%s` option\n", repo.FullName, option)
+			}
+			continue
+		}
+
+		// If include list is specified, only keep repos matching it
+		var included *Pattern
 		if len(provider.Include) > 0 {
-			if includeMap[repo.FullName] {
-				filtered = append(filtered, repo)
+			if included = matchAny(include, repo.FullName); included == nil {
+				if verbose {
+					fmt.Fprintf(output.Stdout, "----> %s: skipped, no `include` rule matches\n", repo.FullName)
+				}
+				continue
 			}
-		} else {
-			// If exclude list is specified, exclude repos in that list
-			if !excludeMap[repo.FullName] {
-				filtered = append(filtered, repo)
+		}
+
+		// Then drop the repos matching the exclude list
+		if excluded := matchAny(exclude, repo.FullName); excluded != nil {
+			if verbose {
+				fmt.Fprintf(output.Stdout, "----> %s: skipped by `exclude` rule `%s`\n", repo.FullName, excluded)
 			}
+			continue
 		}
+
+		if verbose {
+			if included != nil {
+				fmt.Fprintf(output.Stdout, "----> %s: selected by `include` rule `%s`\n", repo.FullName, included)
+			} else {
+				fmt.Fprintf(output.Stdout, "----> %s: selected, no `exclude` rule matches\n", repo.FullName)
+			}
+		}
+		filtered = append(filtered, repo)
 	}
 
 	return filtered
 }
+
+// hasAttributeFilters checks whether any attribute filter is enabled
+func hasAttributeFilters(provider *config.ProviderConfig) bool {
+	return provider.SkipForks || provider.SkipArchived || provider.SkipMirrors || provider.SkipTemplates ||
+		(provider.Visibility != "" && provider.Visibility != config.VisibilityAll)
+}
+
+// rejectingAttributeFilter returns the name of the option rejecting a repository,
+// or an empty string if the repository passes all the attribute filters
+func rejectingAttributeFilter(repo repository.Repository, provider *config.ProviderConfig) string {
+	switch {
+	case provider.SkipForks && repo.Fork:
+		return "skip_forks"
+	case provider.SkipArchived && repo.Archived:
+		return "skip_archived"
+	case provider.SkipMirrors && repo.Mirror:
+		return "skip_mirrors"
+	case provider.SkipTemplates && repo.Template:
+		return "skip_templates"
+	case provider.Visibility == config.VisibilityPrivate && !repo.Private:
+		return "visibility: private"
+	case provider.Visibility == config.VisibilityPublic && repo.Private:
+		return "visibility: public"
+	}
+	return ""
+}
+
+// parseValidPatterns parses filter entries, ignoring the invalid ones
+func parseValidPatterns(entries []string) []*Pattern {
+	patterns := make([]*Pattern, 0, len(entries))
+	for _, entry := range entries {
+		if p, err := ParsePattern(entry); err == nil {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchAny returns the first pattern matching a full name, or nil if none matches
+func matchAny(patterns []*Pattern, fullName string) *Pattern {
+	for _, p := range patterns {
+		if p.Match(fullName) {
+			return p
+		}
+	}
+	return nil
+}
@@ -60,10 +60,46 @@ func TestFilterRepositories(t *testing.T) {
 			expectedIDs: []int{1, 3}, // Should exclude owner1/repo2
 		},
 		{
-			name:        "Include and exclude (include takes precedence)",
+			name:        "Include and exclude (exclude applied after include)",
 			include:     []string{"owner1/repo1"},
 			exclude:     []string{"owner1/repo1", "owner1/repo2"},
-			expectedIDs: []int{1}, // Include takes precedence, so only owner1/repo1 is included
+			expectedIDs: []int{}, // owner1/repo1 is included, then excluded
+		},
+		{
+			name:        "Include owner and exclude pattern",
+			include:     []string{"owner1/*"},
+			exclude:     []string{"owner1/*2"},
+			expectedIDs: []int{1}, // owner1/repo2 is removed from the included repos
+		},
+		{
+			name:        "Exclude not matching included repos",
+			include:     []string{"owner1/"},
+			exclude:     []string{"owner2/repo3"},
+			expectedIDs: []int{1, 2},
+		},
+		{
+			name:        "Include owner",
+			include:     []string{"owner1/"},
+			exclude:     []string{},
+			expectedIDs: []int{1, 2}, // Should return all owner1 repos
+		},
+		{
+			name:        "Include glob pattern",
+			include:     []string{"*/repo3", "owner1/repo1"},
+			exclude:     []string{},
+			expectedIDs: []int{1, 3}, // Glob and exact names can be combined
+		},
+		{
+			name:        "Exclude regular expression",
+			include:     []string{},
+			exclude:     []string{"re:^owner1/repo[12]$"},
+			expectedIDs: []int{3}, // Should exclude owner1/repo1 and owner1/repo2
+		},
+		{
+			name:        "Invalid pattern never matches",
+			include:     []string{"re:repo(", "owner2/repo3"},
+			exclude:     []string{},
+			expectedIDs: []int{3},
 		},
 		{
 			name:        "Include non-existent repo",
@@ -111,3 +147,89 @@ func TestFilterRepositories(t *testing.T) {
 	}
 	FilterRepositories(testRepos, provider, true)
 }
+
+func TestCheckPatterns(t *testing.T) {
+	valid := &config.ProviderConfig{
+		Include: []string{"owner/", "owner/*-svc", "re:^owner/"},
+		Exclude: []string{"owner/legacy"},
+	}
+	if problems := CheckPatterns(valid); len(problems) != 0 {
+		t.Errorf("CheckPatterns() = %v, want no problems", problems)
+	}
+
+	invalid := &config.ProviderConfig{
+		Include: []string{"owner/", "re:owner/("},
+		Exclude: []string{"owner/[repo"},
+	}
+	problems := CheckPatterns(invalid)
+	if len(problems) != 2 {
+		t.Fatalf("CheckPatterns() returned %d problems, want 2", len(problems))
+	}
+	if problems[0].Field != "include" || problems[0].Index != 1 {
+		t.Errorf("CheckPatterns()[0] = %s[%d], want include[1]", problems[0].Field, problems[0].Index)
+	}
+	if problems[1].Field != "exclude" || problems[1].Index != 0 {
+		t.Errorf("CheckPatterns()[1] = %s[%d], want exclude[0]", problems[1].Field, problems[1].Index)
+	}
+}
+
+func TestFilterRepositoriesByAttributes(t *testing.T) {
+	testRepos := []repository.Repository{
+		{Id: 1, FullName: "owner/plain"},
+		{Id: 2, FullName: "owner/fork", Fork: true},
+		{Id: 3, FullName: "owner/archived", Archived: true, Private: true},
+		{Id: 4, FullName: "owner/mirror", Mirror: true},
+		{Id: 5, FullName: "owner/template", Template: true, Private: true},
+	}
+
+	tests := []struct {
+		name        string
+		provider    config.ProviderConfig
+		expectedIDs []int
+	}{
+		{
+			name:        "No attribute filters",
+			provider:    config.ProviderConfig{Visibility: config.VisibilityAll},
+			expectedIDs: []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:        "Skip forks and archived",
+			provider:    config.ProviderConfig{SkipForks: true, SkipArchived: true},
+			expectedIDs: []int{1, 4, 5},
+		},
+		{
+			name:        "Skip mirrors and templates",
+			provider:    config.ProviderConfig{SkipMirrors: true, SkipTemplates: true},
+			expectedIDs: []int{1, 2, 3},
+		},
+		{
+			name:        "Private only",
+			provider:    config.ProviderConfig{Visibility: config.VisibilityPrivate},
+			expectedIDs: []int{3, 5},
+		},
+		{
+			name:        "Public only",
+			provider:    config.ProviderConfig{Visibility: config.VisibilityPublic},
+			expectedIDs: []int{1, 2, 4},
+		},
+		{
+			name:        "Attribute and name filters",
+			provider:    config.ProviderConfig{SkipForks: true, Include: []string{"owner/*"}, Exclude: []string{"owner/mirror"}},
+			expectedIDs: []int{1, 3, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered := FilterRepositories(testRepos, &tt.provider, true)
+
+			var filteredIDs []int
+			for _, repo := range filtered {
+				filteredIDs = append(filteredIDs, repo.Id)
+			}
+			if !reflect.DeepEqual(filteredIDs, tt.expectedIDs) {
+				t.Errorf("FilterRepositories() got = %v, want %v", filteredIDs, tt.expectedIDs)
+			}
+		})
+	}
+}
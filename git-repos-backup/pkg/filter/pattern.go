@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix marks a filter entry as a regular expression
+const RegexPrefix = "re:"
+
+// patternKind defines how a filter entry is matched
+type patternKind int
+
+const (
+	// patternExact matches a repository full name exactly
+	patternExact patternKind = iota
+	// patternOwner matches all the repositories of an owner (entries ending with "/")
+	patternOwner
+	// patternGlob matches full names using shell glob syntax (entries containing *, ? or [),
+	// or repository names when the entry has no "/"
+	patternGlob
+	// patternRegex matches full names using a regular expression (entries starting with "re:")
+	patternRegex
+)
+
+// Pattern matches repository full names against a single include or exclude entry.
+//
+// Supported entries:
+//   - `owner/repo`: exact full name
+//   - `owner/`: all the repositories of an owner (including GitLab subgroups)
+//   - `owner/*-archive`: glob pattern, where `*` does not match `/` and `**` matches any path
+//   - `*-archive`: glob pattern without `/`, matched against the repository name only
+//   - `re:^team-.*-svc$`: regular expression, matched anywhere in the full name unless anchored
+type Pattern struct {
+	raw   string
+	kind  patternKind
+	regex *regexp.Regexp
+}
+
+// ParsePattern parses a single include or exclude entry
+func ParsePattern(entry string) (*Pattern, error) {
+	p := &Pattern{raw: entry}
+
+	switch {
+	case strings.HasPrefix(entry, RegexPrefix):
+		regex, err := regexp.Compile(strings.TrimPrefix(entry, RegexPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in filter %q: %w", entry, err)
+		}
+		p.kind = patternRegex
+		p.regex = regex
+	case strings.HasSuffix(entry, "/"):
+		p.kind = patternOwner
+	case strings.ContainsAny(entry, "*?["):
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern in filter %q: %w", entry, err)
+		}
+		regex, err := regexp.Compile(globRegex(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern in filter %q: %w", entry, err)
+		}
+		p.kind = patternGlob
+		p.regex = regex
+	default:
+		p.kind = patternExact
+	}
+
+	return p, nil
+}
+
+// Match reports whether a repository full name matches the pattern
+func (p *Pattern) Match(fullName string) bool {
+	switch p.kind {
+	case patternRegex:
+		return p.regex.MatchString(fullName)
+	case patternOwner:
+		return strings.HasPrefix(fullName, p.raw)
+	case patternGlob:
+		if !strings.Contains(p.raw, "/") {
+			// Slash-free globs select repositories by name, in any owner or GitLab subgroup
+			fullName = fullName[strings.LastIndex(fullName, "/")+1:]
+		}
+		return p.regex.MatchString(fullName)
+	default:
+		return fullName == p.raw
+	}
+}
+
+// String returns the entry the pattern was parsed from
+func (p *Pattern) String() string {
+	return p.raw
+}
+
+// globRegex converts a glob pattern to an anchored regular expression: `**` matches any sequence of
+// characters, `*` and `?` do not match `/`, and character classes and escapes follow path.Match
+func globRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := i + 1
+			if end < len(glob) && glob[end] == '^' {
+				end++
+			}
+			if end < len(glob) && glob[end] == ']' {
+				end++
+			}
+			for end < len(glob) && glob[end] != ']' {
+				if glob[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			// Ranges, negation (^) and escapes have the same syntax in regular expression classes
+			b.WriteString("[" + glob[i+1:end] + "]")
+			i = end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		entry    string
+		fullName string
+		want     bool
+	}{
+		// Exact names
+		{entry: "owner/repo", fullName: "owner/repo", want: true},
+		{entry: "owner/repo", fullName: "owner/repo2", want: false},
+		{entry: "owner/repo", fullName: "other/owner/repo", want: false},
+		// Owner entries
+		{entry: "myorg/", fullName: "myorg/repo", want: true},
+		{entry: "myorg/", fullName: "myorg/subgroup/repo", want: true},
+		{entry: "myorg/", fullName: "myorg2/repo", want: false},
+		// Glob patterns
+		{entry: "infra/*", fullName: "infra/terraform", want: true},
+		{entry: "infra/*", fullName: "infra/sub/terraform", want: false},
+		{entry: "*/*-archive", fullName: "owner/old-archive", want: true},
+		{entry: "*/*-archive", fullName: "owner/archive-old", want: false},
+		{entry: "owner/repo?", fullName: "owner/repo1", want: true},
+		{entry: "owner/repo[0-9]", fullName: "owner/repoa", want: false},
+		{entry: "owner/repo[^0-9]", fullName: "owner/repoa", want: true},
+		{entry: "owner/repo\\*", fullName: "owner/repo*", want: true},
+		{entry: "owner/repo\\*", fullName: "owner/repo1", want: false},
+		// Slash-free globs match the repository name
+		{entry: "*-archive", fullName: "owner/old-archive", want: true},
+		{entry: "*-archive", fullName: "infra/sub/old-archive", want: true},
+		{entry: "*-archive", fullName: "old-archive/repo", want: false},
+		// Globs matching nested GitLab namespaces
+		{entry: "infra/**", fullName: "infra/sub/repo", want: true},
+		{entry: "infra/**", fullName: "infra/repo", want: true},
+		{entry: "infra/**", fullName: "infra2/repo", want: false},
+		{entry: "**/*-archive", fullName: "infra/sub/old-archive", want: true},
+		{entry: "**/*-archive", fullName: "infra/sub-archive/repo", want: false},
+		{entry: "infra/*/repo", fullName: "infra/sub/repo", want: true},
+		{entry: "infra/*/repo", fullName: "infra/a/b/repo", want: false},
+		// Regular expressions
+		{entry: "re:^team-.*-svc$", fullName: "team-a-svc", want: true},
+		{entry: "re:^myorg/team-.*-svc$", fullName: "myorg/team-billing-svc", want: true},
+		{entry: "re:^myorg/team-.*-svc$", fullName: "myorg/team-billing-web", want: false},
+		{entry: "re:legacy", fullName: "owner/legacy-app", want: true},
+		{entry: "re:(?i)^OWNER/", fullName: "owner/repo", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry+" "+tt.fullName, func(t *testing.T) {
+			p, err := ParsePattern(tt.entry)
+			if err != nil {
+				t.Fatalf("ParsePattern(%q) error = %v", tt.entry, err)
+			}
+			if got := p.Match(tt.fullName); got != tt.want {
+				t.Errorf("Pattern(%q).Match(%q) = %v, want %v", tt.entry, tt.fullName, got, tt.want)
+			}
+			if p.String() != tt.entry {
+				t.Errorf("Pattern.String() = %q, want %q", p.String(), tt.entry)
+			}
+		})
+	}
+}